@@ -335,6 +335,58 @@ var disabledCipherSuites = []uint16{
 	TLS_RSA_WITH_RC4_128_SHA,
 }
 
+// strongCipherSuites are the TLS 1.0–1.2 cipher suites allowed by
+// RequireStrongCiphers: AEADs with forward secrecy only. All TLS 1.3 cipher
+// suites already meet this bar.
+var strongCipherSuites = []uint16{
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// strongCurves are the key exchange groups allowed by RequireStrongCurves.
+var strongCurves = []CurveID{X25519, CurveP256, CurveP384}
+
+// RequireStrongCiphers restricts config to forward-secret AEAD cipher suites
+// and at least TLS 1.2. If the peer has none of them in common, the handshake
+// fails with an InsufficientSecurityError.
+func RequireStrongCiphers(config *Config) {
+	config.CipherSuites = append([]uint16(nil), strongCipherSuites...)
+	if config.MinVersion < VersionTLS12 {
+		config.MinVersion = VersionTLS12
+	}
+	config.requireStrongCiphers = true
+}
+
+// RequireStrongCurves restricts config to the X25519, P-256 and P-384 key
+// exchange groups. If the peer has none of them in common, the handshake
+// fails with an InsufficientSecurityError.
+func RequireStrongCurves(config *Config) {
+	config.CurvePreferences = append([]CurveID(nil), strongCurves...)
+	config.requireStrongCurves = true
+}
+
+// InsufficientSecurityError is returned when a handshake fails because a
+// strong-only policy left no cipher suite or curve in common with the peer.
+// A server reports it when its own negotiation shows this; a strong-only
+// client only when the server answers with an insufficient_security alert,
+// as a handshake_failure alert does not say what went wrong.
+type InsufficientSecurityError struct {
+	// Msg describes what could not be negotiated.
+	Msg string
+	// Err is the underlying failure, such as the peer's alert, if any.
+	Err error
+}
+
+func (e *InsufficientSecurityError) Error() string {
+	if e.Err != nil {
+		return "tls: " + e.Msg + ": " + e.Err.Error()
+	}
+	return "tls: " + e.Msg
+}
+
+func (e *InsufficientSecurityError) Unwrap() error { return e.Err }
+
 var (
 	defaultCipherSuitesLen = len(cipherSuitesPreferenceOrder) - len(disabledCipherSuites)
 	defaultCipherSuites    = cipherSuitesPreferenceOrder[:defaultCipherSuitesLen]
@@ -92,6 +92,7 @@ const (
 	extensionSignatureAlgorithms     uint16 = 13
 	extensionALPN                    uint16 = 16
 	extensionSCT                     uint16 = 18
+	extensionDelegatedCredential     uint16 = 34
 	extensionSessionTicket           uint16 = 35
 	extensionPreSharedKey            uint16 = 41
 	extensionEarlyData               uint16 = 42
@@ -229,6 +230,11 @@ type ConnectionState struct {
 	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_AES_128_GCM_SHA256).
 	CipherSuite uint16
 
+	// CurveID is the key exchange group used by the connection (e.g.
+	// X25519). It is zero if no ECDHE key exchange took place, such as for
+	// RSA key exchange or a TLS 1.2 session resumption.
+	CurveID CurveID
+
 	// NegotiatedProtocol is the application protocol negotiated with ALPN.
 	NegotiatedProtocol string
 
@@ -267,6 +273,15 @@ type ConnectionState struct {
 	// response provided by the peer for the leaf certificate, if any.
 	OCSPResponse []byte
 
+	// DelegatedCredential reports whether the server authenticated with a
+	// delegated credential (RFC 9345) instead of its certificate key. It is
+	// only ever true for TLS 1.3 connections that did not resume a session.
+	DelegatedCredential bool
+
+	// FalseStart reports whether the client sent application data before
+	// receiving the server's Finished message; see Config.EnableFalseStart.
+	FalseStart bool
+
 	// TLSUnique contains the "tls-unique" channel binding value (see RFC 5929,
 	// Section 3). This value will be nil for TLS 1.3 connections and for all
 	// resumed connections.
@@ -725,6 +740,66 @@ type Config struct {
 	// used for debugging.
 	KeyLogWriter io.Writer
 
+	// RequireStapledOCSP makes a client reject servers that do not staple
+	// an OCSP response with a good status for their certificate, as
+	// certificates with the OCSP must-staple extension expect. The staple
+	// is checked with VerifyOCSPResponse and a failure is reported as an
+	// *OCSPStapleError. Servers ignore this field.
+	RequireStapledOCSP bool
+
+	// RevocationHardFail makes Conn.VerifyHostnameWithRevocation fail
+	// when the revocation status of the server certificate cannot be
+	// established, instead of accepting the certificate.
+	RevocationHardFail bool
+
+	// OCSPFetcher, if not nil, is called by
+	// Conn.VerifyHostnameWithRevocation to send the DER-encoded OCSP
+	// request to the responder at server and return the raw response.
+	// Returning promptly once ctx is done is up to the fetcher. If nil,
+	// only a stapled response is consulted. The wrapper package's
+	// HTTPOCSPFetcher provides one over HTTP.
+	OCSPFetcher func(ctx context.Context, server string, request []byte) ([]byte, error)
+
+	// MaxRecordsPerHandshake makes servers abort the handshake with a
+	// *FragmentationError once the client has sent more than this many
+	// handshake records, as a ClientHello split into tiny fragments to
+	// evade inspection would. Zero means no limit. Clients ignore it.
+	MaxRecordsPerHandshake int
+
+	// MinRecordSize makes servers abort the handshake with a
+	// *FragmentationError when a client handshake record that stops in
+	// the middle of a handshake message carries fewer than this many
+	// bytes. Records that complete a message may be smaller. Zero means
+	// no limit. Clients ignore it.
+	MinRecordSize int
+
+	// SupportDelegatedCredential makes a client advertise support for
+	// delegated credentials (RFC 9345) in TLS 1.3, letting servers that
+	// have a Certificate.DelegatedCredential sign the handshake with the
+	// short-lived credential key. A client that did not set it rejects
+	// delegated credentials. Servers ignore this field.
+	SupportDelegatedCredential bool
+
+	// EnableFalseStart lets a client send application data right after
+	// its Finished message in a full TLS 1.2 handshake, without waiting a
+	// round trip for the server's (TLS False Start, RFC 7918). Handshake
+	// then returns as soon as the client's Finished is sent, and the first
+	// Read completes the handshake by checking the server's Finished. It
+	// is only used when the cipher suite has a forward-secret ECDHE key
+	// exchange and an AEAD cipher, and the server negotiated an ALPN
+	// protocol, which is the signal browsers take that a server tolerates
+	// early data. ConnectionState().FalseStart reports when it was used.
+	// TLS 1.3 and resumed handshakes already let the client write first.
+	// Servers ignore this field.
+	EnableFalseStart bool
+
+	// AllowSecretExport lets Conn.ExportSecrets return the traffic secrets
+	// of connections using this Config, for analysis tooling that cannot
+	// read a KeyLogWriter file. Anyone holding the secrets can decrypt the
+	// traffic, so it must only be set while debugging. It defaults to
+	// false.
+	AllowSecretExport bool
+
 	// mutex protects sessionTicketKeys and autoSessionTicketKeys.
 	mutex sync.RWMutex
 	// sessionTicketKeys contains zero or more ticket keys. If set, it means the
@@ -736,6 +811,20 @@ type Config struct {
 	// autoSessionTicketKeys is like sessionTicketKeys but is owned by the
 	// auto-rotation logic. See Config.ticketKeys.
 	autoSessionTicketKeys []ticketKey
+
+	// requireStrongCiphers and requireStrongCurves record that the strong-only
+	// policy of RequireStrongCiphers or RequireStrongCurves is in effect, so
+	// that a failed negotiation is reported as an InsufficientSecurityError.
+	requireStrongCiphers bool
+	requireStrongCurves  bool
+
+	// grease makes clients add GREASE values to the ClientHello; see
+	// WithGREASE.
+	grease bool
+
+	// exactCipherOrder makes clients offer CipherSuites as given instead of
+	// in the built-in preference order; see SetCipherOrder.
+	exactCipherOrder bool
 }
 
 const (
@@ -814,8 +903,20 @@ func (c *Config) Clone() *Config {
 		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
 		Renegotiation:               c.Renegotiation,
 		KeyLogWriter:                c.KeyLogWriter,
+		RequireStapledOCSP:          c.RequireStapledOCSP,
+		RevocationHardFail:          c.RevocationHardFail,
+		OCSPFetcher:                 c.OCSPFetcher,
+		MaxRecordsPerHandshake:      c.MaxRecordsPerHandshake,
+		MinRecordSize:               c.MinRecordSize,
+		SupportDelegatedCredential:  c.SupportDelegatedCredential,
+		EnableFalseStart:            c.EnableFalseStart,
+		AllowSecretExport:           c.AllowSecretExport,
 		sessionTicketKeys:           c.sessionTicketKeys,
 		autoSessionTicketKeys:       c.autoSessionTicketKeys,
+		requireStrongCiphers:        c.requireStrongCiphers,
+		requireStrongCurves:         c.requireStrongCurves,
+		grease:                      c.grease,
+		exactCipherOrder:            c.exactCipherOrder,
 	}
 }
 
@@ -1041,6 +1142,146 @@ func (c *Config) supportsCurve(curve CurveID) bool {
 	return false
 }
 
+// CloneConfig returns a copy of config that shares no mutable slices or maps
+// with it, so the copy can be modified without affecting config or any
+// connection using it. Unlike Config.Clone, the Certificates, NextProtos,
+// CipherSuites and CurvePreferences slices and the NameToCertificate map
+// are copied. Callbacks, CA pools, the session cache and the session ticket
+// keys are still shared. A nil config yields a new default Config.
+func CloneConfig(config *Config) *Config {
+	if config == nil {
+		return &Config{}
+	}
+	c := config.Clone()
+	// Copy with make so that a non-nil empty slice, which for CipherSuites
+	// means something different from nil, stays non-nil.
+	if c.Certificates != nil {
+		c.Certificates = append(make([]Certificate, 0, len(c.Certificates)), c.Certificates...)
+	}
+	if c.NextProtos != nil {
+		c.NextProtos = append(make([]string, 0, len(c.NextProtos)), c.NextProtos...)
+	}
+	if c.CipherSuites != nil {
+		c.CipherSuites = append(make([]uint16, 0, len(c.CipherSuites)), c.CipherSuites...)
+	}
+	if c.CurvePreferences != nil {
+		c.CurvePreferences = append(make([]CurveID, 0, len(c.CurvePreferences)), c.CurvePreferences...)
+	}
+	if c.NameToCertificate != nil {
+		m := make(map[string]*Certificate, len(c.NameToCertificate))
+		for name, cert := range c.NameToCertificate {
+			m[name] = cert
+		}
+		c.NameToCertificate = m
+	}
+	return c
+}
+
+// SetRootCAs makes config verify server certificates against pool only,
+// instead of the host's root CA set. A nil pool restores the default.
+func SetRootCAs(config *Config, pool *x509.CertPool) {
+	config.RootCAs = pool
+}
+
+// AddRootCAPEM adds the PEM-encoded certificates in pemCerts to the root
+// CAs config verifies server certificates against. If config has no RootCAs
+// yet, a new pool is created, so the host's root CA set is no longer used.
+// An existing pool is modified in place. It returns an error if pemCerts
+// contains no certificate.
+func AddRootCAPEM(config *Config, pemCerts []byte) error {
+	pool := config.RootCAs
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return errors.New("tls: failed to find any PEM certificate in root CA input")
+	}
+	config.RootCAs = pool
+	return nil
+}
+
+// SetClientCAs makes a server config verify client certificates against
+// pool, when its ClientAuth policy calls for verification.
+func SetClientCAs(config *Config, pool *x509.CertPool) {
+	config.ClientCAs = pool
+}
+
+// SetClientAuth sets the client authentication policy of a server config.
+// With VerifyClientCertIfGiven or RequireAndVerifyClientCert, the verified
+// client chains are reported in ConnectionState.VerifiedChains.
+func SetClientAuth(config *Config, mode ClientAuthType) {
+	config.ClientAuth = mode
+}
+
+// WithMinRSABits returns a copy of config that rejects peers presenting an
+// RSA certificate with a modulus shorter than bits. Every certificate the
+// peer sends is checked, the leaf as well as any intermediates. The check
+// runs before config's own VerifyPeerCertificate, which is kept.
+func WithMinRSABits(config *Config, bits int) *Config {
+	config = CloneConfig(config)
+	next := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.New("tls: failed to parse certificate from peer: " + err.Error())
+			}
+			if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < bits {
+				return fmt.Errorf("tls: peer certificate %d has a %d-bit RSA key, below the required %d bits", i, pub.N.BitLen(), bits)
+			}
+		}
+		if next != nil {
+			return next(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+	return config
+}
+
+// WithGREASE returns a copy of config whose clients add GREASE values
+// (RFC 8701) to the ClientHello, as browsers do, so that its fingerprint
+// does not stand out: a reserved cipher suite, supported group and
+// version, and two reserved extensions, one first and one last. The
+// values are random for each handshake and are never negotiated. With
+// enable false, GREASE is turned off. Servers ignore the setting.
+func WithGREASE(config *Config, enable bool) *Config {
+	config = CloneConfig(config)
+	config.grease = enable
+	return config
+}
+
+// SetCipherOrder makes clients offer exactly suites, in this order, such
+// as the order a target client sends, instead of the supported suites of
+// CipherSuites sorted by the built-in preference, which also depends on
+// hardware AES support. Unlike CipherSuites, suites may include TLS 1.3
+// suites, placed where they should appear; if it has none, the default
+// TLS 1.3 suites follow the others when TLS 1.3 is offered. Suites this
+// package does not implement are left out, as are TLS 1.3 suites when TLS
+// 1.3 is not offered and TLS 1.2-only suites when TLS 1.2 is not. Servers
+// keep choosing by the built-in preference. A nil suites restores the
+// defaults and the automatic ordering.
+func (c *Config) SetCipherOrder(suites []uint16) {
+	if suites == nil {
+		c.CipherSuites = nil
+		c.exactCipherOrder = false
+		return
+	}
+	c.CipherSuites = append(make([]uint16, 0, len(suites)), suites...)
+	c.exactCipherOrder = true
+}
+
+// SetCurveOrder makes clients offer exactly curves as supported groups, in
+// this order, with a key share for the first under TLS 1.3. It sets
+// CurvePreferences, whose order clients already follow; a nil curves
+// restores the defaults.
+func (c *Config) SetCurveOrder(curves []CurveID) {
+	if curves == nil {
+		c.CurvePreferences = nil
+		return
+	}
+	c.CurvePreferences = append(make([]CurveID, 0, len(curves)), curves...)
+}
+
 // mutualVersion returns the protocol version to use given the advertised
 // versions of the peer. Priority is given to the peer preference order.
 func (c *Config) mutualVersion(isClient bool, peerVersions []uint16) (uint16, bool) {
@@ -1368,6 +1609,12 @@ type Certificate struct {
 	// using x509.ParseCertificate to reduce per-handshake processing. If nil,
 	// the leaf certificate will be parsed as needed.
 	Leaf *x509.Certificate
+	// DelegatedCredential is an optional delegated credential (RFC 9345)
+	// issued by the leaf certificate, such as one from
+	// NewDelegatedCredential. TLS 1.3 servers send it to clients that
+	// advertise support and sign the handshake with its PrivateKey
+	// instead of the PrivateKey above.
+	DelegatedCredential *DelegatedCredential
 }
 
 // leaf returns the parsed leaf certificate, either from c.Leaf or by parsing
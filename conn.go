@@ -12,6 +12,7 @@ import (
 	"crypto/cipher"
 	"crypto/subtle"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"hash"
@@ -26,6 +27,10 @@ import (
 // It implements the net.Conn interface.
 // Conn represents a secured connection with XTLS extension.
 type Conn struct {
+	// xtlsAlertsStripped counts the alerts removed by xtlsDirectWrite. It
+	// is accessed atomically and kept first for 64-bit alignment.
+	xtlsAlertsStripped uint64
+
 	// Underlying connection and TLS state.
 	conn        net.Conn
 	isClient    bool
@@ -38,8 +43,20 @@ type Conn struct {
 	haveVers        bool
 	config          *Config
 	handshakes      int
+	handshakeRecords int // handshake records received by a server; see checkFragmentation
+	handshakeTime   time.Duration // how long the first successful handshake took
 	didResume       bool
 	cipherSuite     uint16
+	curveID         CurveID
+	delegatedCredential bool // the server signed with an RFC 9345 delegated credential
+
+	// falseStart completes a TLS 1.2 client handshake that returned early
+	// under Config.EnableFalseStart, by reading the server's session ticket
+	// and Finished. falseStartPending is 1 while it has yet to run, which
+	// finishFalseStart does before the first read.
+	falseStart        func() error
+	falseStartPending uint32
+	usedFalseStart    bool
 	ocspResponse    []byte
 	scts            [][]byte
 	peerCertificates []*x509.Certificate
@@ -52,6 +69,14 @@ type Conn struct {
 	clientFinishedIsFirst bool
 	closeNotifyErr  error
 	closeNotifySent bool
+	// writeDeadline is the last write deadline set through SetDeadline or
+	// SetWriteDeadline, which CloseNotify puts back. It is guarded by
+	// deadlineMutex.
+	deadlineMutex sync.Mutex
+	writeDeadline time.Time
+	// closeNotifyRecv is 1 once a close_notify alert has been read from the
+	// peer, accessed atomically so CleanlyClosed does not wait on c.in.
+	closeNotifyRecv int32
 	clientFinished  [12]byte
 	serverFinished  [12]byte
 	clientProtocol  string
@@ -62,6 +87,7 @@ type Conn struct {
 	hand           bytes.Buffer // handshake data waiting to be read
 	buffering      bool         // whether records are buffered in sendBuf
 	sendBuf        []byte       // a buffer of records waiting to be sent
+	writeBuffering bool         // whether SetWriteBuffering asked to batch writes
 
 	bytesSent      int64
 	packetsSent    int64
@@ -71,12 +97,14 @@ type Conn struct {
 	tmp            [16]byte
 
 	// XTLS enhancements
-	xtlsMode           XTLSMode
+	xtlsMode           int32     // XTLSMode, accessed atomically
+	xtlsInitOnce       sync.Once // Runs xtlsInitializeXTLSMode once for Read and Write
 	xtlsInitialized    bool      // Whether XTLS mode detection has completed
 	xtlsDirectReady    bool      // Whether direct mode is ready for full direct
 	xtlsOriginFallback bool      // Fallback to origin logic on anomaly
 	xtlsReadBypass     bool      // If true, all further reads are passthrough
 	xtlsWriteBypass    bool      // If true, all further writes are passthrough
+	xtlsUpgraded       bool      // Whether Upgrade has been called
 
 	// For matching and stateful detection
 	xtlsDataTotal      int
@@ -86,6 +114,66 @@ type Conn struct {
 	xtlsMatchCount     int
 	xtlsFallbackCount  int
 	xtlsDebug          bool
+
+	// xtlsSignature is the prefix expected of the peer's first data in
+	// Origin mode, set by SetOriginSignature; xtlsMatchCount counts the
+	// bytes of it matched so far.
+	xtlsSignature []byte
+
+	// fallbackReason and fallbackDetail record why xtlsOriginFallback was
+	// set, for FallbackReason.
+	fallbackMu     sync.Mutex
+	fallbackReason FallbackReason
+	fallbackDetail string
+
+	// strippedAlerts is a ring of the last alert records removed by
+	// xtlsDirectWrite, sized by SetStrippedAlertHistory. strippedNext is
+	// where the next one goes, which is the oldest once the ring is full.
+	strippedMu     sync.Mutex
+	strippedAlerts [][]byte
+	strippedNext   int
+
+	recordTracer func(dir Direction, contentType uint8, length int)
+
+	// handshakeProgress is called at each handshake stage; see
+	// SetHandshakeProgress.
+	handshakeProgress func(stage string)
+
+	// keyUpdateInterval is set by SetKeyUpdateInterval; lastKeyUpdate is
+	// when the sending keys were last set. Both are guarded by out.
+	keyUpdateInterval time.Duration
+	lastKeyUpdate     time.Time
+
+	// forceAlertStrip makes Direct mode writes strip alerts under TLS 1.3
+	// too; see SetForceAlertStripping.
+	forceAlertStrip bool
+	// benignAlertStrip limits Direct mode stripping to plaintext warning
+	// close_notify records; see SetBenignAlertStripping.
+	benignAlertStrip bool
+
+	// secrets collects the secrets of the handshake for ExportSecrets when
+	// Config.AllowSecretExport is set.
+	secrets *ConnSecrets
+
+	// maxHandshakeSize is the largest handshake message accepted from the
+	// peer, set by SetMaxHandshakeSize; zero means maxHandshake.
+	maxHandshakeSize int
+
+	// tag is the label set by SetTag.
+	tagMu sync.Mutex
+	tag   string
+
+	// clientHello is the first ClientHello received by a server, kept for
+	// ClientJA3 and ClientJA4.
+	clientHello *clientHelloMsg
+
+	// firstWrite holds the bytes queued by QueueFirstWrite.
+	firstWrite []byte
+
+	// abortMutex protects handshakeAborted, which AbortHandshake sets
+	// before closing conn to interrupt a handshake on another goroutine.
+	abortMutex       sync.Mutex
+	handshakeAborted bool
 }
 
 // halfConn, permanentError, and supporting types/consts are omitted for brevity.
@@ -94,13 +182,15 @@ type Conn struct {
 // --- XTLS public API ---
 
 // SetXTLSMode sets the XTLS mode before any handshake or data transfer.
+// It is safe to call concurrently with Read and Write, which use the mode
+// in effect when they start.
 func (c *Conn) SetXTLSMode(mode XTLSMode) {
-	c.xtlsMode = mode
+	atomic.StoreInt32(&c.xtlsMode, int32(mode))
 }
 
 // GetXTLSMode returns the current XTLS mode.
 func (c *Conn) GetXTLSMode() XTLSMode {
-	return c.xtlsMode
+	return XTLSMode(atomic.LoadInt32(&c.xtlsMode))
 }
 
 // EnableXTLSDebug enables debug output for XTLS logic.
@@ -108,6 +198,205 @@ func (c *Conn) EnableXTLSDebug(enable bool) {
 	c.xtlsDebug = enable
 }
 
+// SetTag labels the connection with tag, such as the ID of the request it
+// serves, so that XTLS-level events can be matched with application ones.
+// Debug output enabled by EnableXTLSDebug is prefixed with the tag, and
+// hooks such as a record tracer can fetch it with Tag. It may be called at
+// any time, from any goroutine.
+func (c *Conn) SetTag(tag string) {
+	c.tagMu.Lock()
+	c.tag = tag
+	c.tagMu.Unlock()
+}
+
+// Tag returns the label set by SetTag, or "" if there is none.
+func (c *Conn) Tag() string {
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+	return c.tag
+}
+
+// debugf emits debug output for c, if enabled, prefixed with its tag.
+func (c *Conn) debugf(format string, v ...interface{}) {
+	if !c.xtlsDebug {
+		return
+	}
+	if tag := c.Tag(); tag != "" {
+		format = "[%s] " + format
+		v = append([]interface{}{tag}, v...)
+	}
+	XTLSDebug(true, format, v...)
+}
+
+// SetRecordTracer installs fn to be called for every TLS record read from or
+// written to the connection, with the record's content type and length as
+// seen on the wire. Plaintext is never passed to fn. Records bypassed by
+// Direct mode are not traced. A nil fn disables tracing. It must be set
+// before the connection is used. fn can call Tag to label what it logs.
+func (c *Conn) SetRecordTracer(fn func(dir Direction, contentType uint8, length int)) {
+	c.recordTracer = fn
+}
+
+// Handshake stages reported to a SetHandshakeProgress callback. The
+// strings are stable and may be logged or compared directly.
+const (
+	// HandshakeStageClientHelloSent: the client wrote its ClientHello.
+	HandshakeStageClientHelloSent = "ClientHelloSent"
+	// HandshakeStageClientHelloReceived: the server read the ClientHello.
+	HandshakeStageClientHelloReceived = "ClientHelloReceived"
+	// HandshakeStageServerHelloReceived: the client read the ServerHello.
+	HandshakeStageServerHelloReceived = "ServerHelloReceived"
+	// HandshakeStageCertificateReceived: the client read the server's
+	// certificate chain. Resumed handshakes skip it.
+	HandshakeStageCertificateReceived = "CertificateReceived"
+	// HandshakeStageFinished: the handshake completed on this side.
+	HandshakeStageFinished = "Finished"
+)
+
+// SetHandshakeProgress installs fn to be called with the name of each
+// handshake stage as this side reaches it, in order, so that slow
+// handshakes can be timed stage by stage. A client reports
+// ClientHelloSent, ServerHelloReceived, CertificateReceived and Finished;
+// a server reports ClientHelloReceived and Finished. fn runs on the
+// handshake goroutine and must not block or call back into the connection.
+// It must be set before the handshake; nil disables it.
+func (c *Conn) SetHandshakeProgress(fn func(stage string)) {
+	c.handshakeProgress = fn
+}
+
+// handshakeStage reports stage to the SetHandshakeProgress callback.
+func (c *Conn) handshakeStage(stage string) {
+	if c.handshakeProgress != nil {
+		c.handshakeProgress(stage)
+	}
+}
+
+// SetMaxHandshakeSize caps the length of a handshake message accepted from
+// the peer at n bytes, instead of the default of 65536, to bound the memory
+// a malicious peer can make the connection buffer. The limit is checked
+// against the length in the message header, before the body is read; a
+// larger message aborts the handshake with an internal_error alert and a
+// *HandshakeSizeError. Certificate chains are the largest messages of a
+// normal handshake, so n should leave room for the peer's chain. Zero or
+// less restores the default. It must be called before the handshake.
+func (c *Conn) SetMaxHandshakeSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	c.maxHandshakeSize = n
+}
+
+// SetOriginSignature makes an Origin mode connection check that the
+// application data the peer sends first starts with sig, such as a protocol
+// magic or the header of an inner TLS record. If a byte differs, the data
+// is still delivered, but the connection switches to the Origin fallback
+// logic and FallbackReason reports FallbackSignatureMismatch with the
+// offset, the bytes involved and the peer address. A nil or empty sig, the
+// default, disables the check. It must be called before the first Read.
+func (c *Conn) SetOriginSignature(sig []byte) {
+	c.xtlsSignature = append([]byte(nil), sig...)
+}
+
+// FallbackReason reports why the connection switched to the Origin
+// fallback logic, with an optional detail, or FallbackNone if it has not.
+func (c *Conn) FallbackReason() (FallbackReason, string) {
+	c.fallbackMu.Lock()
+	defer c.fallbackMu.Unlock()
+	return c.fallbackReason, c.fallbackDetail
+}
+
+// originFallback switches c to the Origin fallback logic for reason.
+func (c *Conn) originFallback(reason FallbackReason, detail string) {
+	c.fallbackMu.Lock()
+	c.fallbackReason, c.fallbackDetail = reason, detail
+	c.fallbackMu.Unlock()
+	c.xtlsOriginFallback = true
+	c.xtlsFallbackCount++
+	c.debugf("Falling back to Origin logic: %v: %s", reason, detail)
+}
+
+// checkOriginSignature matches data, the next application data read from
+// the peer, against the rest of the signature set by SetOriginSignature.
+func (c *Conn) checkOriginSignature(data []byte) {
+	sig := c.xtlsSignature
+	for _, b := range data {
+		if c.xtlsOriginFallback || c.xtlsMatchCount >= len(sig) {
+			return
+		}
+		if want := sig[c.xtlsMatchCount]; b != want {
+			c.originFallback(FallbackSignatureMismatch, fmt.Sprintf("byte %d is %#02x, want %#02x, from %v",
+				c.xtlsMatchCount, b, want, c.conn.RemoteAddr()))
+			return
+		}
+		c.xtlsMatchCount++
+	}
+}
+
+// ErrAlreadyUpgraded is returned by Upgrade when the connection has already
+// been upgraded to Direct mode.
+var ErrAlreadyUpgraded = errors.New("tls: connection already upgraded to direct mode")
+
+// Upgrade switches a live connection from Origin to Direct passthrough,
+// typically after an application-level exchange such as HTTP
+// authentication has been completed over TLS. Records waiting to be sent
+// are flushed first, and any data the record layer has already buffered is
+// still returned by subsequent Reads before new bytes from the wire. Both
+// peers must upgrade at the same point in the stream.
+//
+// Upgrade may be called only once; later calls return ErrAlreadyUpgraded.
+// It must not be called concurrently with Read or Write.
+func (c *Conn) Upgrade() error {
+	return c.upgrade(nil)
+}
+
+// SpliceFrom switches the connection to Direct passthrough like Upgrade, and
+// hands prebuffered to the peer as the first raw bytes. It is used when the
+// caller has already read plaintext that belongs to the spliced stream, for
+// example during a Vision or fallback handoff, and must send it before raw
+// copying begins.
+//
+// The peer receives, in order: any records still waiting in the send
+// buffer, then prebuffered verbatim (no record framing and no alert
+// stripping), then the bytes of later Writes. If SpliceFrom returns an
+// error, the connection must be closed, as the peer may have seen only part
+// of that sequence. Like Upgrade, it may be called only once.
+func (c *Conn) SpliceFrom(prebuffered []byte) error {
+	return c.upgrade(prebuffered)
+}
+
+func (c *Conn) upgrade(prebuffered []byte) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.xtlsUpgraded {
+		return ErrAlreadyUpgraded
+	}
+	if err := c.finishFalseStart(); err != nil {
+		return err
+	}
+	if _, err := c.flush(); err != nil {
+		return c.out.setErrorLocked(err)
+	}
+	if len(prebuffered) > 0 {
+		if _, err := c.conn.Write(prebuffered); err != nil {
+			return c.out.setErrorLocked(err)
+		}
+	}
+	c.xtlsUpgraded = true
+	c.SetXTLSMode(XTLSModeDirect)
+	c.xtlsDirectReady = true
+	c.xtlsReadBypass = true
+	c.xtlsWriteBypass = true
+	c.debugf("Upgraded to Direct mode")
+	return nil
+}
+
 // --- Core Write/Read Methods with XTLS logic ---
 
 func (c *Conn) Write(b []byte) (int, error) {
@@ -115,9 +404,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return c.xtlsDirectWrite(b)
 	}
 
-	if !c.xtlsInitialized {
-		c.xtlsInitializeXTLSMode()
-	}
+	c.xtlsInitOnce.Do(c.xtlsInitializeXTLSMode)
 
 	// For Direct mode: after the protocol detection/transition, all writes become passthrough
 	if c.xtlsDirectReady {
@@ -130,7 +417,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return c.xtlsOriginWriteFallback(b)
 	}
 
-	switch c.xtlsMode {
+	switch c.GetXTLSMode() {
 	case XTLSModeDirect:
 		return c.xtlsDirectWrite(b)
 	case XTLSModeOrigin:
@@ -146,9 +433,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 		return c.xtlsDirectRead(b)
 	}
 
-	if !c.xtlsInitialized {
-		c.xtlsInitializeXTLSMode()
-	}
+	c.xtlsInitOnce.Do(c.xtlsInitializeXTLSMode)
 
 	// For Direct mode: after the protocol detection/transition, all reads become passthrough
 	if c.xtlsDirectReady {
@@ -161,7 +446,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 		return c.xtlsOriginReadFallback(b)
 	}
 
-	switch c.xtlsMode {
+	switch c.GetXTLSMode() {
 	case XTLSModeDirect:
 		return c.xtlsDirectRead(b)
 	case XTLSModeOrigin:
@@ -190,21 +475,139 @@ func (c *Conn) xtlsInitializeXTLSMode() {
 // --- XTLS Direct Mode Logic ---
 
 // xtlsDirectWrite strips trailing TLS1.2 alert (21 3 3 0 26) if present and writes directly.
+// On TLS 1.3 connections nothing is stripped unless SetForceAlertStripping
+// asked for it. With SetBenignAlertStripping only trailing close_notify
+// records are stripped instead.
 func (c *Conn) xtlsDirectWrite(b []byte) (int, error) {
+	if c.benignAlertStrip {
+		return c.xtlsDirectWriteBenign(b)
+	}
 	const alertPatternLen = 5
 	alertPattern := []byte{0x15, 0x03, 0x03, 0x00, 0x1a}
-	if len(b) >= alertPatternLen && bytes.Equal(b[len(b)-alertPatternLen:], alertPattern) {
+	if len(b) >= alertPatternLen && bytes.Equal(b[len(b)-alertPatternLen:], alertPattern) &&
+		alertStrippingApplies(c.vers, c.forceAlertStrip) {
 		n, err := c.conn.Write(b[:len(b)-alertPatternLen])
 		if err != nil {
 			return n, err
 		}
+		atomic.AddUint64(&c.xtlsAlertsStripped, 1)
+		c.recordStrippedAlert(b[len(b)-alertPatternLen:])
+		c.debugf("Removed a trailing alert record from a Direct write")
 		return n + alertPatternLen, nil
 	}
 	return c.conn.Write(b)
 }
 
-// xtlsDirectRead reads directly from the underlying net.Conn.
+// xtlsDirectWriteBenign writes b directly without the trailing alert
+// records that RemoveBenignTrailingAlerts strips.
+func (c *Conn) xtlsDirectWriteBenign(b []byte) (int, error) {
+	if !alertStrippingApplies(c.vers, c.forceAlertStrip) {
+		return c.conn.Write(b)
+	}
+	head, count := RemoveBenignTrailingAlerts(b)
+	if count == 0 {
+		return c.conn.Write(b)
+	}
+	n, err := c.conn.Write(head)
+	if err != nil {
+		return n, err
+	}
+	atomic.AddUint64(&c.xtlsAlertsStripped, uint64(count))
+	for rest := b[len(head):]; len(rest) > 0; rest = rest[7:] {
+		c.recordStrippedAlert(rest[:7])
+	}
+	c.debugf("Removed %d trailing close_notify records from a Direct write", count)
+	return len(b), nil
+}
+
+// SetBenignAlertStripping makes Direct mode writes strip only trailing
+// plaintext warning-level close_notify records, as RemoveBenignTrailingAlerts
+// does, instead of the encrypted alert header stripped by default. Only
+// alerts sent before the handshake keys are in use can be told apart this
+// way: once the connection is established every alert is encrypted, its
+// level and description cannot be read, and it is treated as not benign
+// and sent. It must be called before the connection is used.
+func (c *Conn) SetBenignAlertStripping(benign bool) {
+	c.benignAlertStrip = benign
+}
+
+// SetForceAlertStripping makes Direct mode writes strip trailing alert
+// records even after TLS 1.3 was negotiated. By default they are only
+// stripped on TLS 1.2 and earlier, where alerts travel as plaintext alert
+// records: under TLS 1.3 every record, alerts included, is sent as
+// application data, so bytes that look like an alert are most likely data
+// and stripping them would corrupt the stream. It must be called before
+// the connection is used.
+func (c *Conn) SetForceAlertStripping(force bool) {
+	c.forceAlertStrip = force
+}
+
+// AlertsStripped returns the number of trailing TLS alerts that Direct mode
+// writes have removed instead of sending.
+func (c *Conn) AlertsStripped() uint64 {
+	return atomic.LoadUint64(&c.xtlsAlertsStripped)
+}
+
+// SetStrippedAlertHistory makes the connection keep copies of the last n
+// alert records that Direct mode writes strip, for RecentStrippedAlerts.
+// Zero, the default, keeps none. Changing n discards the history.
+func (c *Conn) SetStrippedAlertHistory(n int) {
+	if n < 0 {
+		n = 0
+	}
+	c.strippedMu.Lock()
+	defer c.strippedMu.Unlock()
+	c.strippedAlerts = make([][]byte, 0, n)
+	c.strippedNext = 0
+}
+
+// RecentStrippedAlerts returns copies of the most recently stripped alert
+// records, oldest first, as kept by SetStrippedAlertHistory.
+func (c *Conn) RecentStrippedAlerts() [][]byte {
+	c.strippedMu.Lock()
+	defer c.strippedMu.Unlock()
+	alerts := make([][]byte, 0, len(c.strippedAlerts))
+	for i := range c.strippedAlerts {
+		rec := c.strippedAlerts[(c.strippedNext+i)%len(c.strippedAlerts)]
+		alerts = append(alerts, append([]byte(nil), rec...))
+	}
+	return alerts
+}
+
+// recordStrippedAlert adds a copy of rec to the stripped alert history.
+func (c *Conn) recordStrippedAlert(rec []byte) {
+	c.strippedMu.Lock()
+	defer c.strippedMu.Unlock()
+	if cap(c.strippedAlerts) == 0 {
+		return
+	}
+	rec = append([]byte(nil), rec...)
+	if len(c.strippedAlerts) < cap(c.strippedAlerts) {
+		c.strippedAlerts = append(c.strippedAlerts, rec)
+		return
+	}
+	c.strippedAlerts[c.strippedNext] = rec
+	c.strippedNext = (c.strippedNext + 1) % len(c.strippedAlerts)
+}
+
+// xtlsDirectRead reads directly from the underlying net.Conn. Data the
+// record layer buffered before the switch to Direct mode is returned first,
+// so that no bytes are lost or reordered.
 func (c *Conn) xtlsDirectRead(b []byte) (int, error) {
+	if atomic.LoadUint32(&c.falseStartPending) == 1 {
+		c.in.Lock()
+		err := c.finishFalseStart()
+		c.in.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if c.input.Len() > 0 {
+		return c.input.Read(b)
+	}
+	if c.rawInput.Len() > 0 {
+		return c.rawInput.Read(b)
+	}
 	return c.conn.Read(b)
 }
 
@@ -236,13 +639,17 @@ func (c *Conn) xtlsOriginWrite(b []byte) (int, error) {
 	}
 
 	if !c.handshakeComplete() {
-		return 0, errors.New("tls: handshake not complete")
+		return 0, ErrNotHandshaken
 	}
 
 	if c.closeNotifySent {
 		return 0, errors.New("tls: connection is closed")
 	}
 
+	if err := c.maybeUpdateKeysLocked(); err != nil {
+		return 0, c.out.setErrorLocked(err)
+	}
+
 	var m int
 	if len(b) > 1 && c.vers == VersionTLS10 {
 		if _, ok := c.out.cipher.(cipher.BlockMode); ok {
@@ -270,6 +677,9 @@ func (c *Conn) xtlsOriginRead(b []byte) (int, error) {
 	c.in.Lock()
 	defer c.in.Unlock()
 
+	if err := c.finishFalseStart(); err != nil {
+		return 0, err
+	}
 	for c.input.Len() == 0 {
 		if err := c.readRecord(); err != nil {
 			return 0, err
@@ -282,9 +692,14 @@ func (c *Conn) xtlsOriginRead(b []byte) (int, error) {
 	}
 
 	n, _ := c.input.Read(b)
-
-	// Handle close-notify alert, see original code.
-	if n != 0 && c.input.Len() == 0 && c.rawInput.Len() > 0 &&
+	c.checkOriginSignature(b[:n])
+
+	// If a complete alert record (most likely a close_notify) is already
+	// buffered, process it now so that the caller sees io.EOF together with
+	// the last data. A record that has only partly arrived is left alone:
+	// its type byte alone is not enough to act on, and reading the rest
+	// would block the data that is ready to be returned.
+	if n != 0 && c.input.Len() == 0 && c.rawInputHasFullRecord() &&
 		recordType(c.rawInput.Bytes()[0]) == recordTypeAlert {
 		if err := c.readRecord(); err != nil {
 			return n, err // will be io.EOF on closeNotify
@@ -294,6 +709,33 @@ func (c *Conn) xtlsOriginRead(b []byte) (int, error) {
 	return n, nil
 }
 
+// finishFalseStart completes a handshake that returned early under
+// Config.EnableFalseStart, if any, before the first read. A failure is
+// kept as the read error of the connection. The caller holds c.in.
+func (c *Conn) finishFalseStart() error {
+	if c.falseStart == nil {
+		return nil
+	}
+	finish := c.falseStart
+	c.falseStart = nil
+	atomic.StoreUint32(&c.falseStartPending, 0)
+	if err := finish(); err != nil {
+		return c.in.setErrorLocked(err)
+	}
+	return nil
+}
+
+// rawInputHasFullRecord reports whether c.rawInput starts with a complete
+// record, header and body.
+func (c *Conn) rawInputHasFullRecord() bool {
+	raw := c.rawInput.Bytes()
+	if len(raw) < recordHeaderLen {
+		return false
+	}
+	n := int(raw[3])<<8 | int(raw[4])
+	return len(raw) >= recordHeaderLen+n
+}
+
 // --- Origin Fallback Logic (for anomalies, optional, can be extended) ---
 
 func (c *Conn) xtlsOriginWriteFallback(b []byte) (int, error) {
@@ -322,6 +764,9 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetDeadline(t)
 }
 
@@ -335,9 +780,111 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
+// QueueFirstWrite queues b to be sent as the first application data of a
+// client connection, as soon as the handshake completes, the way XTLS
+// Vision clients piggyback the inner protocol's first bytes on the
+// handshake. With TLS 1.3 the bytes leave in the same write as the
+// client's Finished message, saving a round trip compared to Handshake
+// followed by Write. In Direct mode they are sent raw, like every Direct
+// write; otherwise they are sent in application data records.
+//
+// Queued bytes are sent in the order they were queued and before anything
+// passed to Write. QueueFirstWrite must be called before the handshake;
+// it returns an error on servers and once the handshake has completed.
+func (c *Conn) QueueFirstWrite(b []byte) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if !c.isClient {
+		return errors.New("tls: QueueFirstWrite called on a server connection")
+	}
+	if c.handshakeComplete() {
+		return errors.New("tls: QueueFirstWrite called after the handshake")
+	}
+	c.firstWrite = append(c.firstWrite, b...)
+	return nil
+}
+
+// SetWriteBuffering controls write batching. While it is enabled, records
+// written after the handshake are kept in memory until Flush is called,
+// the buffer is disabled again, or an alert such as close_notify is sent,
+// so that several small writes can leave in a single packet. If it is
+// enabled before the handshake, it takes effect once the handshake
+// completes. Direct mode writes bypass the record layer and are never
+// buffered.
+func (c *Conn) SetWriteBuffering(enable bool) error {
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.writeBuffering = enable
+	if !c.handshakeComplete() {
+		return nil
+	}
+	if enable {
+		c.buffering = true
+		return nil
+	}
+	_, err := c.flush()
+	return err
+}
+
+// Buffered returns the number of bytes written but not yet sent to the
+// underlying connection, including record overhead. It is only non-zero
+// while write buffering is enabled or a handshake flight is being built.
+func (c *Conn) Buffered() int {
+	c.out.Lock()
+	defer c.out.Unlock()
+	return len(c.sendBuf)
+}
+
+// Flush sends any buffered records to the underlying connection. It is a
+// no-op when nothing is buffered and before the handshake completes, so it
+// is always safe to call.
+func (c *Conn) Flush() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+	if !c.handshakeComplete() {
+		return nil
+	}
+	_, err := c.flush()
+	c.buffering = c.writeBuffering
+	return err
+}
+
+// writeFirstQueued sends the bytes queued by QueueFirstWrite. While the
+// final handshake flight is still buffered, they join it.
+func (c *Conn) writeFirstQueued() error {
+	if len(c.firstWrite) == 0 {
+		return nil
+	}
+	data := c.firstWrite
+	c.firstWrite = nil
+	if c.GetXTLSMode() == XTLSModeDirect || c.xtlsDirectReady {
+		c.out.Lock()
+		defer c.out.Unlock()
+		_, err := c.write(data)
+		return err
+	}
+	_, err := c.writeRecord(recordTypeApplicationData, data)
+	return err
+}
+
+// IsClient reports whether c was created by Client or Dial, that is,
+// whether it plays the client role in the handshake.
+func (c *Conn) IsClient() bool {
+	return c.isClient
+}
+
+// IsServer reports whether c was created by Server, that is, whether it
+// plays the server role in the handshake.
+func (c *Conn) IsServer() bool {
+	return !c.isClient
+}
+
 // NetConn returns the underlying connection that is wrapped by c.
 // Note that writing to or reading from this connection directly will corrupt the
 // TLS session.
@@ -849,6 +1396,10 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		return err
 	}
 
+	if c.recordTracer != nil {
+		c.recordTracer(DirectionRead, uint8(typ), n)
+	}
+
 	// Process message.
 	record := c.rawInput.Next(recordHeaderLen + n)
 	data, typ, err := c.in.decrypt(record)
@@ -883,6 +1434,7 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
 		if alert(data[1]) == alertCloseNotify {
+			atomic.StoreInt32(&c.closeNotifyRecv, 1)
 			return c.in.setErrorLocked(io.EOF)
 		}
 		if c.vers == VersionTLS13 {
@@ -940,11 +1492,78 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
 		c.hand.Write(data)
+		if !handshakeComplete && !c.isClient {
+			if err := c.checkFragmentation(len(data)); err != nil {
+				return c.in.setErrorLocked(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// FragmentationError is returned by a server handshake that the client
+// split into more records than Config.MaxRecordsPerHandshake allows, or
+// into a record smaller than Config.MinRecordSize.
+type FragmentationError struct {
+	// Records is the number of handshake records received so far.
+	Records int
+	// Size is the length of the record that was too small, or zero if
+	// the record count was exceeded.
+	Size int
+}
+
+func (e *FragmentationError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("tls: handshake fragmented into a %d-byte record", e.Size)
 	}
+	return fmt.Sprintf("tls: handshake fragmented into more than %d records", e.Records-1)
+}
+
+// HandshakeSizeError is returned when the peer sends a handshake message
+// longer than the connection accepts; see Conn.SetMaxHandshakeSize.
+type HandshakeSizeError struct {
+	// Size is the length announced in the message header.
+	Size int
+	// Max is the largest length the connection accepted.
+	Max int
+}
+
+func (e *HandshakeSizeError) Error() string {
+	return fmt.Sprintf("tls: handshake message of length %d bytes exceeds maximum of %d bytes", e.Size, e.Max)
+}
 
+// checkFragmentation enforces Config.MaxRecordsPerHandshake and
+// Config.MinRecordSize on a server, for a handshake record of size bytes
+// that was just appended to c.hand.
+func (c *Conn) checkFragmentation(size int) error {
+	c.handshakeRecords++
+	if max := c.config.MaxRecordsPerHandshake; max > 0 && c.handshakeRecords > max {
+		c.sendAlert(alertHandshakeFailure)
+		return &FragmentationError{Records: c.handshakeRecords}
+	}
+	// Records that complete a message may be short; a record that stops
+	// inside one is only there to split it.
+	if size < c.config.MinRecordSize && !handshakeMessagesComplete(c.hand.Bytes()) {
+		c.sendAlert(alertHandshakeFailure)
+		return &FragmentationError{Records: c.handshakeRecords, Size: size}
+	}
 	return nil
 }
 
+// handshakeMessagesComplete reports whether b ends at a handshake message
+// boundary.
+func handshakeMessagesComplete(b []byte) bool {
+	for len(b) >= 4 {
+		n := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if len(b) < 4+n {
+			return false
+		}
+		b = b[4+n:]
+	}
+	return len(b) == 0
+}
+
 // retryReadRecord recurses into readRecordOrCCS to drop a non-advancing record, like
 // a warning alert, empty application_data, or a change_cipher_spec in TLS 1.3.
 func (c *Conn) retryReadRecord(expectChangeCipherSpec bool) error {
@@ -1005,6 +1624,12 @@ func (c *Conn) sendAlertLocked(err alert) error {
 	c.tmp[1] = byte(err)
 
 	_, writeErr := c.writeRecordLocked(recordTypeAlert, c.tmp[0:2])
+	if c.buffering && c.handshakeComplete() {
+		// Alerts must not wait for Flush when write buffering is on.
+		if _, err := c.flush(); writeErr == nil {
+			writeErr = err
+		}
+	}
 	if err == alertCloseNotify {
 		// closeNotify is a special case in that it isn't an error.
 		return writeErr
@@ -1174,6 +1799,9 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 		if _, err := c.write(outBuf); err != nil {
 			return n, err
 		}
+		if c.recordTracer != nil {
+			c.recordTracer(DirectionWrite, outBuf[0], len(outBuf)-recordHeaderLen)
+		}
 		n += m
 		data = data[m:]
 	}
@@ -1207,9 +1835,13 @@ func (c *Conn) readHandshake() (any, error) {
 
 	data := c.hand.Bytes()
 	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
-	if n > maxHandshake {
+	max := c.maxHandshakeSize
+	if max == 0 {
+		max = maxHandshake
+	}
+	if n > max {
 		c.sendAlertLocked(alertInternalError)
-		return nil, c.in.setErrorLocked(fmt.Errorf("tls: handshake message of length %d bytes exceeds maximum of %d bytes", n, maxHandshake))
+		return nil, c.in.setErrorLocked(&HandshakeSizeError{Size: n, Max: max})
 	}
 	for c.hand.Len() < 4+n {
 		if err := c.readRecord(); err != nil {
@@ -1373,24 +2005,89 @@ func (c *Conn) handleKeyUpdate(keyUpdate *keyUpdateMsg) error {
 		c.out.Lock()
 		defer c.out.Unlock()
 
-		msg := &keyUpdateMsg{}
-		_, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal())
-		if err != nil {
+		if err := c.sendKeyUpdateLocked(false); err != nil {
 			// Surface the error at the next write.
 			c.out.setErrorLocked(err)
 			return nil
 		}
-
-		newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
-		c.out.setTrafficSecret(cipherSuite, newSecret)
 	}
 
 	return nil
 }
 
+// sendKeyUpdateLocked sends a KeyUpdate message, asking the peer to update
+// its keys too if requestUpdate is set, and switches to the next sending
+// keys. The caller holds c.out.
+func (c *Conn) sendKeyUpdateLocked(requestUpdate bool) error {
+	cipherSuite := cipherSuiteTLS13ByID(c.cipherSuite)
+	if cipherSuite == nil {
+		return errors.New("tls: KeyUpdate on a connection without a TLS 1.3 cipher suite")
+	}
+	msg := &keyUpdateMsg{updateRequested: requestUpdate}
+	if _, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal()); err != nil {
+		return err
+	}
+	newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
+	c.out.setTrafficSecret(cipherSuite, newSecret)
+	c.lastKeyUpdate = nowFunc()
+	return nil
+}
+
+// SetKeyUpdateInterval makes a TLS 1.3 connection send a KeyUpdate and
+// switch to new sending keys once d has passed since the handshake or the
+// last update, so that long-lived connections do not encrypt unbounded
+// amounts of data under one key. The check runs before each Origin mode
+// write, so an idle connection updates its keys when it next writes.
+// KeyUpdates from the peer are always handled by the Origin mode read
+// path, which answers those that request one. Direct mode bypasses the
+// record layer in both directions, leaving the keyed state untouched: the
+// bytes it passes are the inner stream's own records, and KeyUpdates
+// within them are for the endpoints of that stream. Zero or less disables
+// it, which is the default; it has no effect before TLS 1.3.
+func (c *Conn) SetKeyUpdateInterval(d time.Duration) {
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.keyUpdateInterval = d
+}
+
+// maybeUpdateKeysLocked sends a KeyUpdate if the SetKeyUpdateInterval
+// interval has passed. The caller holds c.out.
+func (c *Conn) maybeUpdateKeysLocked() error {
+	if c.keyUpdateInterval <= 0 || c.vers != VersionTLS13 ||
+		nowFunc().Sub(c.lastKeyUpdate) < c.keyUpdateInterval {
+		return nil
+	}
+	c.debugf("Updating sending keys after %v", c.keyUpdateInterval)
+	return c.sendKeyUpdateLocked(false)
+}
+
+
+// closeNotifyTimeout bounds the wait for a close_notify alert to be
+// written by Close, CloseWrite and CloseNotify.
+const closeNotifyTimeout = 5 * time.Second
 
 // Close closes the connection.
 func (c *Conn) Close() error {
+	return c.close(closeNotifyTimeout)
+}
+
+// CloseGracefully closes the connection like Close, for callers that need a
+// deterministic clean shutdown: records held by SetWriteBuffering are
+// flushed, then a genuine close_notify record is sent, also in Direct mode,
+// where Write would strip what looks like one, and only then is the
+// underlying connection closed. Flushing and the alert must complete within
+// timeout instead of the five seconds Close allows; zero or less means five
+// seconds. A nil error means the alert was written, though the peer may not
+// have read it yet. As with Close, a Write in progress makes it close
+// without the alert.
+func (c *Conn) CloseGracefully(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = closeNotifyTimeout
+	}
+	return c.close(timeout)
+}
+
+func (c *Conn) close(timeout time.Duration) error {
 	// Interlock with Conn.Write above.
 	var x int32
 	for {
@@ -1414,7 +2111,7 @@ func (c *Conn) Close() error {
 
 	var alertErr error
 	if c.handshakeComplete() {
-		if err := c.closeNotify(); err != nil {
+		if err := c.closeNotifyWithin(timeout); err != nil {
 			alertErr = fmt.Errorf("tls: failed to send closeNotify alert (but connection was closed anyway): %w", err)
 		}
 	}
@@ -1425,6 +2122,20 @@ func (c *Conn) Close() error {
 	return alertErr
 }
 
+// CleanlyClosed reports whether the peer ended the stream with a close_notify
+// alert. When Read has returned io.EOF and CleanlyClosed is false, the
+// connection was cut by a bare TCP FIN or RST, and the data received may have
+// been truncated by an attacker.
+//
+// Only records read through the TLS record layer are inspected. Once the
+// connection is in Direct mode, reads bypass the record layer and alerts are
+// neither parsed nor authenticated, so CleanlyClosed keeps the value it had
+// at the switch; applications relying on Direct mode must detect truncation
+// with their own framing.
+func (c *Conn) CleanlyClosed() bool {
+	return atomic.LoadInt32(&c.closeNotifyRecv) == 1
+}
+
 var errEarlyCloseWrite = errors.New("tls: CloseWrite called before handshake complete")
 
 // CloseWrite shuts down the writing side of the connection. It should only be
@@ -1438,17 +2149,45 @@ func (c *Conn) CloseWrite() error {
 	return c.closeNotify()
 }
 
+var errEarlyCloseNotify = errors.New("tls: CloseNotify called before handshake complete")
+
+// CloseNotify sends a close_notify alert, waiting up to five seconds for it
+// to be written, but leaves the underlying connection open and usable. It is
+// meant for protocols that shut TLS down gracefully and then reuse the TCP
+// connection, for example to hand it to a fallback. Further Writes on c
+// fail; the underlying connection gets back the write deadline last set
+// through SetDeadline or SetWriteDeadline. Close sends the same alert, with
+// the same bound, before closing the connection.
+func (c *Conn) CloseNotify() error {
+	if !c.handshakeComplete() {
+		return errEarlyCloseNotify
+	}
+	err := c.closeNotify()
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	if dlErr := c.conn.SetWriteDeadline(c.writeDeadline); err == nil {
+		err = dlErr
+	}
+	return err
+}
+
 func (c *Conn) closeNotify() error {
+	return c.closeNotifyWithin(closeNotifyTimeout)
+}
+
+// closeNotifyWithin sends a close_notify alert, flushing buffered records
+// first, and gives up after timeout.
+func (c *Conn) closeNotifyWithin(timeout time.Duration) error {
 	c.out.Lock()
 	defer c.out.Unlock()
 
 	if !c.closeNotifySent {
 		// Set a Write Deadline to prevent possibly blocking forever.
-		c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
 		c.closeNotifyErr = c.sendAlertLocked(alertCloseNotify)
 		c.closeNotifySent = true
 		// Any subsequent writes will fail.
-		c.SetWriteDeadline(time.Now())
+		c.conn.SetWriteDeadline(time.Now())
 	}
 	return c.closeNotifyErr
 }
@@ -1489,6 +2228,10 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 		return nil
 	}
 
+	if c.isHandshakeAborted() {
+		return ErrHandshakeAborted
+	}
+
 	handshakeCtx, cancel := context.WithCancel(ctx)
 	// Note: defer this before starting the "interrupter" goroutine
 	// so that we can tell the difference between the input being canceled and
@@ -1508,6 +2251,9 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 			if ctxErr := <-interruptRes; ctxErr != nil {
 				// Return context error to user.
 				ret = ctxErr
+				if ctxErr == context.DeadlineExceeded {
+					ret = &handshakeTimeoutError{err: ctxErr}
+				}
 			}
 		}()
 		go func() {
@@ -1535,10 +2281,29 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 	c.in.Lock()
 	defer c.in.Unlock()
 
+	start := nowFunc()
 	c.handshakeErr = c.handshakeFn(handshakeCtx)
+	if c.isHandshakeAborted() {
+		// AbortHandshake closed the connection before the handshake
+		// completed, so it fails even if handshakeFn got through.
+		atomic.StoreUint32(&c.handshakeStatus, 0)
+		c.handshakeErr = ErrHandshakeAborted
+	}
 	if c.handshakeErr == nil {
+		if c.handshakes == 0 {
+			c.handshakeTime = nowFunc().Sub(start)
+		}
 		c.handshakes++
+		c.out.Lock()
+		c.buffering = c.writeBuffering
+		c.lastKeyUpdate = nowFunc()
+		c.out.Unlock()
 	} else {
+		if isTimeout(c.handshakeErr) {
+			c.handshakeErr = &handshakeTimeoutError{err: c.handshakeErr}
+		} else if c.handshakeErr != ErrHandshakeAborted {
+			c.handshakeErr = c.handshakeAlertError(c.handshakeErr)
+		}
 		// If an error occurred during the handshake try to flush the
 		// alert that might be left in the buffer.
 		c.flush()
@@ -1554,13 +2319,140 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 	return c.handshakeErr
 }
 
-// ConnectionState returns basic TLS details about the connection.
+// HandshakeError is returned by Handshake and HandshakeContext when the
+// handshake failed with a TLS alert, either received from the peer or sent
+// to it, so that certificate problems such as unknown_ca (48) can be told
+// apart from negotiation problems such as handshake_failure (40). Other
+// handshake failures are returned unwrapped.
+type HandshakeError struct {
+	// Err is the error the handshake failed with. Error returns its text.
+	Err error
+	// Remote reports whether the peer sent the alert.
+	Remote bool
+
+	alert alert
+}
+
+func (e *HandshakeError) Error() string { return e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// AlertCode returns the numeric code of the alert, as defined in RFC 8446,
+// Section 6.
+func (e *HandshakeError) AlertCode() uint8 { return uint8(e.alert) }
+
+// handshakeAlertError wraps err, a handshake failure, in a HandshakeError
+// if an alert was received from or sent to the peer.
+func (c *Conn) handshakeAlertError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		if a, ok := opErr.Err.(alert); ok {
+			return &HandshakeError{Err: err, Remote: true, alert: a}
+		}
+	}
+	c.out.Lock()
+	sent := c.out.err
+	c.out.Unlock()
+	if errors.As(sent, &opErr) && opErr.Op == "local error" {
+		if a, ok := opErr.Err.(alert); ok {
+			return &HandshakeError{Err: err, alert: a}
+		}
+	}
+	return err
+}
+
+// ErrHandshakeAborted is returned by Handshake and HandshakeContext when the
+// handshake was interrupted by AbortHandshake.
+var ErrHandshakeAborted = errors.New("tls: handshake aborted")
+
+// ErrHandshakeTimeout matches, with errors.Is, the errors of handshakes cut
+// off by the deadline of their context or connection, and of DialWithDialer
+// running past the dialer timeout. Those errors also match the underlying
+// deadline error, such as context.DeadlineExceeded.
+var ErrHandshakeTimeout = errors.New("tls: handshake timed out")
+
+// ErrNotHandshaken is returned by operations that need a completed
+// handshake when called before it, such as VerifyHostname, or Write on a
+// connection whose handshake failed.
+var ErrNotHandshaken = errors.New("tls: handshake has not yet been performed")
+
+// ErrKeyingMaterialUnavailable matches, with errors.Is, the error of
+// ConnectionState.ExportKeyingMaterial on connections that cannot export
+// keying material, such as those with renegotiation enabled.
+var ErrKeyingMaterialUnavailable = errors.New("tls: ExportKeyingMaterial is unavailable")
+
+// handshakeTimeoutError is a handshake failure caused by a deadline.
+type handshakeTimeoutError struct {
+	err error
+}
+
+func (e *handshakeTimeoutError) Error() string        { return "tls: handshake timed out: " + e.err.Error() }
+func (e *handshakeTimeoutError) Unwrap() error        { return e.err }
+func (e *handshakeTimeoutError) Is(target error) bool { return target == ErrHandshakeTimeout }
+func (e *handshakeTimeoutError) Timeout() bool        { return true }
+func (e *handshakeTimeoutError) Temporary() bool      { return true }
+
+// isTimeout reports whether err is a deadline error of the connection.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// AbortHandshake cancels a handshake in progress, closing the underlying
+// connection so that the blocked Handshake or HandshakeContext call returns
+// ErrHandshakeAborted. A handshake that has not started yet will fail the
+// same way. AbortHandshake has no effect once the handshake has completed,
+// and it is safe to call concurrently with Handshake: a handshake that
+// completes while AbortHandshake closes the connection still fails.
+func (c *Conn) AbortHandshake() {
+	c.abortMutex.Lock()
+	defer c.abortMutex.Unlock()
+	if c.handshakeAborted || c.handshakeComplete() {
+		return
+	}
+	c.handshakeAborted = true
+	c.conn.Close()
+}
+
+func (c *Conn) isHandshakeAborted() bool {
+	c.abortMutex.Lock()
+	defer c.abortMutex.Unlock()
+	return c.handshakeAborted
+}
+
+// ConnectionState returns basic TLS details about the connection. A call
+// made while a handshake is running, such as the one started by the first
+// Read or Write, waits for it to finish. Until a handshake has succeeded
+// it returns the zero ConnectionState, with HandshakeComplete false, rather
+// than the fields a partial or failed handshake got as far as setting.
 func (c *Conn) ConnectionState() ConnectionState {
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
+	if !c.handshakeComplete() {
+		return ConnectionState{ekm: noExportedKeyingMaterialBeforeHandshake}
+	}
 	return c.connectionStateLocked()
 }
 
+// HandshakeComplete reports whether a handshake has succeeded. Unlike
+// ConnectionState it never waits for a handshake in progress, so it suits
+// monitoring code that must not block on a slow or stalled peer.
+func (c *Conn) HandshakeComplete() bool {
+	return c.handshakeComplete()
+}
+
+// PeerCertificatesPEM returns the certificate chain sent by the peer, leaf
+// first, as concatenated PEM "CERTIFICATE" blocks, for archiving the
+// certificates of upstream servers. It is empty before the handshake and
+// when the peer sent no certificates, such as a client that was not asked
+// for one.
+func (c *Conn) PeerCertificatesPEM() []byte {
+	var b []byte
+	for _, cert := range c.ConnectionState().PeerCertificates {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return b
+}
+
 func (c *Conn) connectionStateLocked() ConnectionState {
 	var state ConnectionState
 	state.HandshakeComplete = c.handshakeComplete()
@@ -1570,6 +2462,9 @@ func (c *Conn) connectionStateLocked() ConnectionState {
 	state.NegotiatedProtocolIsMutual = true
 	state.ServerName = c.serverName
 	state.CipherSuite = c.cipherSuite
+	state.CurveID = c.curveID
+	state.DelegatedCredential = c.delegatedCredential
+	state.FalseStart = c.usedFalseStart
 	state.PeerCertificates = c.peerCertificates
 	state.VerifiedChains = c.verifiedChains
 	state.SignedCertificateTimestamps = c.scts
@@ -1581,7 +2476,9 @@ func (c *Conn) connectionStateLocked() ConnectionState {
 			state.TLSUnique = c.serverFinished[:]
 		}
 	}
-	if c.config.Renegotiation != RenegotiateNever {
+	if !state.HandshakeComplete {
+		state.ekm = noExportedKeyingMaterialBeforeHandshake
+	} else if c.config.Renegotiation != RenegotiateNever {
 		state.ekm = noExportedKeyingMaterial
 	} else {
 		state.ekm = c.ekm
@@ -1598,6 +2495,102 @@ func (c *Conn) OCSPResponse() []byte {
 	return c.ocspResponse
 }
 
+// Values returned by ResumptionMethod.
+const (
+	ResumptionNone          = "none"           // full handshake
+	ResumptionSessionTicket = "session-ticket" // TLS 1.2 session ticket (RFC 5077)
+	ResumptionPSKTicket     = "psk-ticket"     // TLS 1.3 resumption PSK from a NewSessionTicket
+)
+
+// ResumptionMethod reports how the session was resumed, for debugging
+// resumption-heavy workloads: ResumptionNone after a full handshake,
+// ResumptionSessionTicket for TLS 1.2 and ResumptionPSKTicket for TLS 1.3.
+// Clients find the ticket in Config.ClientSessionCache, and servers do not
+// keep a session ID cache; external PSKs are not supported, so every
+// resumption is ticket based.
+func (c *Conn) ResumptionMethod() string {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	switch {
+	case !c.handshakeComplete() || !c.didResume:
+		return ResumptionNone
+	case c.vers == VersionTLS13:
+		return ResumptionPSKTicket
+	default:
+		return ResumptionSessionTicket
+	}
+}
+
+// HandshakeDuration returns how long the handshake took to run, from
+// sending or awaiting the first handshake message to completion. It is
+// zero until the handshake has completed successfully.
+func (c *Conn) HandshakeDuration() time.Duration {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	return c.handshakeTime
+}
+
+// Channel binding types supported by ChannelBinding.
+const (
+	// ChannelBindingTLSExporter is the RFC 9266 binding, available on TLS 1.3.
+	ChannelBindingTLSExporter = "tls-exporter"
+	// ChannelBindingTLSUnique is the RFC 5929 binding, available on full
+	// (non-resumed) TLS 1.2 handshakes.
+	ChannelBindingTLSUnique = "tls-unique"
+)
+
+// tlsExporterLabel and tlsExporterLength are fixed by RFC 9266, Section 2.
+const (
+	tlsExporterLabel  = "EXPORTER-Channel-Binding"
+	tlsExporterLength = 32
+)
+
+// UnsupportedChannelBindingError is returned by ChannelBinding when the
+// binding type is unknown or cannot be used with the negotiated connection.
+type UnsupportedChannelBindingError struct {
+	Type    string // the requested binding type
+	Version uint16 // the negotiated TLS version
+	Reason  string
+}
+
+func (e *UnsupportedChannelBindingError) Error() string {
+	return fmt.Sprintf("tls: channel binding %q unsupported: %s", e.Type, e.Reason)
+}
+
+// ChannelBinding returns the channel binding data of the given type, for use
+// by authentication mechanisms such as SCRAM-PLUS. Both peers derive the
+// same value. bindingType is ChannelBindingTLSExporter on TLS 1.3, or
+// ChannelBindingTLSUnique on TLS 1.2. tls-exporter is refused on TLS 1.2
+// because this package does not implement the extended master secret that
+// RFC 9266 requires there, and tls-unique is undefined on TLS 1.3 and
+// insecure on resumed sessions.
+func (c *Conn) ChannelBinding(bindingType string) ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	state := c.ConnectionState()
+	unsupported := func(reason string) error {
+		return &UnsupportedChannelBindingError{Type: bindingType, Version: state.Version, Reason: reason}
+	}
+	switch bindingType {
+	case ChannelBindingTLSExporter:
+		if state.Version != VersionTLS13 {
+			return nil, unsupported("requires TLS 1.3")
+		}
+		return state.ExportKeyingMaterial(tlsExporterLabel, nil, tlsExporterLength)
+	case ChannelBindingTLSUnique:
+		if state.Version == VersionTLS13 {
+			return nil, unsupported("not defined for TLS 1.3")
+		}
+		if state.TLSUnique == nil {
+			return nil, unsupported("not available on resumed sessions")
+		}
+		return append([]byte(nil), state.TLSUnique...), nil
+	default:
+		return nil, unsupported("unknown binding type")
+	}
+}
+
 // VerifyHostname checks that the peer certificate chain is valid for
 // connecting to host. If so, it returns nil; if not, it returns an error
 // describing the problem.
@@ -1608,7 +2601,7 @@ func (c *Conn) VerifyHostname(host string) error {
 		return errors.New("tls: VerifyHostname called on TLS server connection")
 	}
 	if !c.handshakeComplete() {
-		return errors.New("tls: handshake has not yet been performed")
+		return ErrNotHandshaken
 	}
 	if len(c.verifiedChains) == 0 {
 		return errors.New("tls: handshake did not verify certificate chain")
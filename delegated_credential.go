@@ -0,0 +1,277 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+// Delegated credentials for TLS 1.3 servers, see RFC 9345.
+
+package tls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// oidDelegationUsage is the DelegationUsage certificate extension that
+// allows a certificate to issue delegated credentials. See RFC 9345, Section 4.2.
+var oidDelegationUsage = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44363, 44}
+
+// maxDelegatedCredentialValidity is the longest a delegated credential may
+// remain valid for. See RFC 9345, Section 4.1.3.
+const maxDelegatedCredentialValidity = 7 * 24 * time.Hour
+
+const delegatedCredentialContext = "TLS, server delegated credentials\x00"
+
+// delegatedCredentialSchemes are the signature algorithms a client accepts
+// for delegated credentials, both for the credential key and for the
+// certificate signature over it. Only TLS 1.3 algorithms are allowed.
+var delegatedCredentialSchemes = []SignatureScheme{
+	ECDSAWithP256AndSHA256,
+	Ed25519,
+	PSSWithSHA256,
+	PSSWithSHA384,
+	PSSWithSHA512,
+	ECDSAWithP384AndSHA384,
+	ECDSAWithP521AndSHA512,
+}
+
+// A DelegatedCredential is a short-lived key pair that a certificate with
+// the DelegationUsage extension vouches for, so that servers can sign TLS
+// 1.3 handshakes without holding the certificate key. See RFC 9345.
+type DelegatedCredential struct {
+	// ValidTime is the credential lifetime, counted from the NotBefore
+	// time of the certificate that issued it.
+	ValidTime time.Duration
+	// Scheme is the signature algorithm the credential key signs the
+	// handshake with.
+	Scheme SignatureScheme
+	// PublicKey is the credential public key.
+	PublicKey crypto.PublicKey
+	// Algorithm is the signature algorithm the certificate key signed the
+	// credential with.
+	Algorithm SignatureScheme
+	// Signature is the certificate signature over the credential.
+	Signature []byte
+	// PrivateKey is the credential private key. Only servers need it and
+	// it is never sent to the peer.
+	PrivateKey crypto.Signer
+}
+
+// NewDelegatedCredential issues a delegated credential from cert for a
+// freshly generated key that signs with scheme, valid for validFor from
+// now. The leaf of cert must carry the DelegationUsage extension and
+// validFor may not exceed seven days. scheme must be an ECDSA or Ed25519
+// algorithm.
+func NewDelegatedCredential(cert *Certificate, scheme SignatureScheme, validFor time.Duration) (*DelegatedCredential, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("tls: delegated credential needs a certificate")
+	}
+	leaf, err := cert.leaf()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDelegationUsage(leaf); err != nil {
+		return nil, err
+	}
+	if validFor <= 0 || validFor > maxDelegatedCredentialValidity {
+		return nil, fmt.Errorf("tls: delegated credential validity %v is not between 0 and %v", validFor, maxDelegatedCredentialValidity)
+	}
+	expiry := time.Now().Add(validFor)
+	if expiry.After(leaf.NotAfter) {
+		return nil, errors.New("tls: delegated credential would outlive its certificate")
+	}
+
+	var priv crypto.Signer
+	switch scheme {
+	case ECDSAWithP256AndSHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAWithP384AndSHA384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case ECDSAWithP521AndSHA512:
+		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case Ed25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("tls: unsupported delegated credential signature algorithm %v", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	algs := signatureSchemesForCertificate(VersionTLS13, cert)
+	if len(algs) == 0 {
+		return nil, unsupportedCertificateError(cert)
+	}
+	dc := &DelegatedCredential{
+		ValidTime:  expiry.Sub(leaf.NotBefore).Truncate(time.Second),
+		Scheme:     scheme,
+		PublicKey:  priv.Public(),
+		Algorithm:  algs[0],
+		PrivateKey: priv,
+	}
+	cred, err := dc.marshalCredential()
+	if err != nil {
+		return nil, err
+	}
+	sigType, sigHash, err := typeAndHashFromSignatureScheme(dc.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signOpts := crypto.SignerOpts(sigHash)
+	if sigType == signatureRSAPSS {
+		signOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: sigHash}
+	}
+	signed := delegatedCredentialSignedMessage(sigHash, leaf.Raw, cred, dc.Algorithm)
+	dc.Signature, err = cert.PrivateKey.(crypto.Signer).Sign(rand.Reader, signed, signOpts)
+	if err != nil {
+		return nil, errors.New("tls: failed to sign delegated credential: " + err.Error())
+	}
+	return dc, nil
+}
+
+// Expiry returns the time at which dc, issued by leaf, stops being valid.
+func (dc *DelegatedCredential) Expiry(leaf *x509.Certificate) time.Time {
+	return leaf.NotBefore.Add(dc.ValidTime)
+}
+
+// marshalCredential encodes the Credential structure of RFC 9345, Section 4.
+func (dc *DelegatedCredential) marshalCredential() ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(dc.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var b cryptobyte.Builder
+	b.AddUint32(uint32(dc.ValidTime / time.Second))
+	b.AddUint16(uint16(dc.Scheme))
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(spki)
+	})
+	return b.Bytes()
+}
+
+// marshal encodes the DelegatedCredential structure of RFC 9345, Section 4.
+func (dc *DelegatedCredential) marshal() ([]byte, error) {
+	cred, err := dc.marshalCredential()
+	if err != nil {
+		return nil, err
+	}
+	var b cryptobyte.Builder
+	b.AddBytes(cred)
+	b.AddUint16(uint16(dc.Algorithm))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(dc.Signature)
+	})
+	return b.Bytes()
+}
+
+// parseDelegatedCredential decodes a DelegatedCredential structure. It
+// returns the credential and the encoding of its cred field.
+func parseDelegatedCredential(data []byte) (*DelegatedCredential, []byte, error) {
+	s := cryptobyte.String(data)
+	dc := new(DelegatedCredential)
+	var validTime uint32
+	var scheme, algorithm uint16
+	var spki cryptobyte.String
+	if !s.ReadUint32(&validTime) || !s.ReadUint16(&scheme) ||
+		!s.ReadUint24LengthPrefixed(&spki) || spki.Empty() {
+		return nil, nil, errors.New("tls: malformed delegated credential")
+	}
+	cred := data[:len(data)-len(s)]
+	if !s.ReadUint16(&algorithm) ||
+		!readUint16LengthPrefixed(&s, &dc.Signature) || len(dc.Signature) == 0 ||
+		!s.Empty() {
+		return nil, nil, errors.New("tls: malformed delegated credential")
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, nil, errors.New("tls: malformed delegated credential key: " + err.Error())
+	}
+	dc.ValidTime = time.Duration(validTime) * time.Second
+	dc.Scheme = SignatureScheme(scheme)
+	dc.PublicKey = pub
+	dc.Algorithm = SignatureScheme(algorithm)
+	return dc, cred, nil
+}
+
+// verifyDelegatedCredential parses the delegated credential a server sent
+// along with leaf and checks it per RFC 9345, Section 4.1.3: leaf may issue
+// credentials, the credential is current and not valid for more than seven
+// days, both of its algorithms were offered in peerAlgs, and leaf signed it.
+func verifyDelegatedCredential(data []byte, leaf *x509.Certificate, peerAlgs []SignatureScheme, now time.Time) (*DelegatedCredential, error) {
+	dc, cred, err := parseDelegatedCredential(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDelegationUsage(leaf); err != nil {
+		return nil, err
+	}
+	expiry := dc.Expiry(leaf)
+	if !now.Before(expiry) {
+		return nil, errors.New("tls: delegated credential has expired")
+	}
+	if expiry.Sub(now) > maxDelegatedCredentialValidity {
+		return nil, errors.New("tls: delegated credential is valid for more than seven days")
+	}
+	if !isSupportedSignatureAlgorithm(dc.Scheme, peerAlgs) ||
+		!isSupportedSignatureAlgorithm(dc.Algorithm, peerAlgs) {
+		return nil, errors.New("tls: delegated credential uses an unsupported signature algorithm")
+	}
+	sigType, sigHash, err := typeAndHashFromSignatureScheme(dc.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signed := delegatedCredentialSignedMessage(sigHash, leaf.Raw, cred, dc.Algorithm)
+	if err := verifyHandshakeSignature(sigType, leaf.PublicKey, sigHash, signed, dc.Signature); err != nil {
+		return nil, errors.New("tls: invalid delegated credential signature: " + err.Error())
+	}
+	return dc, nil
+}
+
+// checkDelegationUsage reports whether leaf is allowed to issue delegated
+// credentials. See RFC 9345, Section 4.2.
+func checkDelegationUsage(leaf *x509.Certificate) error {
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return errors.New("tls: certificate lacks the digitalSignature key usage needed for delegated credentials")
+	}
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidDelegationUsage) {
+			return nil
+		}
+	}
+	return errors.New("tls: certificate lacks the DelegationUsage extension")
+}
+
+// delegatedCredentialSignedMessage returns the pre-hashed (if necessary)
+// message the certificate key signs. See RFC 9345, Section 4.
+func delegatedCredentialSignedMessage(sigHash crypto.Hash, leaf, cred []byte, algorithm SignatureScheme) []byte {
+	var h hash.Hash
+	if sigHash == directSigning {
+		h = &directHash{}
+	} else {
+		h = sigHash.New()
+	}
+	h.Write(signaturePadding)
+	io.WriteString(h, delegatedCredentialContext)
+	h.Write(leaf)
+	h.Write(cred)
+	h.Write([]byte{byte(algorithm >> 8), byte(algorithm)})
+	return h.Sum(nil)
+}
+
+// directHash is a hash.Hash that returns its input unchanged, for
+// signature algorithms such as Ed25519 that sign the message directly.
+type directHash struct{ bytes.Buffer }
+
+func (d *directHash) Sum(b []byte) []byte { return append(b, d.Bytes()...) }
+func (d *directHash) Size() int           { return d.Len() }
+func (d *directHash) BlockSize() int      { return 1 }
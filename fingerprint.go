@@ -0,0 +1,173 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+// JA3 and JA4 fingerprints of the ClientHello received by a server.
+
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientJA3 returns the JA3 fingerprint of the ClientHello this server
+// connection received: the MD5, in hex, of the client's version, cipher
+// suites, extensions, curves and point formats, with GREASE values removed.
+// It is empty on client connections and before a ClientHello was read.
+func (c *Conn) ClientJA3() string {
+	hello := c.receivedClientHello()
+	if hello == nil {
+		return ""
+	}
+	sum := md5.Sum([]byte(ja3String(hello)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientJA4 returns the JA4 fingerprint of the ClientHello this server
+// connection received, such as "t13d1516h2_8daaf6152771_b186095e22b6". It
+// is empty on client connections and before a ClientHello was read.
+func (c *Conn) ClientJA4() string {
+	hello := c.receivedClientHello()
+	if hello == nil {
+		return ""
+	}
+	return ja4String(hello)
+}
+
+func (c *Conn) receivedClientHello() *clientHelloMsg {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.isClient {
+		return nil
+	}
+	return c.clientHello
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3String returns the JA3 string that is hashed into the fingerprint.
+func ja3String(hello *clientHelloMsg) string {
+	join := func(values []uint16) string {
+		var parts []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				parts = append(parts, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	curves := make([]uint16, 0, len(hello.supportedCurves))
+	for _, curve := range hello.supportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	points := make([]uint16, 0, len(hello.supportedPoints))
+	for _, p := range hello.supportedPoints {
+		points = append(points, uint16(p))
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", hello.vers,
+		join(hello.cipherSuites), join(hello.extensions), join(curves), join(points))
+}
+
+// ja4String returns the JA4 fingerprint, following the JA4 specification
+// for TLS over TCP.
+func ja4String(hello *clientHelloMsg) string {
+	version := hello.vers
+	for _, v := range hello.supportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	var versionCode string
+	switch version {
+	case VersionTLS13:
+		versionCode = "13"
+	case VersionTLS12:
+		versionCode = "12"
+	case VersionTLS11:
+		versionCode = "11"
+	case VersionTLS10:
+		versionCode = "10"
+	case VersionSSL30:
+		versionCode = "s3"
+	default:
+		versionCode = "00"
+	}
+
+	sni := "i"
+	if hello.serverName != "" {
+		sni = "d"
+	}
+
+	var ciphers, extensions []string
+	for _, suite := range hello.cipherSuites {
+		if !isGREASE(suite) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", suite))
+		}
+	}
+	extensionCount := 0
+	for _, ext := range hello.extensions {
+		if isGREASE(ext) {
+			continue
+		}
+		extensionCount++
+		if ext != extensionServerName && ext != extensionALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", ext))
+		}
+	}
+
+	alpn := "00"
+	if len(hello.alpnProtocols) > 0 && hello.alpnProtocols[0] != "" {
+		p := hello.alpnProtocols[0]
+		first, last := p[0], p[len(p)-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min99(len(ciphers)), min99(extensionCount), alpn)
+
+	sort.Strings(ciphers)
+	b := ja4Hash(strings.Join(ciphers, ","), len(ciphers) == 0)
+
+	sort.Strings(extensions)
+	c := strings.Join(extensions, ",")
+	var sigalgs []string
+	for _, s := range hello.supportedSignatureAlgorithms {
+		if !isGREASE(uint16(s)) {
+			sigalgs = append(sigalgs, fmt.Sprintf("%04x", uint16(s)))
+		}
+	}
+	if len(sigalgs) > 0 {
+		c += "_" + strings.Join(sigalgs, ",")
+	}
+	return a + "_" + b + "_" + ja4Hash(c, len(extensions) == 0)
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of s, or
+// zeroes if the list it was made from is empty.
+func ja4Hash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -91,7 +91,26 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 	configCipherSuites := config.cipherSuites()
 	hello.cipherSuites = make([]uint16, 0, len(configCipherSuites))
 
+	// With SetCipherOrder, the configured suites are offered in their own
+	// order, TLS 1.3 ones included; otherwise the default TLS 1.3 suites
+	// follow the others.
+	appendTLS13Suites := true
+	if config.exactCipherOrder {
+		preferenceOrder = configCipherSuites
+		for _, suiteId := range configCipherSuites {
+			if cipherSuiteTLS13ByID(suiteId) != nil {
+				appendTLS13Suites = false
+				break
+			}
+		}
+	}
 	for _, suiteId := range preferenceOrder {
+		if config.exactCipherOrder && cipherSuiteTLS13ByID(suiteId) != nil {
+			if hello.supportedVersions[0] == VersionTLS13 {
+				hello.cipherSuites = append(hello.cipherSuites, suiteId)
+			}
+			continue
+		}
 		suite := mutualCipherSuite(configCipherSuites, suiteId)
 		if suite == nil {
 			continue
@@ -122,10 +141,12 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 
 	var params ecdheParameters
 	if hello.supportedVersions[0] == VersionTLS13 {
-		if hasAESGCMHardwareSupport {
-			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13...)
-		} else {
-			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13NoAES...)
+		if appendTLS13Suites {
+			if hasAESGCMHardwareSupport {
+				hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13...)
+			} else {
+				hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13NoAES...)
+			}
 		}
 
 		curveID := config.curvePreferences()[0]
@@ -137,11 +158,38 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 			return nil, nil, err
 		}
 		hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
+		if config.SupportDelegatedCredential {
+			hello.delegatedCredentialSchemes = delegatedCredentialSchemes
+		}
+	}
+
+	if config.grease {
+		if hello.grease, err = greaseValues(config.rand()); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	return hello, params, nil
 }
 
+// greaseValues picks the GREASE values for a ClientHello, of the form
+// 0x?a?a (RFC 8701, Section 2), making the two extensions differ.
+func greaseValues(rand io.Reader) ([]uint16, error) {
+	var seed [greaseCount]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	values := make([]uint16, greaseCount)
+	for i, b := range seed {
+		v := uint16(b&0xf0 | 0x0a)
+		values[i] = v<<8 | v
+	}
+	if values[greaseFirstExtension] == values[greaseLastExtension] {
+		values[greaseLastExtension] ^= 0x1010
+	}
+	return values, nil
+}
+
 func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	if c.config == nil {
 		c.config = defaultConfig()
@@ -175,9 +223,19 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
 		return err
 	}
+	c.handshakeStage(HandshakeStageClientHelloSent)
 
 	msg, err := c.readHandshake()
 	if err != nil {
+		// Only insufficient_security says why the server gave up. A
+		// handshake_failure may have any cause, such as a missing
+		// certificate or ALPN protocol, so it is returned as is.
+		if c.config.requireStrongCiphers || c.config.requireStrongCurves {
+			var e *net.OpError
+			if errors.As(err, &e) && e.Op == "remote error" && e.Err == alertInsufficientSecurity {
+				return &InsufficientSecurityError{Msg: "server rejected the strong-only cipher suites and curves", Err: err}
+			}
+		}
 		return err
 	}
 
@@ -186,6 +244,7 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 		c.sendAlert(alertUnexpectedMessage)
 		return unexpectedMessageError(serverHello, msg)
 	}
+	c.handshakeStage(HandshakeStageServerHelloReceived)
 
 	if err := c.pickTLSVersion(serverHello); err != nil {
 		return err
@@ -230,12 +289,30 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	if err := hs.handshake(); err != nil {
 		return err
 	}
+	if err := c.writeFirstQueued(); err != nil {
+		return err
+	}
 
 	// If we had a successful handshake and hs.session is different from
 	// the one already cached - cache a new one.
-	if cacheKey != "" && hs.session != nil && session != hs.session {
-		c.config.ClientSessionCache.Put(cacheKey, hs.session)
+	saveSession := func() {
+		if cacheKey != "" && hs.session != nil && session != hs.session {
+			c.config.ClientSessionCache.Put(cacheKey, hs.session)
+		}
 	}
+	if readServerFinished := c.falseStart; readServerFinished != nil {
+		// Under False Start the ticket comes with the server's Finished,
+		// which the first read waits for.
+		c.falseStart = func() error {
+			if err := readServerFinished(); err != nil {
+				return err
+			}
+			saveSession()
+			return nil
+		}
+		return nil
+	}
+	saveSession()
 
 	return nil
 }
@@ -415,6 +492,10 @@ func (hs *clientHandshakeState) handshake() error {
 		// Make sure the connection is still being verified whether or not this
 		// is a resumption. Resumptions currently don't reverify certificates so
 		// they don't call verifyServerCertificate. See Issue 31641.
+		if err := c.checkStapledOCSP(); err != nil {
+			c.sendAlert(alertBadCertificateStatusResponse)
+			return err
+		}
 		if c.config.VerifyConnection != nil {
 			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
 				c.sendAlert(alertBadCertificate)
@@ -441,20 +522,42 @@ func (hs *clientHandshakeState) handshake() error {
 			return err
 		}
 		c.clientFinishedIsFirst = true
-		if err := hs.readSessionTicket(); err != nil {
-			return err
-		}
-		if err := hs.readFinished(c.serverFinished[:]); err != nil {
+		if hs.falseStartAllowed() {
+			c.usedFalseStart = true
+			c.falseStart = hs.readServerFinished
+			atomic.StoreUint32(&c.falseStartPending, 1)
+		} else if err := hs.readServerFinished(); err != nil {
 			return err
 		}
 	}
 
 	c.ekm = ekmFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.hello.random, hs.serverHello.random)
 	atomic.StoreUint32(&c.handshakeStatus, 1)
+	c.handshakeStage(HandshakeStageFinished)
 
 	return nil
 }
 
+// readServerFinished reads the flight that ends a full handshake after the
+// client's Finished: the session ticket, if any, and the server's Finished.
+func (hs *clientHandshakeState) readServerFinished() error {
+	if err := hs.readSessionTicket(); err != nil {
+		return err
+	}
+	return hs.readFinished(hs.c.serverFinished[:])
+}
+
+// falseStartAllowed reports whether a full handshake may return before the
+// server's Finished under Config.EnableFalseStart. RFC 7918 requires a
+// forward-secret key exchange and a strong cipher; like browsers, it also
+// waits for the server to negotiate ALPN. Renegotiations never false start.
+func (hs *clientHandshakeState) falseStartAllowed() bool {
+	c := hs.c
+	return c.config.EnableFalseStart && c.handshakes == 0 &&
+		hs.suite.flags&suiteECDHE != 0 && hs.suite.aead != nil &&
+		c.clientProtocol != ""
+}
+
 func (hs *clientHandshakeState) pickCipherSuite() error {
 	if hs.suite = mutualCipherSuite(hs.hello.cipherSuites, hs.serverHello.cipherSuite); hs.suite == nil {
 		hs.c.sendAlert(alertHandshakeFailure)
@@ -478,6 +581,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		return unexpectedMessageError(certMsg, msg)
 	}
 	hs.finishedHash.Write(certMsg.marshal())
+	c.handshakeStage(HandshakeStageCertificateReceived)
 
 	msg, err = c.readHandshake()
 	if err != nil {
@@ -536,6 +640,9 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			c.sendAlert(alertUnexpectedMessage)
 			return err
 		}
+		if ka, ok := keyAgreement.(*ecdheKeyAgreement); ok {
+			c.curveID = ka.params.CurveID()
+		}
 
 		msg, err = c.readHandshake()
 		if err != nil {
@@ -642,7 +749,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 	}
 
 	hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.hello.random, hs.serverHello.random)
-	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
+	if err := c.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
 		c.sendAlert(alertInternalError)
 		return errors.New("tls: failed to write to key log: " + err.Error())
 	}
@@ -735,6 +842,7 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 
 	// Restore masterSecret, peerCerts, and ocspResponse from previous state
 	hs.masterSecret = hs.session.masterSecret
+	c.saveSecret(keyLogLabelTLS12, hs.hello.random, hs.masterSecret)
 	c.peerCertificates = hs.session.serverCertificates
 	c.verifiedChains = hs.session.verifiedChains
 	c.ocspResponse = hs.session.ocspResponse
@@ -841,6 +949,20 @@ func (hs *clientHandshakeState) sendFinished(out []byte) error {
 	return nil
 }
 
+// certificateErrorAlert returns the alert that reports a chain verification
+// failure to the peer, as RFC 8446, Section 6.2 suggests.
+func certificateErrorAlert(err error) alert {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return alertUnknownCA
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return alertCertificateExpired
+	}
+	return alertBadCertificate
+}
+
 // verifyServerCertificate parses and verifies the provided chain, setting
 // c.verifiedChains and c.peerCertificates or sending the appropriate alert.
 func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
@@ -867,7 +989,7 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 		var err error
 		c.verifiedChains, err = certs[0].Verify(opts)
 		if err != nil {
-			c.sendAlert(alertBadCertificate)
+			c.sendAlert(certificateErrorAlert(err))
 			return err
 		}
 	}
@@ -882,6 +1004,11 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 
 	c.peerCertificates = certs
 
+	if err := c.checkStapledOCSP(); err != nil {
+		c.sendAlert(alertBadCertificateStatusResponse)
+		return err
+	}
+
 	if c.config.VerifyPeerCertificate != nil {
 		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
 			c.sendAlert(alertBadCertificate)
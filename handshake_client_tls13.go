@@ -96,11 +96,15 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.sendClientFinished(); err != nil {
 		return err
 	}
+	if err := c.writeFirstQueued(); err != nil {
+		return err
+	}
 	if _, err := c.flush(); err != nil {
 		return err
 	}
 
 	atomic.StoreUint32(&c.handshakeStatus, 1)
+	c.handshakeStage(HandshakeStageFinished)
 
 	return nil
 }
@@ -349,6 +353,7 @@ func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid server key share")
 	}
+	c.curveID = hs.ecdheParams.CurveID()
 
 	earlySecret := hs.earlySecret
 	if !hs.usingPSK {
@@ -364,12 +369,12 @@ func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 		serverHandshakeTrafficLabel, hs.transcript)
 	c.in.setTrafficSecret(hs.suite, serverSecret)
 
-	err := c.config.writeKeyLog(keyLogLabelClientHandshake, hs.hello.random, clientSecret)
+	err := c.writeKeyLog(keyLogLabelClientHandshake, hs.hello.random, clientSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
-	err = c.config.writeKeyLog(keyLogLabelServerHandshake, hs.hello.random, serverSecret)
+	err = c.writeKeyLog(keyLogLabelServerHandshake, hs.hello.random, serverSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
@@ -414,6 +419,10 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		// Make sure the connection is still being verified whether or not this
 		// is a resumption. Resumptions currently don't reverify certificates so
 		// they don't call verifyServerCertificate. See Issue 31641.
+		if err := c.checkStapledOCSP(); err != nil {
+			c.sendAlert(alertBadCertificateStatusResponse)
+			return err
+		}
 		if c.config.VerifyConnection != nil {
 			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
 				c.sendAlert(alertBadCertificate)
@@ -450,6 +459,7 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		return errors.New("tls: received empty certificates message")
 	}
 	hs.transcript.Write(certMsg.marshal())
+	c.handshakeStage(HandshakeStageCertificateReceived)
 
 	c.scts = certMsg.certificate.SignedCertificateTimestamps
 	c.ocspResponse = certMsg.certificate.OCSPStaple
@@ -458,6 +468,25 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		return err
 	}
 
+	// The server signs with the delegated credential key instead of the
+	// certificate key if it sent one. See RFC 9345, Section 4.1.3.
+	serverKey := c.peerCertificates[0].PublicKey
+	var dc *DelegatedCredential
+	if certMsg.delegatedCredential != nil {
+		if len(hs.hello.delegatedCredentialSchemes) == 0 {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server sent an unsolicited delegated credential")
+		}
+		dc, err = verifyDelegatedCredential(certMsg.delegatedCredential, c.peerCertificates[0],
+			hs.hello.delegatedCredentialSchemes, c.config.time())
+		if err != nil {
+			c.sendAlert(alertIllegalParameter)
+			return err
+		}
+		serverKey = dc.PublicKey
+		c.delegatedCredential = true
+	}
+
 	msg, err = c.readHandshake()
 	if err != nil {
 		return err
@@ -482,8 +511,12 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: certificate used with invalid signature algorithm")
 	}
+	if dc != nil && certVerify.signatureAlgorithm != dc.Scheme {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: delegated credential used with a different signature algorithm")
+	}
 	signed := signedMessage(sigHash, serverSignatureContext, hs.transcript)
-	if err := verifyHandshakeSignature(sigType, c.peerCertificates[0].PublicKey,
+	if err := verifyHandshakeSignature(sigType, serverKey,
 		sigHash, signed, certVerify.signature); err != nil {
 		c.sendAlert(alertDecryptError)
 		return errors.New("tls: invalid signature by the server certificate: " + err.Error())
@@ -524,12 +557,12 @@ func (hs *clientHandshakeStateTLS13) readServerFinished() error {
 		serverApplicationTrafficLabel, hs.transcript)
 	c.in.setTrafficSecret(hs.suite, serverSecret)
 
-	err = c.config.writeKeyLog(keyLogLabelClientTraffic, hs.hello.random, hs.trafficSecret)
+	err = c.writeKeyLog(keyLogLabelClientTraffic, hs.hello.random, hs.trafficSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
-	err = c.config.writeKeyLog(keyLogLabelServerTraffic, hs.hello.random, serverSecret)
+	err = c.writeKeyLog(keyLogLabelServerTraffic, hs.hello.random, serverSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
@@ -81,6 +81,7 @@ type clientHelloMsg struct {
 	sessionTicket                    []uint8
 	supportedSignatureAlgorithms     []SignatureScheme
 	supportedSignatureAlgorithmsCert []SignatureScheme
+	delegatedCredentialSchemes       []SignatureScheme
 	secureRenegotiationSupported     bool
 	secureRenegotiation              []byte
 	alpnProtocols                    []string
@@ -92,8 +93,27 @@ type clientHelloMsg struct {
 	pskModes                         []uint8
 	pskIdentities                    []pskIdentity
 	pskBinders                       [][]byte
+
+	// extensions lists the extension types in the order they were
+	// received. It is only set by unmarshal, for fingerprinting.
+	extensions []uint16
+
+	// grease, if not nil, holds the GREASE values (RFC 8701) that marshal
+	// injects, indexed by the grease* constants. They are kept out of the
+	// fields above so that negotiation never sees them.
+	grease []uint16
 }
 
+// Positions of the GREASE values in clientHelloMsg.grease.
+const (
+	greaseCipher = iota
+	greaseGroup
+	greaseVersion
+	greaseFirstExtension
+	greaseLastExtension
+	greaseCount
+)
+
 func (m *clientHelloMsg) marshal() []byte {
 	if m.raw != nil {
 		return m.raw
@@ -108,6 +128,9 @@ func (m *clientHelloMsg) marshal() []byte {
 			b.AddBytes(m.sessionId)
 		})
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if m.grease != nil {
+				b.AddUint16(m.grease[greaseCipher])
+			}
 			for _, suite := range m.cipherSuites {
 				b.AddUint16(suite)
 			}
@@ -121,6 +144,11 @@ func (m *clientHelloMsg) marshal() []byte {
 		bWithoutExtensions := *b
 
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if m.grease != nil {
+				// RFC 8701, Section 3: an empty extension first.
+				b.AddUint16(m.grease[greaseFirstExtension])
+				b.AddUint16(0) // empty extension_data
+			}
 			if len(m.serverName) > 0 {
 				// RFC 6066, Section 3
 				b.AddUint16(extensionServerName)
@@ -147,6 +175,9 @@ func (m *clientHelloMsg) marshal() []byte {
 				b.AddUint16(extensionSupportedCurves)
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						if m.grease != nil {
+							b.AddUint16(m.grease[greaseGroup])
+						}
 						for _, curve := range m.supportedCurves {
 							b.AddUint16(uint16(curve))
 						}
@@ -191,6 +222,17 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if len(m.delegatedCredentialSchemes) > 0 {
+				// RFC 9345, Section 4.1.1
+				b.AddUint16(extensionDelegatedCredential)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, sigAlgo := range m.delegatedCredentialSchemes {
+							b.AddUint16(uint16(sigAlgo))
+						}
+					})
+				})
+			}
 			if m.secureRenegotiationSupported {
 				// RFC 5746, Section 3.2
 				b.AddUint16(extensionRenegotiationInfo)
@@ -223,6 +265,9 @@ func (m *clientHelloMsg) marshal() []byte {
 				b.AddUint16(extensionSupportedVersions)
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						if m.grease != nil {
+							b.AddUint16(m.grease[greaseVersion])
+						}
 						for _, vers := range m.supportedVersions {
 							b.AddUint16(vers)
 						}
@@ -266,6 +311,13 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if m.grease != nil {
+				// A one-byte extension last, before pre_shared_key.
+				b.AddUint16(m.grease[greaseLastExtension])
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+				})
+			}
 			if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 				// RFC 8446, Section 4.2.11
 				b.AddUint16(extensionPreSharedKey)
@@ -391,6 +443,7 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 			!extensions.ReadUint16LengthPrefixed(&extData) {
 			return false
 		}
+		m.extensions = append(m.extensions, extension)
 
 		switch extension {
 		case extensionServerName:
@@ -481,6 +534,20 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				m.supportedSignatureAlgorithmsCert = append(
 					m.supportedSignatureAlgorithmsCert, SignatureScheme(sigAndAlg))
 			}
+		case extensionDelegatedCredential:
+			// RFC 9345, Section 4.1.1
+			var sigAndAlgs cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&sigAndAlgs) || sigAndAlgs.Empty() {
+				return false
+			}
+			for !sigAndAlgs.Empty() {
+				var sigAndAlg uint16
+				if !sigAndAlgs.ReadUint16(&sigAndAlg) {
+					return false
+				}
+				m.delegatedCredentialSchemes = append(
+					m.delegatedCredentialSchemes, SignatureScheme(sigAndAlg))
+			}
 		case extensionRenegotiationInfo:
 			// RFC 5746, Section 3.2
 			if !readUint8LengthPrefixed(&extData, &m.secureRenegotiation) {
@@ -1277,10 +1344,11 @@ func (m *certificateMsg) unmarshal(data []byte) bool {
 }
 
 type certificateMsgTLS13 struct {
-	raw          []byte
-	certificate  Certificate
-	ocspStapling bool
-	scts         bool
+	raw                 []byte
+	certificate         Certificate
+	ocspStapling        bool
+	scts                bool
+	delegatedCredential []byte
 }
 
 func (m *certificateMsgTLS13) marshal() []byte {
@@ -1300,14 +1368,14 @@ func (m *certificateMsgTLS13) marshal() []byte {
 		if !m.scts {
 			certificate.SignedCertificateTimestamps = nil
 		}
-		marshalCertificate(b, certificate)
+		marshalCertificate(b, certificate, m.delegatedCredential)
 	})
 
 	m.raw = b.BytesOrPanic()
 	return m.raw
 }
 
-func marshalCertificate(b *cryptobyte.Builder, certificate Certificate) {
+func marshalCertificate(b *cryptobyte.Builder, certificate Certificate, delegatedCredential []byte) {
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
 		for i, cert := range certificate.Certificate {
 			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
@@ -1339,6 +1407,13 @@ func marshalCertificate(b *cryptobyte.Builder, certificate Certificate) {
 						})
 					})
 				}
+				if delegatedCredential != nil {
+					// RFC 9345, Section 4.1.2
+					b.AddUint16(extensionDelegatedCredential)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(delegatedCredential)
+					})
+				}
 			})
 		}
 	})
@@ -1351,7 +1426,7 @@ func (m *certificateMsgTLS13) unmarshal(data []byte) bool {
 	var context cryptobyte.String
 	if !s.Skip(4) || // message type and uint24 length field
 		!s.ReadUint8LengthPrefixed(&context) || !context.Empty() ||
-		!unmarshalCertificate(&s, &m.certificate) ||
+		!unmarshalCertificate(&s, &m.certificate, &m.delegatedCredential) ||
 		!s.Empty() {
 		return false
 	}
@@ -1362,7 +1437,7 @@ func (m *certificateMsgTLS13) unmarshal(data []byte) bool {
 	return true
 }
 
-func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate) bool {
+func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate, delegatedCredential *[]byte) bool {
 	var certList cryptobyte.String
 	if !s.ReadUint24LengthPrefixed(&certList) {
 		return false
@@ -1409,6 +1484,13 @@ func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate) bool {
 					certificate.SignedCertificateTimestamps = append(
 						certificate.SignedCertificateTimestamps, sct)
 				}
+			case extensionDelegatedCredential:
+				// RFC 9345, Section 4.1.2
+				if delegatedCredential == nil || extData.Empty() {
+					return false
+				}
+				*delegatedCredential = append([]byte(nil), extData...)
+				extData = nil
 			default:
 				// Ignore unknown extensions.
 				continue
@@ -44,6 +44,7 @@ func (c *Conn) serverHandshake(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	c.handshakeStage(HandshakeStageClientHelloReceived)
 
 	if c.vers == VersionTLS13 {
 		hs := serverHandshakeStateTLS13{
@@ -123,6 +124,7 @@ func (hs *serverHandshakeState) handshake() error {
 
 	c.ekm = ekmFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.clientHello.random, hs.hello.random)
 	atomic.StoreUint32(&c.handshakeStatus, 1)
+	c.handshakeStage(HandshakeStageFinished)
 
 	return nil
 }
@@ -138,6 +140,7 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 		c.sendAlert(alertUnexpectedMessage)
 		return nil, unexpectedMessageError(clientHello, msg)
 	}
+	c.clientHello = clientHello
 
 	var configForClient *Config
 	originalConfig := c.config
@@ -353,6 +356,14 @@ func (hs *serverHandshakeState) pickCipherSuite() error {
 
 	hs.suite = selectCipherSuite(preferenceList, hs.clientHello.cipherSuites, hs.cipherSuiteOk)
 	if hs.suite == nil {
+		if c.config.requireStrongCurves && hs.onlyCurvesMissing(preferenceList) {
+			c.sendAlert(alertInsufficientSecurity)
+			return &InsufficientSecurityError{Msg: "no strong curve supported by both client and server"}
+		}
+		if c.config.requireStrongCiphers {
+			c.sendAlert(alertInsufficientSecurity)
+			return &InsufficientSecurityError{Msg: "no strong cipher suite supported by both client and server"}
+		}
 		c.sendAlert(alertHandshakeFailure)
 		return errors.New("tls: no cipher suite supported by both client and server")
 	}
@@ -372,6 +383,18 @@ func (hs *serverHandshakeState) pickCipherSuite() error {
 	return nil
 }
 
+// onlyCurvesMissing reports whether a cipher suite from preferenceList
+// would have been selected if the client shared an ECDHE curve with the
+// server, that is whether the curves alone made negotiation fail.
+func (hs *serverHandshakeState) onlyCurvesMissing(preferenceList []uint16) bool {
+	if hs.ecdheOk || !supportsECDHE(&Config{}, hs.clientHello.supportedCurves, hs.clientHello.supportedPoints) {
+		return false
+	}
+	relaxed := *hs
+	relaxed.ecdheOk = true
+	return selectCipherSuite(preferenceList, hs.clientHello.cipherSuites, relaxed.cipherSuiteOk) != nil
+}
+
 func (hs *serverHandshakeState) cipherSuiteOk(c *cipherSuite) bool {
 	if c.flags&suiteECDHE != 0 {
 		if !hs.ecdheOk {
@@ -483,6 +506,7 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 	}
 
 	hs.masterSecret = hs.sessionState.masterSecret
+	c.saveSecret(keyLogLabelTLS12, hs.clientHello.random, hs.masterSecret)
 
 	return nil
 }
@@ -531,6 +555,9 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		c.sendAlert(alertHandshakeFailure)
 		return err
 	}
+	if ka, ok := keyAgreement.(*ecdheKeyAgreement); ok {
+		c.curveID = ka.params.CurveID()
+	}
 	if skx != nil {
 		hs.finishedHash.Write(skx.marshal())
 		if _, err := c.writeRecord(recordTypeHandshake, skx.marshal()); err != nil {
@@ -627,7 +654,7 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		return err
 	}
 	hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.clientHello.random, hs.hello.random)
-	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.clientHello.random, hs.masterSecret); err != nil {
+	if err := c.writeKeyLog(keyLogLabelTLS12, hs.clientHello.random, hs.masterSecret); err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
@@ -831,7 +858,7 @@ func (c *Conn) processCertsFromClient(certificate Certificate) error {
 
 		chains, err := certs[0].Verify(opts)
 		if err != nil {
-			c.sendAlert(alertBadCertificate)
+			c.sendAlert(certificateErrorAlert(err))
 			return errors.New("tls: failed to verify client certificate: " + err.Error())
 		}
 
@@ -33,6 +33,7 @@ type serverHandshakeStateTLS13 struct {
 	suite           *cipherSuiteTLS13
 	cert            *Certificate
 	sigAlg          SignatureScheme
+	dc              []byte // encoded delegated credential, if signing with one
 	earlySecret     []byte
 	sharedKey       []byte
 	handshakeSecret []byte
@@ -79,6 +80,7 @@ func (hs *serverHandshakeStateTLS13) handshake() error {
 	}
 
 	atomic.StoreUint32(&c.handshakeStatus, 1)
+	c.handshakeStage(HandshakeStageFinished)
 
 	return nil
 }
@@ -192,6 +194,10 @@ GroupSelection:
 		}
 	}
 	if selectedGroup == 0 {
+		if c.config.requireStrongCurves {
+			c.sendAlert(alertInsufficientSecurity)
+			return &InsufficientSecurityError{Msg: "no strong curve supported by both client and server"}
+		}
 		c.sendAlert(alertHandshakeFailure)
 		return errors.New("tls: no ECDHE curve supported by both client and server")
 	}
@@ -217,6 +223,7 @@ GroupSelection:
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid client key share")
 	}
+	c.curveID = selectedGroup
 
 	c.serverName = hs.clientHello.serverName
 	return nil
@@ -378,9 +385,36 @@ func (hs *serverHandshakeStateTLS13) pickCertificate() error {
 	}
 	hs.cert = certificate
 
+	if dc := certificate.DelegatedCredential; dc != nil && hs.useDelegatedCredential(dc) {
+		hs.dc, err = dc.marshal()
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		hs.sigAlg = dc.Scheme
+		c.delegatedCredential = true
+	}
+
 	return nil
 }
 
+// useDelegatedCredential reports whether dc can replace the certificate key
+// for this client: it must have advertised support for both of the
+// credential's algorithms, and dc must not have expired. See RFC 9345,
+// Section 4.1.1.
+func (hs *serverHandshakeStateTLS13) useDelegatedCredential(dc *DelegatedCredential) bool {
+	if dc.PrivateKey == nil ||
+		!isSupportedSignatureAlgorithm(dc.Scheme, hs.clientHello.supportedSignatureAlgorithms) ||
+		!isSupportedSignatureAlgorithm(dc.Algorithm, hs.clientHello.delegatedCredentialSchemes) {
+		return false
+	}
+	leaf, err := hs.cert.leaf()
+	if err != nil {
+		return false
+	}
+	return hs.c.config.time().Before(dc.Expiry(leaf))
+}
+
 // sendDummyChangeCipherSpec sends a ChangeCipherSpec record for compatibility
 // with middleboxes that didn't implement TLS correctly. See RFC 8446, Appendix D.4.
 func (hs *serverHandshakeStateTLS13) sendDummyChangeCipherSpec() error {
@@ -538,12 +572,12 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		serverHandshakeTrafficLabel, hs.transcript)
 	c.out.setTrafficSecret(hs.suite, serverSecret)
 
-	err := c.config.writeKeyLog(keyLogLabelClientHandshake, hs.clientHello.random, clientSecret)
+	err := c.writeKeyLog(keyLogLabelClientHandshake, hs.clientHello.random, clientSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
-	err = c.config.writeKeyLog(keyLogLabelServerHandshake, hs.clientHello.random, serverSecret)
+	err = c.writeKeyLog(keyLogLabelServerHandshake, hs.clientHello.random, serverSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
@@ -600,6 +634,7 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	certMsg.certificate = *hs.cert
 	certMsg.scts = hs.clientHello.scts && len(hs.cert.SignedCertificateTimestamps) > 0
 	certMsg.ocspStapling = hs.clientHello.ocspStapling && len(hs.cert.OCSPStaple) > 0
+	certMsg.delegatedCredential = hs.dc
 
 	hs.transcript.Write(certMsg.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
@@ -620,9 +655,13 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	if sigType == signatureRSAPSS {
 		signOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: sigHash}
 	}
-	sig, err := hs.cert.PrivateKey.(crypto.Signer).Sign(c.config.rand(), signed, signOpts)
+	signer, _ := hs.cert.PrivateKey.(crypto.Signer)
+	if hs.dc != nil {
+		signer = hs.cert.DelegatedCredential.PrivateKey
+	}
+	sig, err := signer.Sign(c.config.rand(), signed, signOpts)
 	if err != nil {
-		public := hs.cert.PrivateKey.(crypto.Signer).Public()
+		public := signer.Public()
 		if rsaKey, ok := public.(*rsa.PublicKey); ok && sigType == signatureRSAPSS &&
 			rsaKey.N.BitLen()/8 < sigHash.Size()*2+2 { // key too small for RSA-PSS
 			c.sendAlert(alertHandshakeFailure)
@@ -664,12 +703,12 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 		serverApplicationTrafficLabel, hs.transcript)
 	c.out.setTrafficSecret(hs.suite, serverSecret)
 
-	err := c.config.writeKeyLog(keyLogLabelClientTraffic, hs.clientHello.random, hs.trafficSecret)
+	err := c.writeKeyLog(keyLogLabelClientTraffic, hs.clientHello.random, hs.trafficSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
-	err = c.config.writeKeyLog(keyLogLabelServerTraffic, hs.clientHello.random, serverSecret)
+	err = c.writeKeyLog(keyLogLabelServerTraffic, hs.clientHello.random, serverSecret)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
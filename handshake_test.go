@@ -0,0 +1,1549 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nXTLS/Go/xtlstest"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCertificate returns a self-signed ECDSA certificate valid for names.
+func testCertificate(t *testing.T, names ...string) Certificate {
+	t.Helper()
+	der, key, err := xtlstest.Certificate(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testRSACertificate returns a self-signed certificate with an RSA key of
+// the given size.
+func testRSACertificate(t *testing.T, bits int) Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nxtls test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testHandshake runs a handshake between clientConfig and serverConfig over
+// an in-memory pipe and returns both connections along with their handshake
+// errors.
+func testHandshake(t *testing.T, clientConfig, serverConfig *Config) (client, server *Conn, clientErr, serverErr error) {
+	t.Helper()
+	c1, c2 := xtlstest.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	server = Server(c1, serverConfig)
+	client = Client(c2, clientConfig)
+	clientErr, serverErr = xtlstest.Handshake(client, server)
+	return client, server, clientErr, serverErr
+}
+
+func TestRequireStrongCiphers(t *testing.T) {
+	clientConfig := &Config{InsecureSkipVerify: true}
+	RequireStrongCiphers(clientConfig)
+	RequireStrongCurves(clientConfig)
+	serverConfig := &Config{
+		Certificates: []Certificate{testCertificate(t, "example.test")},
+		MaxVersion:   VersionTLS12,
+		CipherSuites: []uint16{TLS_RSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	}
+
+	// A plain handshake_failure does not say why the server gave up, so it
+	// is not reported as an InsufficientSecurityError.
+	_, _, err, _ := testHandshake(t, clientConfig, serverConfig)
+	var secErr *InsufficientSecurityError
+	var opErr *net.OpError
+	if errors.As(err, &secErr) || !errors.As(err, &opErr) || opErr.Err != alertHandshakeFailure {
+		t.Fatalf("client handshake error = %v, want the server's handshake_failure alert", err)
+	}
+
+	// A strong-only server that finds no suite says insufficient_security,
+	// which is.
+	strictServer := &Config{Certificates: serverConfig.Certificates, MaxVersion: VersionTLS12}
+	RequireStrongCiphers(strictServer)
+	strictServer.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256} // unusable with the ECDSA certificate
+	_, _, err, _ = testHandshake(t, clientConfig, strictServer)
+	if !errors.As(err, &secErr) {
+		t.Fatalf("client handshake error = %v, want an InsufficientSecurityError", err)
+	}
+
+	// The same client completes against a server with a strong suite.
+	serverConfig.CipherSuites = append(serverConfig.CipherSuites, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	client, _, err, _ := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite := client.ConnectionState().CipherSuite; suite != TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("negotiated %s, want a strong suite", CipherSuiteName(suite))
+	}
+}
+
+func TestRequireStrongCiphersServer(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	RequireStrongCiphers(serverConfig)
+	clientConfig := &Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         VersionTLS12,
+		CipherSuites:       []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	}
+
+	_, _, _, err := testHandshake(t, clientConfig, serverConfig)
+	var secErr *InsufficientSecurityError
+	if !errors.As(err, &secErr) {
+		t.Fatalf("server handshake error = %v, want an InsufficientSecurityError", err)
+	}
+}
+
+func TestRequireStrongCurvesServerTLS12(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	RequireStrongCurves(serverConfig)
+	clientConfig := &Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         VersionTLS12,
+		CurvePreferences:   []CurveID{CurveP521},
+	}
+
+	_, _, clientErr, serverErr := testHandshake(t, clientConfig, serverConfig)
+	var secErr *InsufficientSecurityError
+	if !errors.As(serverErr, &secErr) || !strings.Contains(secErr.Msg, "curve") {
+		t.Errorf("server handshake error = %v, want an InsufficientSecurityError about curves", serverErr)
+	}
+	var opErr *net.OpError
+	if !errors.As(clientErr, &opErr) || opErr.Err != alertInsufficientSecurity {
+		t.Errorf("client handshake error = %v, want the server's insufficient_security alert", clientErr)
+	}
+}
+
+func TestAbortHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	// The peer swallows the ClientHello and never answers.
+	go io.Copy(io.Discard, c1)
+
+	client := Client(c2, &Config{InsecureSkipVerify: true})
+	sent := make(chan struct{})
+	client.SetHandshakeProgress(func(stage string) {
+		if stage == HandshakeStageClientHelloSent {
+			close(sent)
+		}
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- client.Handshake() }()
+
+	<-sent // the handshake now waits for the ServerHello
+	client.AbortHandshake()
+	select {
+	case err := <-errc:
+		if err != ErrHandshakeAborted {
+			t.Fatalf("Handshake error = %v, want %v", err, ErrHandshakeAborted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AbortHandshake did not interrupt the handshake")
+	}
+	if err := client.Handshake(); err != ErrHandshakeAborted {
+		t.Errorf("second Handshake error = %v, want %v", err, ErrHandshakeAborted)
+	}
+}
+
+// abortingConn calls abort after the first Write once armed is set, as a
+// concurrent AbortHandshake would between the client's last flight and the
+// end of its handshake.
+type abortingConn struct {
+	net.Conn
+	armed bool
+	abort func()
+}
+
+func (c *abortingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.armed {
+		c.armed = false
+		c.abort()
+	}
+	return n, err
+}
+
+func TestAbortHandshakeCompleting(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	server := Server(c1, &Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+	conn := &abortingConn{Conn: c2}
+	client := Client(conn, &Config{InsecureSkipVerify: true})
+	conn.abort = client.AbortHandshake
+	client.SetHandshakeProgress(func(stage string) {
+		// The client's next write is its Finished message.
+		if stage == HandshakeStageCertificateReceived {
+			conn.armed = true
+		}
+	})
+	clientErr, _ := xtlstest.Handshake(client, server)
+	if clientErr != ErrHandshakeAborted {
+		t.Fatalf("Handshake error = %v, want %v", clientErr, ErrHandshakeAborted)
+	}
+	if client.ConnectionState().HandshakeComplete {
+		t.Error("an aborted handshake is reported as complete")
+	}
+
+	// Racing the end of the handshake, AbortHandshake either takes effect
+	// or is too late, never both.
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	for i := 0; i < 50; i++ {
+		c1, c2 := xtlstest.Pipe()
+		server := Server(c1, serverConfig)
+		client := Client(c2, &Config{InsecureSkipVerify: true})
+		hello := make(chan struct{})
+		client.SetHandshakeProgress(func(stage string) {
+			if stage == HandshakeStageServerHelloReceived {
+				close(hello)
+			}
+		})
+		aborted := make(chan struct{})
+		go func() {
+			<-hello
+			client.AbortHandshake()
+			close(aborted)
+		}()
+		err, _ := xtlstest.Handshake(client, server)
+		<-aborted
+		if err == nil {
+			if _, err := client.Write([]byte("x")); err != nil {
+				t.Fatalf("Write after a successful handshake: %v", err)
+			}
+		} else if err != ErrHandshakeAborted {
+			t.Fatalf("Handshake error = %v, want nil or %v", err, ErrHandshakeAborted)
+		} else if client.ConnectionState().HandshakeComplete {
+			t.Fatal("an aborted handshake is reported as complete")
+		}
+		c1.Close()
+		c2.Close()
+	}
+
+	// Once the handshake has completed, AbortHandshake leaves it alone.
+	client, server, err, _ := testHandshake(t, &Config{InsecureSkipVerify: true}, &Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AbortHandshake()
+	go io.Copy(io.Discard, server)
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Errorf("Write after AbortHandshake of a completed handshake: %v", err)
+	}
+}
+
+func TestAddRootCAPEM(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	serverConfig := &Config{Certificates: []Certificate{cert}}
+
+	// Neither the system pool nor an unrelated pool trust the server.
+	for _, roots := range []*x509.CertPool{nil, x509.NewCertPool()} {
+		clientConfig := &Config{ServerName: "example.test"}
+		SetRootCAs(clientConfig, roots)
+		_, _, err, _ := testHandshake(t, clientConfig, serverConfig)
+		var unknown x509.UnknownAuthorityError
+		if !errors.As(err, &unknown) {
+			t.Errorf("handshake error = %v, want an x509.UnknownAuthorityError", err)
+		}
+	}
+
+	clientConfig := &Config{ServerName: "example.test"}
+	if err := AddRootCAPEM(clientConfig, []byte("not a certificate")); err == nil {
+		t.Error("AddRootCAPEM accepted input without certificates")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := AddRootCAPEM(clientConfig, certPEM); err != nil {
+		t.Fatal(err)
+	}
+	client, _, err, _ := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VerifyHostname("example.test"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireAndVerifyClientCert(t *testing.T) {
+	clientCert := testCertificate(t, "client.test")
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	SetClientCAs(serverConfig, pool)
+	SetClientAuth(serverConfig, RequireAndVerifyClientCert)
+
+	_, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true, Certificates: []Certificate{clientCert}}, serverConfig)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake with a trusted client cert: client %v, server %v", err, serverErr)
+	}
+	chains := server.ConnectionState().VerifiedChains
+	if len(chains) == 0 || !chains[0][0].Equal(leaf) {
+		t.Errorf("VerifiedChains = %v, want a chain for the client certificate", chains)
+	}
+
+	unknown := testCertificate(t, "client.test")
+	client, _, _, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true, Certificates: []Certificate{unknown}}, serverConfig)
+	if serverErr == nil {
+		t.Fatal("server accepted an unknown client certificate")
+	}
+	// In TLS 1.3 the client learns of the rejection from the alert that
+	// follows its Finished message.
+	_, err = client.Read(make([]byte, 1))
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err != alertUnknownCA {
+		t.Errorf("client error = %v, want an unknown_ca alert", err)
+	}
+}
+
+func TestCleanlyClosed(t *testing.T) {
+	config := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after close_notify = %v, want io.EOF", err)
+	}
+	if !client.CleanlyClosed() {
+		t.Error("CleanlyClosed = false after close_notify")
+	}
+
+	client, server, err, serverErr = testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	// Drop the transport without sending close_notify.
+	server.NetConn().Close()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after abrupt close = %v, want io.EOF", err)
+	}
+	if client.CleanlyClosed() {
+		t.Error("CleanlyClosed = true after an abrupt close")
+	}
+}
+
+func TestWithMinRSABits(t *testing.T) {
+	var called bool
+	clientConfig := WithMinRSABits(&Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			called = true
+			return nil
+		},
+	}, 2048)
+
+	weak := &Config{Certificates: []Certificate{testRSACertificate(t, 1024)}}
+	_, _, err, _ := testHandshake(t, clientConfig, weak)
+	if err == nil {
+		t.Fatal("handshake with a 1024-bit RSA certificate succeeded")
+	}
+	if called {
+		t.Error("chained VerifyPeerCertificate ran after the key size check failed")
+	}
+
+	strong := &Config{Certificates: []Certificate{testRSACertificate(t, 2048)}}
+	if _, _, err, serverErr := testHandshake(t, clientConfig, strong); err != nil || serverErr != nil {
+		t.Fatalf("handshake with a 2048-bit RSA certificate: client %v, server %v", err, serverErr)
+	}
+	if !called {
+		t.Error("chained VerifyPeerCertificate was not called")
+	}
+}
+
+func TestChannelBinding(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	tests := []struct {
+		version     uint16
+		bindingType string
+		supported   bool
+	}{
+		{VersionTLS13, ChannelBindingTLSExporter, true},
+		{VersionTLS13, ChannelBindingTLSUnique, false},
+		{VersionTLS12, ChannelBindingTLSUnique, true},
+		{VersionTLS12, ChannelBindingTLSExporter, false},
+		{VersionTLS13, "tls-server-end-point", false},
+	}
+	for _, tt := range tests {
+		clientConfig := &Config{InsecureSkipVerify: true, MaxVersion: tt.version}
+		client, server, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", err, serverErr)
+		}
+		cb, err := client.ChannelBinding(tt.bindingType)
+		if !tt.supported {
+			var cbErr *UnsupportedChannelBindingError
+			if !errors.As(err, &cbErr) || cbErr.Type != tt.bindingType || cbErr.Version != tt.version {
+				t.Errorf("%x %s: err = %v, want an UnsupportedChannelBindingError", tt.version, tt.bindingType, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%x %s: client: %v", tt.version, tt.bindingType, err)
+		}
+		sb, err := server.ChannelBinding(tt.bindingType)
+		if err != nil {
+			t.Fatalf("%x %s: server: %v", tt.version, tt.bindingType, err)
+		}
+		if len(cb) == 0 || !bytes.Equal(cb, sb) {
+			t.Errorf("%x %s: client binding %x, server binding %x", tt.version, tt.bindingType, cb, sb)
+		}
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	if c := CloneConfig(nil); c == nil {
+		t.Fatal("CloneConfig(nil) = nil")
+	}
+
+	cert := testCertificate(t, "example.test")
+	orig := &Config{
+		ServerName:        "example.test",
+		Certificates:      []Certificate{cert},
+		NextProtos:        []string{"h2"},
+		CipherSuites:      []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		CurvePreferences:  []CurveID{X25519},
+		NameToCertificate: map[string]*Certificate{"example.test": &cert},
+	}
+	clone := CloneConfig(orig)
+	clone.ServerName = "other.test"
+	clone.Certificates[0] = Certificate{}
+	clone.NextProtos[0] = "http/1.1"
+	clone.CipherSuites[0] = TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	clone.CurvePreferences[0] = CurveP256
+	delete(clone.NameToCertificate, "example.test")
+
+	if orig.ServerName != "example.test" ||
+		orig.Certificates[0].PrivateKey == nil ||
+		orig.NextProtos[0] != "h2" ||
+		orig.CipherSuites[0] != TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ||
+		orig.CurvePreferences[0] != X25519 ||
+		orig.NameToCertificate["example.test"] == nil {
+		t.Errorf("modifying the clone changed the original: %+v", orig)
+	}
+
+	if c := CloneConfig(&Config{CipherSuites: []uint16{}}); c.CipherSuites == nil {
+		t.Error("CloneConfig turned an empty CipherSuites into nil")
+	}
+}
+
+func TestCloseNotify(t *testing.T) {
+	config := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	if err := server.CloseNotify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after CloseNotify = %v, want io.EOF", err)
+	}
+	if !client.CleanlyClosed() {
+		t.Error("peer did not see a close_notify")
+	}
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Error("Write after CloseNotify succeeded")
+	}
+
+	// The TCP-level connection stays usable, e.g. for a fallback.
+	if _, err := server.NetConn().Write([]byte("fallback")); err != nil {
+		t.Fatalf("raw Write after CloseNotify: %v", err)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(client.NetConn(), buf); err != nil || string(buf) != "fallback" {
+		t.Fatalf("raw Read = %q, %v, want %q", buf, err, "fallback")
+	}
+
+	// A write deadline set before CloseNotify is put back afterwards.
+	_, server, err, serverErr = testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	server.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := server.CloseNotify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.NetConn().Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("raw Write after CloseNotify = %v, want the restored deadline to expire it", err)
+	}
+}
+
+func TestResumptionMethod(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	for _, tt := range []struct {
+		version uint16
+		want    string
+	}{
+		{VersionTLS12, ResumptionSessionTicket},
+		{VersionTLS13, ResumptionPSKTicket},
+	} {
+		clientConfig := &Config{
+			InsecureSkipVerify: true,
+			ServerName:         "example.test",
+			MaxVersion:         tt.version,
+			ClientSessionCache: NewLRUClientSessionCache(1),
+		}
+		client, server, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", err, serverErr)
+		}
+		if m := client.ResumptionMethod(); m != ResumptionNone {
+			t.Errorf("%x: first ResumptionMethod = %q, want %q", tt.version, m, ResumptionNone)
+		}
+		// TLS 1.3 tickets arrive after the handshake; a Read processes them.
+		go server.Write([]byte("x"))
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		client, server, err, serverErr = testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("resumed handshake: client %v, server %v", err, serverErr)
+		}
+		if m := client.ResumptionMethod(); m != tt.want {
+			t.Errorf("%x: client ResumptionMethod = %q, want %q", tt.version, m, tt.want)
+		}
+		if m := server.ResumptionMethod(); m != tt.want {
+			t.Errorf("%x: server ResumptionMethod = %q, want %q", tt.version, m, tt.want)
+		}
+	}
+}
+
+// testIssuedCertificate returns a test CA and a certificate it issued from
+// template for a fresh ECDSA key.
+func testIssuedCertificate(t *testing.T, template *x509.Certificate) (ca *x509.Certificate, caKey *ecdsa.PrivateKey, cert Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nxtls test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return ca, caKey, Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRequireStapledOCSP(t *testing.T) {
+	ca, caKey, issued := testIssuedCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.test"},
+		DNSNames:     []string{"example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		// TLS feature extension (RFC 7633) with status_request: must-staple.
+		ExtraExtensions: []pkix.Extension{{
+			Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+			Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+		}},
+	})
+	leaf := issued.Leaf
+
+	staple := func(status int) []byte {
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig := &Config{RootCAs: roots, ServerName: "example.test", MaxVersion: version, RequireStapledOCSP: true}
+		for _, tt := range []struct {
+			name   string
+			staple []byte
+			ok     bool
+		}{
+			{"missing", nil, false},
+			{"good", staple(ocsp.Good), true},
+			{"revoked", staple(ocsp.Revoked), false},
+		} {
+			cert := issued
+			cert.OCSPStaple = tt.staple
+			_, _, err, _ := testHandshake(t, clientConfig, &Config{Certificates: []Certificate{cert}})
+			var stapleErr *OCSPStapleError
+			if tt.ok && err != nil {
+				t.Errorf("%x %s staple: %v", version, tt.name, err)
+			}
+			if !tt.ok && !errors.As(err, &stapleErr) {
+				t.Errorf("%x %s staple: err = %v, want an OCSPStapleError", version, tt.name, err)
+			}
+		}
+	}
+}
+
+func TestClientJA3JA4(t *testing.T) {
+	// A ClientHello with GREASE values in the cipher suites, extensions,
+	// groups and versions, which both fingerprints must ignore.
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(VersionTLS12)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0) // session ID
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range []uint16{0x0a0a, TLS_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256} {
+				b.AddUint16(suite)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(compressionNone) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			ext := func(typ uint16, body func(b *cryptobyte.Builder)) {
+				b.AddUint16(typ)
+				b.AddUint16LengthPrefixed(body)
+			}
+			ext(0x0a0a, func(b *cryptobyte.Builder) {})
+			ext(extensionServerName, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0) // host_name
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("example.test")) })
+				})
+			})
+			ext(extensionSupportedCurves, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x1a1a)
+					b.AddUint16(uint16(X25519))
+					b.AddUint16(uint16(CurveP256))
+				})
+			})
+			ext(extensionSupportedPoints, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(pointFormatUncompressed) })
+			})
+			ext(extensionSignatureAlgorithms, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(uint16(ECDSAWithP256AndSHA256))
+					b.AddUint16(uint16(PSSWithSHA256))
+				})
+			})
+			ext(extensionALPN, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, proto := range []string{"h2", "http/1.1"} {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(proto)) })
+					}
+				})
+			})
+			ext(extensionSupportedVersions, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x0a0a)
+					b.AddUint16(VersionTLS13)
+					b.AddUint16(VersionTLS12)
+				})
+			})
+		})
+	})
+	var hello clientHelloMsg
+	if !hello.unmarshal(b.BytesOrPanic()) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	c := &Conn{clientHello: &hello}
+
+	if want := "771,4865-49199,0-10-11-13-16-43,29-23,0"; ja3String(&hello) != want {
+		t.Errorf("JA3 string = %q, want %q", ja3String(&hello), want)
+	}
+	if got, want := c.ClientJA3(), "97737df38853b88c4324af06e211c4a1"; got != want {
+		t.Errorf("ClientJA3 = %q, want %q", got, want)
+	}
+	if got, want := c.ClientJA4(), "t13d0206h2_c1929292aa6b_fb71836bce29"; got != want {
+		t.Errorf("ClientJA4 = %q, want %q", got, want)
+	}
+
+	// A real handshake records the ClientHello on the server only.
+	client, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true},
+		&Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	if len(server.ClientJA3()) != 32 || !strings.HasPrefix(server.ClientJA4(), "t13i") {
+		t.Errorf("server fingerprints = %q, %q", server.ClientJA3(), server.ClientJA4())
+	}
+	if client.ClientJA3() != "" || client.ClientJA4() != "" {
+		t.Error("client connection reported a ClientHello fingerprint")
+	}
+}
+
+// writeLog records the bytes of every Write on a net.Conn.
+type writeLog struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (w *writeLog) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), b...))
+	return w.Conn.Write(b)
+}
+
+// recordCount returns the number of TLS records in b.
+func recordCount(b []byte) int {
+	n := 0
+	for len(b) >= recordHeaderLen {
+		end := recordHeaderLen + (int(b[3])<<8 | int(b[4]))
+		if end > len(b) {
+			break
+		}
+		b = b[end:]
+		n++
+	}
+	return n
+}
+
+func TestQueueFirstWrite(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		c1, c2 := xtlstest.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		server := Server(c1, &Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+		log := &writeLog{Conn: c2}
+		client := Client(log, &Config{InsecureSkipVerify: true, MaxVersion: version})
+
+		if err := client.QueueFirstWrite([]byte("hello, ")); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.QueueFirstWrite([]byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("TLS %x: client handshake: %v", version, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("TLS %x: server handshake: %v", version, err)
+		}
+		if version == VersionTLS13 {
+			// ChangeCipherSpec, Finished and the queued data share the
+			// final write.
+			if last := log.writes[len(log.writes)-1]; recordCount(last) != 3 {
+				t.Errorf("final handshake write holds %d records, want 3", recordCount(last))
+			}
+		}
+		if err := client.QueueFirstWrite([]byte("late")); err == nil {
+			t.Errorf("TLS %x: QueueFirstWrite after the handshake succeeded", version)
+		}
+
+		go client.Write([]byte("!"))
+		buf := make([]byte, 13)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello, world!" {
+			t.Errorf("TLS %x: server read %q, %v, want %q", version, buf, err, "hello, world!")
+		}
+	}
+
+	server := Server(nil, &Config{})
+	if err := server.QueueFirstWrite([]byte("x")); err == nil {
+		t.Error("QueueFirstWrite on a server succeeded")
+	}
+}
+
+func TestWriteBuffering(t *testing.T) {
+	config := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	if err := client.Flush(); err != nil || client.Buffered() != 0 {
+		t.Fatalf("Flush with nothing buffered = %v, Buffered = %d", err, client.Buffered())
+	}
+	if err := client.SetWriteBuffering(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello, ", "world"} {
+		if _, err := client.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := client.Buffered(); n <= len("hello, world") {
+		t.Fatalf("Buffered = %d, want more than %d", n, len("hello, world"))
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Buffered(); n != 0 {
+		t.Fatalf("Buffered after Flush = %d, want 0", n)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatalf("second Flush = %v", err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello, world" {
+		t.Fatalf("server read %q, %v, want %q", buf, err, "hello, world")
+	}
+
+	// Buffering stays on after Flush, and Close sends what is left.
+	client.Write([]byte("bye"))
+	if client.Buffered() == 0 {
+		t.Fatal("Write after Flush was not buffered")
+	}
+	client.Close()
+	if b, err := io.ReadAll(server); err != nil || string(b) != "bye" {
+		t.Fatalf("server read %q, %v after Close, want %q", b, err, "bye")
+	}
+}
+
+func TestWithGREASE(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig := &Config{InsecureSkipVerify: true, MaxVersion: version}
+		_, plain, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", err, serverErr)
+		}
+		_, server, err, serverErr := testHandshake(t, WithGREASE(clientConfig, true), serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("TLS %x: GREASE handshake: client %v, server %v", version, err, serverErr)
+		}
+
+		hello := server.clientHello
+		exts := hello.extensions
+		if !isGREASE(hello.cipherSuites[0]) || !isGREASE(uint16(hello.supportedCurves[0])) ||
+			!isGREASE(hello.supportedVersions[0]) || !isGREASE(exts[0]) || !isGREASE(exts[len(exts)-1]) {
+			t.Errorf("TLS %x: ClientHello lacks GREASE: suites %x, groups %x, versions %x, extensions %x",
+				version, hello.cipherSuites, hello.supportedCurves, hello.supportedVersions, exts)
+		}
+		if exts[0] == exts[len(exts)-1] {
+			t.Errorf("TLS %x: both GREASE extensions are %x", version, exts[0])
+		}
+		if plain.ClientJA3() != server.ClientJA3() {
+			t.Errorf("TLS %x: GREASE changed the JA3 fingerprint", version)
+		}
+		for _, ext := range plain.clientHello.extensions {
+			if isGREASE(ext) {
+				t.Errorf("TLS %x: GREASE extension %x sent without WithGREASE", version, ext)
+			}
+		}
+	}
+
+	if WithGREASE(WithGREASE(nil, true), false).grease {
+		t.Error("WithGREASE(config, false) did not turn GREASE off")
+	}
+}
+
+func TestSetCipherOrder(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	order := []uint16{
+		TLS_CHACHA20_POLY1305_SHA256,
+		TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		TLS_AES_128_GCM_SHA256,
+		TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+	curves := []CurveID{CurveP256, X25519}
+
+	for _, tt := range []struct {
+		maxVersion uint16
+		want       []uint16
+	}{
+		{VersionTLS13, order},
+		{VersionTLS12, []uint16{order[1], order[3], order[4]}},
+	} {
+		clientConfig := &Config{InsecureSkipVerify: true, MaxVersion: tt.maxVersion}
+		clientConfig.SetCipherOrder(order)
+		clientConfig.SetCurveOrder(curves)
+		_, server, err, serverErr := testHandshake(t, clientConfig.Clone(), serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("TLS %x: handshake: client %v, server %v", tt.maxVersion, err, serverErr)
+		}
+		hello := server.clientHello
+		if fmt.Sprint(hello.cipherSuites) != fmt.Sprint(tt.want) {
+			t.Errorf("TLS %x: offered suites %x, want %x", tt.maxVersion, hello.cipherSuites, tt.want)
+		}
+		if fmt.Sprint(hello.supportedCurves) != fmt.Sprint(curves) {
+			t.Errorf("TLS %x: offered groups %v, want %v", tt.maxVersion, hello.supportedCurves, curves)
+		}
+	}
+
+	// Without SetCipherOrder the built-in preference reorders CipherSuites,
+	// and with only TLS 1.2 suites the default TLS 1.3 ones are appended.
+	reversed := []uint16{TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	for _, exact := range []bool{false, true} {
+		clientConfig := &Config{InsecureSkipVerify: true, CipherSuites: reversed}
+		if exact {
+			clientConfig.SetCipherOrder(reversed)
+		}
+		_, server, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("handshake: client %v, server %v", err, serverErr)
+		}
+		suites := server.clientHello.cipherSuites
+		if got := suites[0] == reversed[0]; got != exact {
+			t.Errorf("exact order %t: offered suites %x", exact, suites)
+		}
+		if len(suites) <= len(reversed) || cipherSuiteTLS13ByID(suites[len(suites)-1]) == nil {
+			t.Errorf("exact order %t: offered suites %x lack the default TLS 1.3 suites", exact, suites)
+		}
+	}
+
+	config := &Config{}
+	config.SetCipherOrder(order)
+	config.SetCipherOrder(nil)
+	if config.CipherSuites != nil || config.exactCipherOrder {
+		t.Error("SetCipherOrder(nil) did not restore the defaults")
+	}
+}
+
+func TestExportSecrets(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		var keyLog strings.Builder
+		clientConfig := &Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         version,
+			KeyLogWriter:       &keyLog,
+			AllowSecretExport:  true,
+		}
+		if _, err := Client(nil, clientConfig).ExportSecrets(); err != ErrNotHandshaken {
+			t.Errorf("TLS %x: ExportSecrets before the handshake = %v, want %v", version, err, ErrNotHandshaken)
+		}
+		client, server, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+		if err != nil || serverErr != nil {
+			t.Fatalf("TLS %x: handshake: client %v, server %v", version, err, serverErr)
+		}
+		s, err := client.ExportSecrets()
+		if err != nil {
+			t.Fatalf("TLS %x: ExportSecrets: %v", version, err)
+		}
+		if s.Version != version {
+			t.Errorf("TLS %x: Version = %x", version, s.Version)
+		}
+		secrets := map[string][]byte{keyLogLabelTLS12: s.MasterSecret}
+		if version == VersionTLS13 {
+			secrets = map[string][]byte{
+				keyLogLabelClientHandshake: s.ClientHandshakeTrafficSecret,
+				keyLogLabelServerHandshake: s.ServerHandshakeTrafficSecret,
+				keyLogLabelClientTraffic:   s.ClientTrafficSecret,
+				keyLogLabelServerTraffic:   s.ServerTrafficSecret,
+			}
+		}
+		for label, secret := range secrets {
+			line := fmt.Sprintf("%s %x %x\n", label, s.ClientRandom, secret)
+			if len(secret) == 0 || !strings.Contains(keyLog.String(), line) {
+				t.Errorf("TLS %x: %s = %x does not match the key log:\n%s", version, label, secret, keyLog.String())
+			}
+		}
+
+		if _, err := server.ExportSecrets(); err != ErrSecretExportDisabled {
+			t.Errorf("TLS %x: ExportSecrets without AllowSecretExport = %v, want %v", version, err, ErrSecretExportDisabled)
+		}
+	}
+}
+
+func TestHandshakeErrorAlertCode(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	_, _, err, serverErr := testHandshake(t, &Config{ServerName: "example.test"}, serverConfig)
+
+	// The client does not trust the self-signed certificate, so it sends
+	// unknown_ca and the server receives it.
+	var clientHE, serverHE *HandshakeError
+	if !errors.As(err, &clientHE) || clientHE.Remote || clientHE.AlertCode() != uint8(alertUnknownCA) {
+		t.Errorf("client error = %#v, want a local unknown_ca HandshakeError", err)
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthority) {
+		t.Errorf("client error %v does not wrap the verification error", err)
+	}
+	if !errors.As(serverErr, &serverHE) || !serverHE.Remote || serverHE.AlertCode() != 48 {
+		t.Errorf("server error = %#v, want a remote HandshakeError with alert 48", serverErr)
+	}
+
+	// Failures without an alert are not wrapped.
+	client := Client(nil, &Config{})
+	if err := client.Handshake(); errors.As(err, &clientHE) {
+		t.Errorf("Handshake without ServerName = %v, want a plain error", err)
+	}
+}
+
+func TestDelegatedCredential(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nxtls test"},
+		DNSNames:     []string{"example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidDelegationUsage, Value: []byte{0x05, 0x00}}, // NULL
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	cert.DelegatedCredential, err = NewDelegatedCredential(&cert, Ed25519, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	serverConfig := &Config{Certificates: []Certificate{cert}}
+	clientConfig := &Config{ServerName: "example.test", RootCAs: roots, SupportDelegatedCredential: true}
+
+	client, server, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	if !client.ConnectionState().DelegatedCredential || !server.ConnectionState().DelegatedCredential {
+		t.Error("delegated credential not reported as used")
+	}
+
+	// Clients that do not advertise support get the certificate key.
+	client, _, err, serverErr = testHandshake(t, &Config{ServerName: "example.test", RootCAs: roots}, serverConfig)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake without support: client %v, server %v", err, serverErr)
+	}
+	if client.ConnectionState().DelegatedCredential {
+		t.Error("delegated credential used without client support")
+	}
+
+	// A credential the certificate did not sign is rejected.
+	forged := *cert.DelegatedCredential
+	forged.Signature = append([]byte(nil), forged.Signature...)
+	forged.Signature[len(forged.Signature)-1] ^= 1
+	forgedCert := cert
+	forgedCert.DelegatedCredential = &forged
+	_, _, err, _ = testHandshake(t, clientConfig, &Config{Certificates: []Certificate{forgedCert}})
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.AlertCode() != uint8(alertIllegalParameter) {
+		t.Errorf("handshake with a forged credential = %v, want illegal_parameter", err)
+	}
+
+	// Only certificates with the DelegationUsage extension may issue them.
+	plain := testCertificate(t, "example.test")
+	if _, err := NewDelegatedCredential(&plain, Ed25519, time.Hour); err == nil {
+		t.Error("NewDelegatedCredential accepted a certificate without DelegationUsage")
+	}
+	if _, err := NewDelegatedCredential(&cert, Ed25519, 8*24*time.Hour); err == nil {
+		t.Error("NewDelegatedCredential accepted a validity of eight days")
+	}
+}
+
+func TestVerifyHostnameWithRevocation(t *testing.T) {
+	var responder func(w http.ResponseWriter, r *http.Request)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder(w, r)
+	}))
+	defer srv.Close()
+
+	ca, caKey, issued := testIssuedCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.test"},
+		DNSNames:     []string{"example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{srv.URL},
+	})
+	ocspResponse := func(status int) []byte {
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: issued.Leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	fetcher := func(ctx context.Context, server string, request []byte) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(request))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	verify := func(staple []byte, hardFail bool) error {
+		t.Helper()
+		cert := issued
+		cert.OCSPStaple = staple
+		clientConfig := &Config{RootCAs: roots, ServerName: "example.test", RevocationHardFail: hardFail, OCSPFetcher: fetcher}
+		client, _, err, _ := testHandshake(t, clientConfig, &Config{Certificates: []Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return client.VerifyHostnameWithRevocation(ctx, "example.test")
+	}
+
+	// A good staple settles it without asking the responder.
+	responder = func(w http.ResponseWriter, r *http.Request) {
+		t.Error("responder queried despite a good staple")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := verify(ocspResponse(ocsp.Good), true); err != nil {
+		t.Errorf("good staple: %v", err)
+	}
+	var revErr *RevocationError
+	if err := verify(ocspResponse(ocsp.Revoked), false); !errors.As(err, &revErr) || !revErr.Revoked {
+		t.Errorf("revoked staple: err = %v, want a revoked RevocationError", err)
+	}
+
+	// Without a staple, the responder is asked.
+	responder = func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ocspResponse(ocsp.Good))
+	}
+	if err := verify(nil, true); err != nil {
+		t.Errorf("good live response: %v", err)
+	}
+
+	// An unavailable responder only fails under the hard-fail policy.
+	responder = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := verify(nil, false); err != nil {
+		t.Errorf("soft-fail without revocation info: %v", err)
+	}
+	if err := verify(nil, true); !errors.As(err, &revErr) || revErr.Revoked {
+		t.Errorf("hard-fail without revocation info: err = %v, want an unknown-status RevocationError", err)
+	}
+
+	// Without a fetcher, only the staple is consulted.
+	fetcher = nil
+	responder = func(w http.ResponseWriter, r *http.Request) {
+		t.Error("responder queried without an OCSPFetcher")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := verify(nil, false); err != nil {
+		t.Errorf("soft-fail without a fetcher: %v", err)
+	}
+	if err := verify(nil, true); !errors.As(err, &revErr) || revErr.Revoked {
+		t.Errorf("hard-fail without a fetcher: err = %v, want an unknown-status RevocationError", err)
+	}
+
+	// The name is still checked first.
+	client, _, err, _ := testHandshake(t, &Config{RootCAs: roots, ServerName: "example.test"}, &Config{Certificates: []Certificate{issued}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VerifyHostnameWithRevocation(context.Background(), "other.test"); err == nil {
+		t.Error("VerifyHostnameWithRevocation accepted the wrong host name")
+	}
+}
+
+func TestHandshakeFragmentation(t *testing.T) {
+	serverConfig := &Config{
+		Certificates:           []Certificate{testCertificate(t, "example.test")},
+		MaxRecordsPerHandshake: 8,
+		MinRecordSize:          32,
+	}
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig := &Config{InsecureSkipVerify: true, MaxVersion: version}
+		if _, _, err, serverErr := testHandshake(t, clientConfig, serverConfig); err != nil || serverErr != nil {
+			t.Fatalf("%x: unfragmented handshake: client %v, server %v", version, err, serverErr)
+		}
+	}
+
+	// flood announces a 1000-byte ClientHello and sends it a byte per record.
+	flood := func(config *Config) error {
+		c1, c2 := xtlstest.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		go func() {
+			records := [][]byte{xtlstest.Record(xtlstest.RecordTypeHandshake, []byte{typeClientHello, 0, 0x03, 0xe8})}
+			for i := 0; i < 1000; i++ {
+				records = append(records, xtlstest.Record(xtlstest.RecordTypeHandshake, []byte{0}))
+			}
+			xtlstest.Feed(c2, records...)
+		}()
+		return Server(c1, config).Handshake()
+	}
+
+	var fragErr *FragmentationError
+	if err := flood(&Config{Certificates: serverConfig.Certificates, MaxRecordsPerHandshake: 8}); !errors.As(err, &fragErr) || fragErr.Records != 9 {
+		t.Errorf("tiny records with MaxRecordsPerHandshake = %v, want a FragmentationError after 9 records", err)
+	}
+	if err := flood(&Config{Certificates: serverConfig.Certificates, MinRecordSize: 32}); !errors.As(err, &fragErr) || fragErr.Size != 4 {
+		t.Errorf("tiny records with MinRecordSize = %v, want a FragmentationError for the 4-byte record", err)
+	}
+	var he *HandshakeError
+	if err := flood(serverConfig); !errors.As(err, &he) || he.AlertCode() != uint8(alertHandshakeFailure) {
+		t.Errorf("tiny records = %v, want a handshake_failure alert", err)
+	}
+}
+
+func TestErrorSentinels(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	client := Client(c1, &Config{ServerName: "example.test"})
+	if err := client.VerifyHostname("example.test"); !errors.Is(err, ErrNotHandshaken) {
+		t.Errorf("VerifyHostname before the handshake = %v, want ErrNotHandshaken", err)
+	}
+	state := client.ConnectionState()
+	if _, err := state.ExportKeyingMaterial("EXPERIMENTAL test", nil, 16); !errors.Is(err, ErrNotHandshaken) {
+		t.Errorf("ExportKeyingMaterial before the handshake = %v, want ErrNotHandshaken", err)
+	}
+
+	// The peer never answers, so the handshake runs into the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := client.HandshakeContext(ctx)
+	if !errors.Is(err, ErrHandshakeTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HandshakeContext past its deadline = %v, want ErrHandshakeTimeout and context.DeadlineExceeded", err)
+	}
+
+	c3, c4 := xtlstest.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	c3.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	err = Client(c3, &Config{ServerName: "example.test"}).Handshake()
+	if !errors.Is(err, ErrHandshakeTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Handshake past the connection deadline = %v, want ErrHandshakeTimeout and os.ErrDeadlineExceeded", err)
+	}
+
+	// Renegotiation rules out keying material export.
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	clientConfig := &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS12, Renegotiation: RenegotiateOnceAsClient}
+	client, _, err, serverErr := testHandshake(t, clientConfig, serverConfig)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	state = client.ConnectionState()
+	if _, err := state.ExportKeyingMaterial("EXPERIMENTAL test", nil, 16); !errors.Is(err, ErrKeyingMaterialUnavailable) {
+		t.Errorf("ExportKeyingMaterial with renegotiation = %v, want ErrKeyingMaterialUnavailable", err)
+	}
+}
+
+// gatedConn passes its first n writes through and holds back later ones
+// until open is closed.
+type gatedConn struct {
+	net.Conn
+	n    int
+	open chan struct{}
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	if c.n > 0 {
+		c.n--
+	} else {
+		<-c.open
+	}
+	return c.Conn.Write(b)
+}
+
+func TestFalseStart(t *testing.T) {
+	serverConfig := &Config{
+		Certificates: []Certificate{testCertificate(t, "example.test")},
+		MaxVersion:   VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}
+	for _, tt := range []struct {
+		name   string
+		enable bool
+		protos []string
+		want   bool
+	}{
+		{"enabled", true, []string{"h2"}, true},
+		{"disabled", false, []string{"h2"}, false},
+		{"no ALPN", true, nil, false},
+	} {
+		c1, c2 := xtlstest.Pipe()
+		// The server's first flight goes out; the one with its Finished
+		// waits for open.
+		open := make(chan struct{})
+		server := Server(&gatedConn{Conn: c1, n: 1, open: open}, serverConfig)
+		cache := NewLRUClientSessionCache(1)
+		client := Client(c2, &Config{
+			ServerName:         "example.test",
+			InsecureSkipVerify: true,
+			EnableFalseStart:   tt.enable,
+			NextProtos:         tt.protos,
+			ClientSessionCache: cache,
+		})
+
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- server.Handshake() }()
+		clientErr := make(chan error, 1)
+		go func() {
+			err := client.Handshake()
+			if err == nil {
+				_, err = client.Write([]byte("early"))
+			}
+			clientErr <- err
+		}()
+
+		// With False Start the handshake and the first Write complete a
+		// round trip early, while the server's Finished is held back.
+		select {
+		case err := <-clientErr:
+			if err != nil {
+				t.Fatalf("%s: client: %v", tt.name, err)
+			}
+			if !tt.want {
+				t.Errorf("%s: client wrote before the server's Finished", tt.name)
+			}
+			close(open)
+		case <-time.After(100 * time.Millisecond):
+			if tt.want {
+				t.Errorf("%s: client waited for the server's Finished", tt.name)
+			}
+			close(open)
+			if err := <-clientErr; err != nil {
+				t.Fatalf("%s: client: %v", tt.name, err)
+			}
+		}
+		if err := <-serverErr; err != nil {
+			t.Fatalf("%s: server: %v", tt.name, err)
+		}
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "early" {
+			t.Fatalf("%s: server read %q, %v", tt.name, buf, err)
+		}
+		go server.Write([]byte("reply"))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+			t.Fatalf("%s: client read %q, %v", tt.name, buf, err)
+		}
+		if got := client.ConnectionState().FalseStart; got != tt.want {
+			t.Errorf("%s: FalseStart = %v, want %v", tt.name, got, tt.want)
+		}
+		// The session ticket read along with the server's Finished is cached.
+		if _, ok := cache.Get("example.test"); !ok {
+			t.Errorf("%s: session was not cached", tt.name)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestMaxHandshakeSize(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+
+	// A ClientHello within the limit goes through.
+	c1, c2 := xtlstest.Pipe()
+	server := Server(c1, &Config{Certificates: []Certificate{cert}})
+	server.SetMaxHandshakeSize(1024)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := Client(c2, &Config{InsecureSkipVerify: true}).Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake under the limit: %v", err)
+	}
+	c1.Close()
+	c2.Close()
+
+	// oversized announces a ClientHello of size bytes without sending its
+	// body, so the server must reject it from the header alone.
+	oversized := func(limit, size int) error {
+		c1, c2 := xtlstest.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		hdr := []byte{typeClientHello, byte(size >> 16), byte(size >> 8), byte(size)}
+		c2.Write(xtlstest.Record(xtlstest.RecordTypeHandshake, hdr))
+		server := Server(c1, &Config{Certificates: []Certificate{cert}})
+		server.SetMaxHandshakeSize(limit)
+		return server.Handshake()
+	}
+	var sizeErr *HandshakeSizeError
+	if err := oversized(1024, 1025); !errors.As(err, &sizeErr) || sizeErr.Size != 1025 || sizeErr.Max != 1024 {
+		t.Errorf("oversized ClientHello = %v, want a HandshakeSizeError for 1025 > 1024 bytes", err)
+	}
+	if err := oversized(0, 1<<20); !errors.As(err, &sizeErr) || sizeErr.Max != 65536 {
+		t.Errorf("oversized ClientHello with the default limit = %v, want a HandshakeSizeError with Max 65536", err)
+	}
+}
+
+func TestConnectionStateDuringHandshake(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client := Client(c1, &Config{InsecureSkipVerify: true})
+	server := Server(c2, &Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+	if state := client.ConnectionState(); state.HandshakeComplete || state.Version != 0 {
+		t.Errorf("state before the handshake = %+v, want the zero state", state)
+	}
+
+	go func() {
+		server.Handshake()
+		server.Write([]byte("x"))
+	}()
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			state := client.ConnectionState()
+			switch {
+			case !state.HandshakeComplete && (state.Version != 0 || state.CipherSuite != 0 || state.PeerCertificates != nil):
+				errc <- fmt.Errorf("incomplete state has fields set: %+v", state)
+				return
+			case state.HandshakeComplete && (state.Version == 0 || state.CipherSuite == 0 || len(state.PeerCertificates) == 0):
+				errc <- fmt.Errorf("complete state is missing fields: %+v", state)
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	if state := client.ConnectionState(); !state.HandshakeComplete || state.Version == 0 {
+		t.Errorf("state after the first Read = %+v, want a complete one", state)
+	}
+}
+
+func TestHandshakeProgress(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		c1, c2 := xtlstest.Pipe()
+		server := Server(c1, serverConfig)
+		client := Client(c2, &Config{InsecureSkipVerify: true, MaxVersion: version})
+		var clientStages, serverStages []string
+		client.SetHandshakeProgress(func(stage string) { clientStages = append(clientStages, stage) })
+		server.SetHandshakeProgress(func(stage string) { serverStages = append(serverStages, stage) })
+
+		errc := make(chan error, 1)
+		go func() { errc <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("TLS %x: client handshake: %v", version, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("TLS %x: server handshake: %v", version, err)
+		}
+		c1.Close()
+		c2.Close()
+
+		wantClient := []string{"ClientHelloSent", "ServerHelloReceived", "CertificateReceived", "Finished"}
+		if !reflect.DeepEqual(clientStages, wantClient) {
+			t.Errorf("TLS %x: client stages %q, want %q", version, clientStages, wantClient)
+		}
+		wantServer := []string{"ClientHelloReceived", "Finished"}
+		if !reflect.DeepEqual(serverStages, wantServer) {
+			t.Errorf("TLS %x: server stages %q, want %q", version, serverStages, wantServer)
+		}
+	}
+}
+
+func TestPeerCertificatesPEM(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	client, server, clientErr, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true},
+		&Config{Certificates: []Certificate{cert}})
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+
+	var got [][]byte
+	rest := client.PeerCertificatesPEM()
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			t.Errorf("block type %q", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			t.Errorf("parsing decoded certificate: %v", err)
+		}
+		got = append(got, block.Bytes)
+	}
+	if len(rest) != 0 || len(got) != 1 || !bytes.Equal(got[0], cert.Certificate[0]) {
+		t.Errorf("decoded %d certificates with %d bytes left, want the server's one", len(got), len(rest))
+	}
+
+	if b := server.PeerCertificatesPEM(); len(b) != 0 {
+		t.Errorf("server PeerCertificatesPEM() = %q without a client certificate, want empty", b)
+	}
+}
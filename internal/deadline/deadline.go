@@ -0,0 +1,76 @@
+// Package deadline implements resettable read and write deadlines kept in
+// memory, for connections that cannot push them down to a carrier: the
+// streams of a multiplexed connection and in-memory test transports.
+// Blocking operations select on Wait and return os.ErrDeadlineExceeded
+// once its channel is closed.
+package deadline
+
+import (
+	"sync"
+	"time"
+)
+
+// A Deadline closes a channel when it passes. Use Make to create one.
+type Deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+// Make returns a Deadline that is not set.
+func Make() Deadline {
+	return Deadline{cancel: make(chan struct{})}
+}
+
+// Set arms the deadline for t. A zero t clears it; a t in the past expires
+// it immediately.
+func (d *Deadline) Set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel.
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// Wait returns a channel that is closed when the deadline passes.
+func (d *Deadline) Wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// Expired reports whether the deadline has passed.
+func (d *Deadline) Expired() bool {
+	return isClosed(d.Wait())
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,31 @@
+package deadline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndependent(t *testing.T) {
+	short, long := Make(), Make()
+	short.Set(time.Now().Add(10 * time.Millisecond))
+	long.Set(time.Now().Add(time.Hour))
+
+	select {
+	case <-short.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("short deadline never expired")
+	}
+	if long.Expired() {
+		t.Error("long deadline expired together with the short one")
+	}
+
+	// Clearing an expired deadline re-arms it.
+	short.Set(time.Time{})
+	if short.Expired() {
+		t.Error("cleared deadline still reports expired")
+	}
+	long.Set(time.Now().Add(-time.Second))
+	if !long.Expired() {
+		t.Error("deadline in the past did not expire immediately")
+	}
+}
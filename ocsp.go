@@ -0,0 +1,214 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+// OCSP staple validation, the must-staple policy of Config.RequireStapledOCSP
+// and the revocation checks of Conn.VerifyHostnameWithRevocation.
+
+package tls
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPStapleError is returned when a server's stapled OCSP response is
+// missing or does not show its certificate as good.
+type OCSPStapleError struct {
+	// Reason describes what was wrong with the staple.
+	Reason string
+	// Err is the underlying parse or verification error, if any.
+	Err error
+}
+
+func (e *OCSPStapleError) Error() string {
+	if e.Err != nil {
+		return "tls: OCSP staple rejected: " + e.Reason + ": " + e.Err.Error()
+	}
+	return "tls: OCSP staple rejected: " + e.Reason
+}
+
+func (e *OCSPStapleError) Unwrap() error { return e.Err }
+
+// VerifyOCSPResponse checks that staple is an OCSP response for leaf, signed
+// by issuer or a responder it delegated to, that is currently valid and
+// reports the certificate as good. Failures are *OCSPStapleError values.
+func VerifyOCSPResponse(staple []byte, leaf, issuer *x509.Certificate) error {
+	return verifyOCSPResponse(staple, leaf, issuer, time.Now())
+}
+
+func verifyOCSPResponse(staple []byte, leaf, issuer *x509.Certificate, now time.Time) error {
+	if len(staple) == 0 {
+		return &OCSPStapleError{Reason: "no OCSP response stapled"}
+	}
+	if issuer == nil {
+		return &OCSPStapleError{Reason: "issuer certificate unknown, cannot check the response signature"}
+	}
+	resp, err := currentOCSPResponse(staple, leaf, issuer, now)
+	if err != nil {
+		return &OCSPStapleError{Reason: "invalid OCSP response", Err: err}
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return &OCSPStapleError{Reason: "certificate revoked at " + resp.RevokedAt.Format(time.RFC3339)}
+	default:
+		return &OCSPStapleError{Reason: "certificate status unknown"}
+	}
+}
+
+// checkStapledOCSP enforces Config.RequireStapledOCSP on a client once the
+// server certificates and any staple are known.
+func (c *Conn) checkStapledOCSP() error {
+	if !c.isClient || !c.config.RequireStapledOCSP {
+		return nil
+	}
+	if len(c.peerCertificates) == 0 {
+		return &OCSPStapleError{Reason: "no server certificate"}
+	}
+	leaf := c.peerCertificates[0]
+	var issuer *x509.Certificate
+	if len(c.verifiedChains) > 0 && len(c.verifiedChains[0]) > 1 {
+		issuer = c.verifiedChains[0][1]
+	} else if len(c.peerCertificates) > 1 {
+		issuer = c.peerCertificates[1]
+	}
+	return verifyOCSPResponse(c.ocspResponse, leaf, issuer, c.config.time())
+}
+
+// RevocationError is returned by Conn.VerifyHostnameWithRevocation when the
+// server certificate is revoked, or when its status could not be
+// established and Config.RevocationHardFail is set.
+type RevocationError struct {
+	// Revoked is true if an OCSP response reported the certificate as
+	// revoked, and false if no usable response was found.
+	Revoked bool
+	// Err is the last failure met while looking for a response, if any.
+	Err error
+}
+
+func (e *RevocationError) Error() string {
+	msg := "tls: server certificate revocation status unknown"
+	if e.Revoked {
+		msg = "tls: server certificate is revoked"
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RevocationError) Unwrap() error { return e.Err }
+
+// VerifyHostnameWithRevocation is like VerifyHostname but also checks that
+// the server certificate has not been revoked. It uses the stapled OCSP
+// response if that is valid, and otherwise asks the OCSP responders named
+// in the certificate through Config.OCSPFetcher, giving up when ctx is
+// done. A revoked certificate is always reported as a *RevocationError. If
+// no response settles the status, the error is a *RevocationError when
+// Config.RevocationHardFail is set and nil otherwise.
+func (c *Conn) VerifyHostnameWithRevocation(ctx context.Context, host string) error {
+	if err := c.VerifyHostname(host); err != nil {
+		return err
+	}
+
+	c.handshakeMutex.Lock()
+	leaf := c.peerCertificates[0]
+	var issuer *x509.Certificate
+	if len(c.verifiedChains[0]) > 1 {
+		issuer = c.verifiedChains[0][1]
+	}
+	staple := c.ocspResponse
+	hardFail := c.config.RevocationHardFail
+	fetch := c.config.OCSPFetcher
+	now := c.config.time()
+	c.handshakeMutex.Unlock()
+
+	if issuer == nil {
+		// A directly trusted certificate has no issuer to vouch for it.
+		if hardFail {
+			return &RevocationError{Err: errors.New("no issuer certificate to check the status against")}
+		}
+		return nil
+	}
+
+	var lastErr error
+	if len(staple) > 0 {
+		resp, err := currentOCSPResponse(staple, leaf, issuer, now)
+		if err == nil {
+			return revocationResult(resp.Status)
+		}
+		lastErr = fmt.Errorf("stapled response: %w", err)
+	}
+	servers := leaf.OCSPServer
+	if fetch == nil {
+		servers = nil
+		if lastErr == nil {
+			lastErr = errors.New("no stapled response and no OCSPFetcher to ask a responder")
+		}
+	}
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+		raw, err := fetchOCSPResponse(ctx, fetch, server, leaf, issuer)
+		if err == nil {
+			var resp *ocsp.Response
+			if resp, err = currentOCSPResponse(raw, leaf, issuer, now); err == nil {
+				return revocationResult(resp.Status)
+			}
+		}
+		lastErr = fmt.Errorf("responder %s: %w", server, err)
+	}
+
+	if hardFail {
+		return &RevocationError{Err: lastErr}
+	}
+	return nil
+}
+
+// revocationResult turns the status of a usable OCSP response into the
+// result of VerifyHostnameWithRevocation. An unknown status does not settle
+// anything, but it does come from the issuer, so it is reported rather than
+// retried elsewhere.
+func revocationResult(status int) error {
+	switch status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return &RevocationError{Revoked: true}
+	default:
+		return &RevocationError{Err: errors.New("OCSP response reports the status as unknown")}
+	}
+}
+
+// currentOCSPResponse parses raw as an OCSP response for leaf, signed by
+// issuer or a responder it delegated to, and returns it if it is current
+// at now.
+func currentOCSPResponse(raw []byte, leaf, issuer *x509.Certificate, now time.Time) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(resp.ThisUpdate) {
+		return nil, errors.New("OCSP response is not yet valid")
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return nil, errors.New("OCSP response has expired")
+	}
+	return resp, nil
+}
+
+// fetchOCSPResponse asks the OCSP responder at server for the status of
+// leaf.
+func fetchOCSPResponse(ctx context.Context, fetch func(context.Context, string, []byte) ([]byte, error), server string, leaf, issuer *x509.Certificate) ([]byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetch(ctx, server, req)
+}
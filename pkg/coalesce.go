@@ -0,0 +1,137 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Coalescing of small writes into fewer, larger records.
+
+package xtls
+
+import (
+	"fmt"
+	"time"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// SetWriteCoalescing makes Write hold small writes in memory and send them
+// together, so that a chatty inner protocol produces fewer and more uniform
+// records, like Nagle's algorithm one layer up. Held bytes are sent as a
+// single Write of the underlying connection, and thus one record unless
+// SetMaxRecordSize cuts it, when the first of them has waited maxDelay,
+// when maxBytes are held, or on Flush or Close. A write that does not fit
+// sends the held bytes first, and one of maxBytes or more then goes out on
+// its own. Write reports held bytes as written; an error sending them is
+// returned by the next Write, Flush or Close.
+//
+// Only Origin flow is coalesced. Direct mode writes bypass it, so that the
+// trailing alert stripped from each write stays at its end, and Upgrade,
+// SpliceFrom and SetFlow send held bytes before switching.
+//
+// maxBytes must be within (0, 16384]. A zero maxDelay turns coalescing off,
+// sending anything held.
+func (c *Conn) SetWriteCoalescing(maxDelay time.Duration, maxBytes int) error {
+	if maxDelay > 0 && (maxBytes <= 0 || maxBytes > maxRecordSize) {
+		return fmt.Errorf("xtls: coalescing size %d out of range (0, %d]", maxBytes, maxRecordSize)
+	}
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	if maxDelay <= 0 {
+		c.coalesceDelay, c.coalesceMax = 0, 0
+		return c.flushCoalescedLocked()
+	}
+	c.coalesceDelay, c.coalesceMax = maxDelay, maxBytes
+	if len(c.coalesceBuf) >= maxBytes {
+		return c.flushCoalescedLocked()
+	}
+	return nil
+}
+
+// Flush sends any bytes held by write coalescing, then any records held by
+// the nXTLS connection's write buffering (see nxtls.Conn.Flush), and
+// returns the first write error. A request/response protocol that enables
+// either must Flush after a request before waiting for the response, or
+// both peers may wait forever. It is a no-op when nothing is held.
+func (c *Conn) Flush() error {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flushCoalesced(); err != nil {
+		return err
+	}
+	return c.Conn.Flush()
+}
+
+// coalesceWrite writes b through the coalescing buffer if coalescing is on
+// and the connection is in Origin flow. ok is false if b must be written
+// directly instead.
+func (c *Conn) coalesceWrite(b []byte) (n int, ok bool, err error) {
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	if c.coalesceDelay == 0 || c.Conn.GetXTLSMode() != nxtls.XTLSModeOrigin {
+		// Anything still held was written in Origin flow and goes first.
+		if err := c.flushCoalescedLocked(); err != nil {
+			return 0, true, err
+		}
+		return 0, false, nil
+	}
+	if err := c.coalesceErr; err != nil {
+		c.coalesceErr = nil
+		return 0, true, err
+	}
+	if len(c.coalesceBuf)+len(b) > c.coalesceMax {
+		if err := c.flushCoalescedLocked(); err != nil {
+			return 0, true, err
+		}
+		if len(b) >= c.coalesceMax {
+			n, err := c.write(b)
+			return n, true, err
+		}
+	}
+	c.coalesceBuf = append(c.coalesceBuf, b...)
+	if len(c.coalesceBuf) == c.coalesceMax {
+		return len(b), true, c.flushCoalescedLocked()
+	}
+	if c.coalesceTimer == nil {
+		c.coalesceTimers.Add(1)
+		c.coalesceTimer = time.AfterFunc(c.coalesceDelay, c.flushCoalescedTimer)
+	}
+	return len(b), true, nil
+}
+
+// flushCoalesced sends the bytes held by write coalescing.
+func (c *Conn) flushCoalesced() error {
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	return c.flushCoalescedLocked()
+}
+
+// flushCoalescedTimer sends held bytes once maxDelay has passed, keeping a
+// failure for the next call.
+func (c *Conn) flushCoalescedTimer() {
+	defer c.coalesceTimers.Done()
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	c.coalesceTimer = nil
+	if err := c.flushCoalescedLocked(); err != nil {
+		c.coalesceErr = err
+	}
+}
+
+// flushCoalescedLocked sends held bytes and returns any error kept from a
+// timer flush. The caller holds c.coalesceMu.
+func (c *Conn) flushCoalescedLocked() error {
+	if c.coalesceTimer != nil {
+		if c.coalesceTimer.Stop() {
+			c.coalesceTimers.Done()
+		}
+		c.coalesceTimer = nil
+	}
+	if err := c.coalesceErr; err != nil {
+		c.coalesceErr = nil
+		return err
+	}
+	if len(c.coalesceBuf) == 0 {
+		return nil
+	}
+	_, err := c.write(c.coalesceBuf)
+	c.coalesceBuf = c.coalesceBuf[:0]
+	return err
+}
@@ -0,0 +1,128 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Tracking of live accepted connections to cap their number per Listener.
+
+package xtls
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type tooManyConnsError struct{}
+
+func (tooManyConnsError) Error() string   { return "xtls: too many connections" }
+func (tooManyConnsError) Timeout() bool   { return false }
+func (tooManyConnsError) Temporary() bool { return true }
+
+// ErrTooManyConns is returned by Accept when the SetMaxConns limit is
+// reached under SetFailWhenFull. It is a temporary net.Error, so servers
+// such as net/http back off and retry.
+var ErrTooManyConns error = tooManyConnsError{}
+
+// connLimiter counts the live connections of a Listener against a maximum.
+// A slot taken by AcceptRaw belongs to the raw conn until WrapConn hands it
+// to the *Conn, whose Close frees it, or Reject frees it. The zero value
+// has no limit.
+type connLimiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when a slot frees up or the limit changes
+	max     int
+	fail    bool                  // set by SetFailWhenFull
+	live    int                   // slots held by accepted conns
+	raw     map[net.Conn]struct{} // conns from AcceptRaw holding a slot, not yet wrapped
+	pending int                   // slots acquired for connections being accepted
+	closed  bool
+}
+
+func (l *connLimiter) initLocked() {
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+		l.raw = make(map[net.Conn]struct{})
+	}
+}
+
+func (l *connLimiter) setMax(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.initLocked()
+	l.max = n
+	l.cond.Broadcast()
+}
+
+func (l *connLimiter) setFail(fail bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail = fail
+}
+
+// acquire reserves a slot for a connection about to be accepted. When the
+// limit is reached it waits for a free slot, or returns ErrTooManyConns
+// under SetFailWhenFull. It returns false, with no error, when no limit is
+// set and nothing needs to be tracked.
+func (l *connLimiter) acquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.initLocked()
+	for l.max > 0 && l.live+l.pending >= l.max && !l.closed {
+		if l.fail {
+			return false, ErrTooManyConns
+		}
+		l.cond.Wait()
+	}
+	if l.max <= 0 || l.closed {
+		return false, nil
+	}
+	l.pending++
+	return true, nil
+}
+
+// track moves the slot taken by acquire to the accepted conn c, or frees
+// it if accepting failed and c is nil.
+func (l *connLimiter) track(c net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+	if c == nil {
+		l.cond.Broadcast()
+		return
+	}
+	l.live++
+	l.raw[c] = struct{}{}
+}
+
+// claim reports whether raw holds a slot, which then passes to the caller
+// to release.
+func (l *connLimiter) claim(raw net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.raw[raw]; !ok {
+		return false
+	}
+	delete(l.raw, raw)
+	return true
+}
+
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.live--
+	l.cond.Broadcast()
+}
+
+// close wakes every Accept waiting for a slot, so that it can observe that
+// the listener was closed.
+func (l *connLimiter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.initLocked()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// releaseSlot frees the Listener slot held by c, once.
+func (c *Conn) releaseSlot() {
+	if c.slot != nil && atomic.CompareAndSwapUint32(&c.slotFreed, 0, 1) {
+		c.slot.release()
+	}
+}
@@ -0,0 +1,36 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Placeholder for XTLS over DTLS, which the nXTLS stack does not provide.
+
+package xtls
+
+import "fmt"
+
+// errDTLSUnsupported is returned by DialDTLS while the nXTLS stack has no
+// DTLS record layer.
+var errDTLSUnsupported = fmt.Errorf("%w: DTLS is not supported by the nXTLS stack", ErrUnsupportedNetwork)
+
+// DialDTLS is meant to be like Dial over UDP with DTLS, for tunneling
+// datagram protocols. network must be "udp", "udp4" or "udp6".
+//
+// With DTLS, each Write would be sent as one datagram no larger than the
+// path MTU allows, and each Read would return one whole datagram, so
+// datagram boundaries survive the tunnel and lost datagrams stay lost.
+// Direct mode would not apply, since every datagram needs its own record
+// protection.
+//
+// The nXTLS stack implements TLS only, which needs a reliable, ordered
+// stream, so DialDTLS currently fails with an error that matches
+// ErrUnsupportedNetwork after checking its arguments. To carry datagrams
+// today, frame them over a stream connection, for example one Stream of
+// a Mux per flow.
+func DialDTLS(network, addr string, config *Config) (*Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedNetwork, network)
+	}
+	if err := checkDialAddr(network, addr); err != nil {
+		return nil, err
+	}
+	return nil, errDTLSUnsupported
+}
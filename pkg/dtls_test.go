@@ -0,0 +1,29 @@
+package xtls
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDTLS(t *testing.T) {
+	if _, err := DialDTLS("tcp", "127.0.0.1:443", nil); !errors.Is(err, ErrUnsupportedNetwork) || errors.Is(err, errDTLSUnsupported) {
+		t.Errorf("DialDTLS over tcp = %v, want an unsupported network error", err)
+	}
+	var addrErr *net.AddrError
+	if _, err := DialDTLS("udp", "[fe80::zz]:443", nil); !errors.As(err, &addrErr) {
+		t.Errorf("DialDTLS to a malformed address = %v, want an address error", err)
+	}
+
+	conn, err := DialDTLS("udp", "127.0.0.1:443", &Config{InsecureSkipVerify: true})
+	if errors.Is(err, errDTLSUnsupported) {
+		if !errors.Is(err, ErrUnsupportedNetwork) {
+			t.Errorf("DialDTLS error %v does not match ErrUnsupportedNetwork", err)
+		}
+		t.Skipf("DTLS is not available: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
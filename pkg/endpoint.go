@@ -0,0 +1,113 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Parsing of URL-style endpoint specs from configuration files.
+
+package xtls
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseEndpoint parses an endpoint spec such as
+//
+//	xtls://example.com:443?flow=xtls-rprx-direct&sni=example.com&alpn=h2,http/1.1
+//
+// into the arguments for Dial and the flow to pass to SetFlow. The host may
+// be a name or an IP literal, with IPv6 addresses in brackets and zones
+// escaped as %25; the port is required. The query parameters are:
+//
+//   - flow: RPRXOrigin (the default) or RPRXDirect
+//   - sni: the server name to send and verify, which defaults to the host
+//     unless it is an IP address
+//   - alpn: a comma-separated list of ALPN protocols
+//   - insecure: a boolean that sets InsecureSkipVerify
+//   - network: "tcp" (the default), "tcp4" or "tcp6"
+//
+// Each parameter may appear once. Unknown schemes, parameters and flows are
+// rejected rather than ignored, so that typos in configuration files
+// surface as errors.
+func ParseEndpoint(spec string) (network, addr string, config *Config, flow string, err error) {
+	fail := func(format string, args ...interface{}) (string, string, *Config, string, error) {
+		return "", "", nil, "", fmt.Errorf("xtls: endpoint %q: %s", spec, fmt.Sprintf(format, args...))
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fail("%v", err)
+	}
+	if u.Scheme != "xtls" {
+		return fail("scheme %q is not xtls", u.Scheme)
+	}
+	if u.Opaque != "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.Fragment != "" {
+		return fail("only a host, port and query are allowed")
+	}
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return fail("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fail("invalid or missing port %q", port)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return fail("%v", err)
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	network, config, flow = "tcp", &Config{}, RPRXOrigin
+	for _, key := range keys {
+		if len(query[key]) != 1 {
+			return fail("parameter %q given %d times", key, len(query[key]))
+		}
+		v := query[key][0]
+		switch key {
+		case "flow":
+			if v != RPRXOrigin && v != RPRXDirect {
+				return fail("unknown flow %q, want %s or %s", v, RPRXOrigin, RPRXDirect)
+			}
+			flow = v
+		case "sni":
+			config.ServerName = v
+		case "alpn":
+			for _, proto := range strings.Split(v, ",") {
+				if proto == "" {
+					return fail("empty protocol in alpn %q", v)
+				}
+				config.NextProtos = append(config.NextProtos, proto)
+			}
+		case "insecure":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fail("insecure %q is not a boolean", v)
+			}
+			config.InsecureSkipVerify = b
+		case "network":
+			if v != "tcp" && v != "tcp4" && v != "tcp6" {
+				return fail("unsupported network %q, want tcp, tcp4 or tcp6", v)
+			}
+			network = v
+		default:
+			return fail("unknown parameter %q", key)
+		}
+	}
+	if config.ServerName == "" && net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		config.ServerName = host
+	}
+
+	addr = net.JoinHostPort(host, port)
+	if err := checkDialAddr(network, addr); err != nil {
+		return fail("%v", err)
+	}
+	return network, addr, config, flow, nil
+}
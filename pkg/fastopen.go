@@ -0,0 +1,100 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Dialing and listening with TCP Fast Open.
+
+package xtls
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// A Dialer dials XTLS connections with options that Dial lacks.
+type Dialer struct {
+	// NetDialer is used for the underlying connection; nil means a zero
+	// net.Dialer. It is not modified.
+	NetDialer *net.Dialer
+
+	// Config is the configuration for the returned connections, as for
+	// NewConn.
+	Config *Config
+
+	// FastOpen enables TCP Fast Open on "tcp" networks where the platform
+	// supports it (Linux TCP_FASTOPEN_CONNECT). The connect then completes
+	// without waiting for the SYN-ACK, and the first write, the ClientHello,
+	// is carried in the SYN once the kernel holds a Fast Open cookie for
+	// the server; the first connection to a server only fetches the cookie.
+	// Where Fast Open is unsupported or disabled it is silently skipped and
+	// the connection proceeds as usual.
+	FastOpen bool
+}
+
+// Dial is like DialContext with a background context.
+func (d *Dialer) Dial(network, addr string) (*Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr and returns a client connection for
+// d.Config. Like Dial, it does not perform the handshake; ctx only bounds
+// the connection phase.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (*Conn, error) {
+	if err := checkDialAddr(network, addr); err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	if d.NetDialer != nil {
+		nd = *d.NetDialer
+	}
+	if d.FastOpen {
+		nd.Control = chainControl(nd.Control, setFastOpenConnect)
+	}
+	conn, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, d.Config), nil
+}
+
+// ListenConfig holds options for listening for XTLS connections.
+type ListenConfig struct {
+	// FastOpen enables TCP Fast Open on "tcp" networks where the platform
+	// supports it (Linux TCP_FASTOPEN), so clients holding a cookie can
+	// send their ClientHello in the SYN. Where Fast Open is unsupported
+	// or disabled it is silently skipped.
+	FastOpen bool
+}
+
+// Listen is like ListenXTLS with the options in lc. ctx only bounds the
+// setup of the listener.
+func (lc *ListenConfig) Listen(ctx context.Context, network, addr string, config *Config) (*Listener, error) {
+	var nlc net.ListenConfig
+	if lc.FastOpen {
+		nlc.Control = setFastOpenListen
+	}
+	ln, err := nlc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, config), nil
+}
+
+// chainControl returns a net.Dialer Control function that runs first, if
+// not nil, and then next.
+func chainControl(first, next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if first == nil {
+		return next
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return next(network, address, c)
+	}
+}
+
+// isTCPNetwork reports whether network, as passed to a Control function,
+// is a TCP one.
+func isTCPNetwork(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
@@ -0,0 +1,38 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// TCP Fast Open socket options on Linux.
+
+//go:build linux
+
+package xtls
+
+import "syscall"
+
+const (
+	tcpFastOpen        = 0x17 // TCP_FASTOPEN
+	tcpFastOpenConnect = 0x1e // TCP_FASTOPEN_CONNECT, Linux 4.11 and later
+
+	// fastOpenQueueLen bounds the pending Fast Open requests of a listener.
+	fastOpenQueueLen = 256
+)
+
+// setFastOpenConnect enables Fast Open on a socket about to connect.
+// Errors, such as from kernels without TCP_FASTOPEN_CONNECT, are ignored.
+func setFastOpenConnect(network, address string, c syscall.RawConn) error {
+	if !isTCPNetwork(network) {
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
+
+// setFastOpenListen enables Fast Open on a socket about to listen. Errors
+// are ignored.
+func setFastOpenListen(network, address string, c syscall.RawConn) error {
+	if !isTCPNetwork(network) {
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueueLen)
+	})
+}
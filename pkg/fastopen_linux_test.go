@@ -0,0 +1,127 @@
+//go:build linux
+
+package xtls
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// tcpOption reads an IPPROTO_TCP socket option of conn.
+func tcpOption(t *testing.T, conn syscall.Conn, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Skipf("TCP Fast Open is not available: %v", serr)
+	}
+	return v
+}
+
+func TestFastOpen(t *testing.T) {
+	lc := &ListenConfig{FastOpen: true}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if got := tcpOption(t, ln.Listener.(*net.TCPListener), tcpFastOpen); got != fastOpenQueueLen {
+		t.Errorf("listener TCP_FASTOPEN = %d, want %d", got, fastOpenQueueLen)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.AcceptXTLS()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			errc <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		errc <- err
+	}()
+
+	d := &Dialer{Config: &Config{InsecureSkipVerify: true}, FastOpen: true}
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := tcpOption(t, conn.NetConn().(*net.TCPConn), tcpFastOpenConnect); got != 1 {
+		t.Errorf("client TCP_FASTOPEN_CONNECT = %d, want 1", got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v, want %q", buf, err, "ping")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := (&Dialer{}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if got := tcpOption(t, plain.NetConn().(*net.TCPConn), tcpFastOpenConnect); got != 0 {
+		t.Errorf("TCP_FASTOPEN_CONNECT without FastOpen = %d, want 0", got)
+	}
+}
+
+func TestFastOpenFallback(t *testing.T) {
+	// Networks without Fast Open, such as Unix sockets, connect as usual.
+	addr := t.TempDir() + "/xtls.sock"
+	ln, err := (&ListenConfig{FastOpen: true}).Listen(context.Background(), "unix", addr, &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.AcceptXTLS()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	d := &Dialer{Config: &Config{InsecureSkipVerify: true}, FastOpen: true}
+	conn, err := d.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v, want %q", buf, err, "ping")
+	}
+}
@@ -0,0 +1,16 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// TCP Fast Open stubs for platforms other than Linux.
+
+//go:build !linux
+
+package xtls
+
+import "syscall"
+
+func setFastOpenConnect(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setFastOpenListen(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Helpers for running net/http over XTLS.
+
+package xtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// HTTPDialTLSContext returns a function for http.Transport.DialTLSContext
+// that dials addr, runs the XTLS handshake under ctx and returns the
+// resulting *Conn:
+//
+//	tr := &http.Transport{DialTLSContext: xtls.HTTPDialTLSContext(config)}
+//
+// config is copied. If its ServerName is empty, the host part of addr is
+// used, and if its NextProtos is empty, "http/1.1" is offered via ALPN.
+// net/http's Transport only switches to HTTP/2 on a *crypto/tls.Conn, so
+// list "h2" in NextProtos only when the returned conns are used by an
+// HTTP/2 client, such as golang.org/x/net/http2.Transport, that checks
+// ConnectionState().NegotiatedProtocol itself.
+func HTTPDialTLSContext(config *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	base := nxtls.CloneConfig(config)
+	if len(base.NextProtos) == 0 {
+		base.NextProtos = []string{"http/1.1"}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := base
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			config = base.Clone()
+			config.ServerName = host
+		}
+		if err := checkDialAddr(network, addr); err != nil {
+			return nil, err
+		}
+		raw, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := NewConn(raw, config)
+		// Handshake under ctx without tying the conn's lifetime to it, as
+		// WithContext would; Handshake then only does the bookkeeping.
+		err = conn.Conn.HandshakeContext(ctx)
+		if err == nil {
+			err = conn.Handshake()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// connContextKey is the context key under which ServeHTTP stores the *Conn
+// a request arrived on.
+type connContextKey struct{}
+
+// ServeHTTP listens on the TCP address addr and serves HTTP with handler
+// over XTLS connections, like http.ListenAndServeTLS with XTLS as the TLS
+// layer. net/http sees the connections as plain ones, so ServeHTTP fills
+// in Request.TLS itself; handlers can also reach the connection through
+// ConnFromContext. It always returns a non-nil error.
+func ServeHTTP(addr string, config *Config, handler http.Handler) error {
+	ln, err := ListenXTLS("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	return newHTTPServer(handler).Serve(ln)
+}
+
+// newHTTPServer returns an http.Server that records the *Conn of each
+// request in its context and sets Request.TLS from it.
+func newHTTPServer(handler http.Handler) *http.Server {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if conn, ok := ConnFromContext(r.Context()); ok && r.TLS == nil {
+				state := conn.ConnectionState()
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.TLS = &state
+				r = r2
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if conn, ok := c.(*Conn); ok {
+				return context.WithValue(ctx, connContextKey{}, conn)
+			}
+			return ctx
+		},
+	}
+}
+
+// ConnFromContext returns the connection an HTTP request served by
+// ServeHTTP arrived on, for access to ConnectionState and the other
+// XTLS-specific methods.
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	conn, ok := ctx.Value(connContextKey{}).(*Conn)
+	return conn, ok
+}
+
+// ConnectionStateFromContext returns the TLS state of the connection an
+// HTTP request served by ServeHTTP arrived on.
+func ConnectionStateFromContext(ctx context.Context) (tls.ConnectionState, bool) {
+	conn, ok := ConnFromContext(ctx)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return conn.ConnectionState(), true
+}
+
+// SetConnState registers fn to be told about the connection's state the
+// way http.Server.ConnState is, so that existing HTTP connection
+// dashboards can follow XTLS connections too. fn is called at once with
+// the current state, then on every change: a connection is
+// http.StateNew until its handshake completes, http.StateActive after
+// that, and http.StateClosed once Close is called. http.StateIdle is not
+// reported, as XTLS has no request boundaries to tell an idle connection
+// from one waiting for data. fn must not block.
+func (c *Conn) SetConnState(fn func(net.Conn, http.ConnState)) {
+	c.stateMu.Lock()
+	c.connState = fn
+	state := c.state
+	c.stateMu.Unlock()
+	if fn != nil {
+		fn(c, state)
+	}
+}
+
+// setState moves the connection to state, unless it is already closed,
+// and reports the change to the SetConnState callback.
+func (c *Conn) setState(state http.ConnState) {
+	c.stateMu.Lock()
+	if c.state == state || c.state == http.StateClosed {
+		c.stateMu.Unlock()
+		return
+	}
+	c.state = state
+	fn := c.connState
+	c.stateMu.Unlock()
+	if fn != nil {
+		fn(c, state)
+	}
+}
+
+// maxOCSPResponseSize bounds the OCSP responses read from responders.
+const maxOCSPResponseSize = 1 << 20
+
+// HTTPOCSPFetcher returns a function for Config.OCSPFetcher that POSTs OCSP
+// requests to responders with client, as described in RFC 6960, Appendix
+// A.1. A nil client means http.DefaultClient.
+func HTTPOCSPFetcher(client *http.Client) func(ctx context.Context, server string, request []byte) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, server string, request []byte) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(request))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/ocsp-request")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("unexpected HTTP status " + resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	}
+}
@@ -0,0 +1,213 @@
+package xtls
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	nxtls "github.com/nXTLS/Go"
+	"github.com/nXTLS/Go/xtlstest"
+)
+
+type connKey struct{}
+
+func TestHTTPDialTLSContext(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn := r.Context().Value(connKey{}).(*Conn)
+			io.WriteString(w, conn.ConnectionState().NegotiatedProtocol)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tr := &http.Transport{DialTLSContext: HTTPDialTLSContext(&Config{InsecureSkipVerify: true})}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "http/1.1" {
+		t.Errorf("got %s %q, want 200 with the negotiated protocol http/1.1", resp.Status, body)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, ok := ConnectionStateFromContext(r.Context())
+		if !ok || !state.HandshakeComplete || r.TLS == nil || r.TLS.ServerName != state.ServerName {
+			http.Error(w, "no connection state", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, state.ServerName)
+	}))
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tr := &http.Transport{DialTLSContext: HTTPDialTLSContext(&Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.test",
+	})}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "example.test" {
+		t.Errorf("got %s %q, want 200 %q", resp.Status, body, "example.test")
+	}
+
+	if _, ok := ConnFromContext(context.Background()); ok {
+		t.Error("ConnFromContext found a conn in an empty context")
+	}
+}
+
+func TestSetConnState(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	client := NewConn(c2, &Config{InsecureSkipVerify: true})
+
+	var states []http.ConnState
+	client.SetConnState(func(c net.Conn, state http.ConnState) {
+		if c != client {
+			t.Errorf("callback got conn %v, want the client", c)
+		}
+		states = append(states, state)
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	client.Handshake()
+	c1.Close() // so that close_notify does not block
+	client.Close()
+	client.Close()
+
+	want := []http.ConnState{http.StateNew, http.StateActive, http.StateClosed}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestConnRegistry(t *testing.T) {
+	var registry ConnRegistry
+	direct, peer := testPair(t)
+	go io.Copy(io.Discard, peer) // lets Close send close_notify
+	direct.SetFlow(RPRXDirect)
+	direct.SetTag("direct")
+	origin, _ := testPair(t)
+	registry.Register(direct)
+	registry.Register(origin)
+	registry.Register(direct)
+
+	get := func() []ConnFullState {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		registry.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/xtls", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var states []ConnFullState
+		if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		return states
+	}
+	states := get()
+	if len(states) != 2 {
+		t.Fatalf("got %d conns, want 2", len(states))
+	}
+	if s := states[0]; s.Flow != RPRXDirect || s.Tag != "direct" || s.State != "active" ||
+		!s.HandshakeComplete || s.CipherSuite == "" {
+		t.Errorf("first conn = %+v", s)
+	}
+	if s := states[1]; s.Flow != RPRXOrigin {
+		t.Errorf("second conn flow = %q, want %q", s.Flow, RPRXOrigin)
+	}
+
+	direct.Close()
+	registry.Register(direct)
+	if states := get(); len(states) != 1 || states[0].Flow != RPRXOrigin {
+		t.Errorf("after Close: %+v, want only the origin conn", states)
+	}
+}
+
+func TestFullStateDuringHandshake(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	client := NewConn(c2, &Config{InsecureSkipVerify: true})
+	sent := make(chan struct{})
+	client.SetHandshakeProgress(func(stage string) {
+		if stage == HandshakeStageClientHelloSent {
+			close(sent)
+		}
+	})
+	done := make(chan error, 1)
+	go func() { done <- client.Handshake() }() // stalls: nobody answers
+	<-sent
+
+	if s := client.FullState(); s.HandshakeComplete || s.Version != 0 || s.State != "new" {
+		t.Errorf("FullState during handshake = %+v", s)
+	}
+	c2.Close()
+	<-done
+}
+
+func TestHTTPOCSPFetcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/ocsp-request" {
+			t.Errorf("got %s with Content-Type %q, want an OCSP POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(append([]byte("response to "), body...))
+	}))
+	defer srv.Close()
+
+	fetch := HTTPOCSPFetcher(srv.Client())
+	resp, err := fetch(context.Background(), srv.URL, []byte("request"))
+	if err != nil || string(resp) != "response to request" {
+		t.Errorf("fetch = %q, %v; want the responder's body", resp, err)
+	}
+	if _, err := fetch(context.Background(), srv.URL, []byte("fail")); err == nil {
+		t.Error("fetch accepted a 503 response")
+	}
+}
@@ -0,0 +1,119 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Prometheus text exposition of the package-wide counters.
+
+package xtls
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeBuckets are the upper bounds, in seconds, of the handshake
+// duration histogram; they match the Prometheus client defaults.
+var handshakeBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations per bucket of handshakeBuckets;
+// WriteMetrics reports the buckets cumulatively.
+type histogram struct {
+	mu     sync.Mutex
+	counts [len(handshakeBuckets)]uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// handshakeDurations records the duration of every successful handshake
+// of a Conn created by this package.
+var handshakeDurations histogram
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range handshakeBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// A Histogram is a snapshot of a latency histogram, such as the one
+// returned by Listener.Histogram.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets, in increasing order.
+	Bounds []time.Duration
+	// Counts holds the observations per bucket, not cumulative. It has one
+	// more entry than Bounds, for observations above the last bound.
+	Counts []uint64
+	// Count and Sum are the number and total of all observations.
+	Count uint64
+	Sum   time.Duration
+}
+
+// snapshot returns a copy of the current state of h.
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: make([]time.Duration, len(handshakeBuckets)),
+		Counts: make([]uint64, len(handshakeBuckets)+1),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var bucketed uint64
+	for i, le := range handshakeBuckets {
+		s.Bounds[i] = time.Duration(le * float64(time.Second))
+		s.Counts[i] = h.counts[i]
+		bucketed += h.counts[i]
+	}
+	s.Counts[len(handshakeBuckets)] = h.count - bucketed
+	s.Count = h.count
+	s.Sum = time.Duration(h.sum * float64(time.Second))
+	return s
+}
+
+// WriteMetrics writes the counters returned by Stats, and a histogram of
+// handshake durations, to w in the Prometheus text exposition format, so
+// that a /metrics handler can serve them without this package depending
+// on a Prometheus client:
+//
+//	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+//		xtls.WriteMetrics(w)
+//	})
+//
+// Only successful handshakes are counted in the histogram.
+func WriteMetrics(w io.Writer) error {
+	s := Stats()
+	var b strings.Builder
+	metric := func(name, typ, help string, v uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	metric("xtls_connections_total", "counter", "Connections created.", s.TotalConns)
+	metric("xtls_connections_active", "gauge", "Connections created but not yet closed.", s.ActiveConns)
+	metric("xtls_received_bytes_total", "counter", "Application bytes read.", s.BytesIn)
+	metric("xtls_sent_bytes_total", "counter", "Application bytes written.", s.BytesOut)
+	metric("xtls_alerts_stripped_total", "counter", "Trailing TLS alerts dropped by Direct mode writes.", s.AlertsStripped)
+	metric("xtls_origin_fallbacks_total", "counter", "Closed connections that fell back to the Origin fallback logic.", s.Fallbacks)
+
+	h := &handshakeDurations
+	h.mu.Lock()
+	const name = "xtls_handshake_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Duration of successful handshakes.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, le := range handshakeBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(&b, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(&b, "%s_count %d\n", name, h.count)
+	h.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
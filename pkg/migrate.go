@@ -0,0 +1,85 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Moving a client connection to a new transport by resuming its session.
+
+package xtls
+
+import (
+	"errors"
+	"net"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// ErrNotResumed is returned by Migrate when the server completed the
+// handshake on the new transport without resuming the session.
+var ErrNotResumed = errors.New("xtls: migration handshake did not resume the session")
+
+// ErrConnBusy is returned by Migrate when another method of the
+// connection, such as Read, Write, Peek or Close, is in progress.
+var ErrConnBusy = errors.New("xtls: connection in use")
+
+// Migrate moves the client connection c to newInner, as when a mobile
+// client roams to another network, by resuming its TLS session there
+// instead of performing a full handshake. On success c reads and writes
+// through newInner and the old transport is closed without a close_notify;
+// on failure c is left on the old transport and newInner is closed.
+//
+// TLS cannot move a live session between sockets, so the constraints are:
+//
+//   - The connection must come from NewConn with a Config that has a
+//     ClientSessionCache, and the session must have been cached under the
+//     same key, Config.ServerName or otherwise the server address. Under
+//     TLS 1.3 the server sends its ticket after the handshake, so c must
+//     have read from the old transport first.
+//   - Migrate fails with ErrNotResumed if the server does not resume.
+//   - The resumption still costs a round trip, and data in flight on the
+//     old transport is lost. The application protocol must tolerate the
+//     gap and let the server tie the new connection, which it accepts
+//     like any other, to the old one.
+//   - Only state kept by this wrapper carries over: the flow, read-ahead
+//     data, write chunking, the plaintext tap, the context and the
+//     counters, including the alerts stripped on the old transport. The
+//     new connection starts in Origin flow and the SetFlowByALPN mapping
+//     is applied again, as on the server side; settings made on the nXTLS
+//     connection, such as EnableDebug and SetRecordTracer, must be made
+//     again.
+//
+// The connection must be idle: Migrate fails with ErrConnBusy, leaving c
+// on the old transport, if another method of c, such as Read, Write, Peek
+// or Handshake, is in progress, and calls made while it switches
+// transports wait for it. Migrate must not be called concurrently with
+// itself or with methods of the nXTLS connection that c does not define
+// itself, such as those reached through Underlying.
+func (c *Conn) Migrate(newInner net.Conn) error {
+	if !c.Conn.IsClient() || c.config == nil || c.config.ClientSessionCache == nil {
+		newInner.Close()
+		return errors.New("xtls: Migrate needs a client connection with a ClientSessionCache")
+	}
+	if !c.Conn.ConnectionState().HandshakeComplete {
+		newInner.Close()
+		return ErrNotHandshaken
+	}
+	nconn := nxtls.Client(newInner, c.config)
+	if err := nconn.HandshakeContext(c.Context()); err != nil {
+		newInner.Close()
+		return c.contextErr(err)
+	}
+	if !nconn.ConnectionState().DidResume {
+		newInner.Close()
+		return ErrNotResumed
+	}
+
+	if !c.connMu.TryLock() {
+		newInner.Close()
+		return ErrConnBusy
+	}
+	old := c.Conn
+	c.migratedAlerts += old.AlertsStripped()
+	// Handshake sees nconn as a new conn, so it runs the handshake
+	// bookkeeping and SetFlowByALPN again.
+	c.Conn = nconn
+	c.setFlowName(RPRXOrigin)
+	c.connMu.Unlock()
+	old.NetConn().Close()
+	return c.Handshake()
+}
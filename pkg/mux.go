@@ -0,0 +1,551 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// A lightweight stream multiplexer over a single XTLS connection.
+
+package xtls
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nXTLS/Go/internal/deadline"
+)
+
+// Mux multiplexes independent, bidirectional streams over one XTLS
+// connection, so that many logical connections share a single handshake.
+//
+// Both ends of the connection must use a Mux. Each stream is framed on the
+// XTLS byte stream as:
+//
+//	+------+-----------+--------+---------+
+//	| type | stream ID | length | payload |
+//	|  1   |     4     |   2    | length  |
+//	+------+-----------+--------+---------+
+//
+// with integers in network byte order. The frame types are:
+//
+//	0x01 open    a new stream; no payload
+//	0x02 data    stream data; at most 16 KiB of payload
+//	0x03 close   the sender will neither read nor write the stream again
+//	0x04 window  a 4-byte increment to the sender's window for the stream
+//
+// The side that called NewConn opens streams with odd IDs and the side that
+// called NewServerConn uses even IDs, so IDs never collide. An open frame
+// with an ID of the receiver's own parity is a protocol error that fails
+// the Mux.
+//
+// At most 64 streams opened by the peer wait for AcceptStream. Further
+// opens are refused with a close frame, so the opener sees the stream
+// closed by the peer, rather than stalling the frames of every other
+// stream behind the unaccepted ones. The close frames are sent by a
+// separate goroutine, so frames keep being read while the peer is not
+// reading; a peer that opens more than 64 further streams before the
+// refusals reach it fails the Mux.
+//
+// Flow control is per stream: each side may have at most 256 KiB of
+// unread data outstanding on a stream. A receiver returns credit with a
+// window frame once the application has read half of that, and a writer
+// blocks while its window is exhausted. One slow stream therefore cannot
+// stall the others sharing the connection.
+//
+// Read and write deadlines on a stream only affect that stream; they are
+// never pushed down to the shared connection. A write deadline bounds the
+// wait for window and for the stream's turn on the connection, but not a
+// frame already being written: while the peer reads nothing, a Write that
+// has started sending a frame returns only once the connection takes it or
+// the Mux fails.
+type Mux struct {
+	conn *Conn
+
+	writeToken chan struct{} // held while a frame is written to conn
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	refused []uint32 // peer-opened streams waiting for refuseLoop to send their close frame
+	err     error    // set once the mux has failed or been closed
+
+	accept    chan *Stream
+	refuse    chan struct{} // wakes refuseLoop once refused has grown
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	frameOpen   byte = 0x01
+	frameData   byte = 0x02
+	frameClose  byte = 0x03
+	frameWindow byte = 0x04
+
+	frameHeaderLen   = 7
+	maxFramePayload  = 16 * 1024
+	streamWindowSize = 256 * 1024
+	acceptBacklog    = 64
+)
+
+// ErrMuxClosed is returned by operations on a Mux, or its streams, after the
+// Mux or its connection has been closed.
+var ErrMuxClosed = errors.New("xtls: mux closed")
+
+// NewMux starts multiplexing streams over conn. The Mux takes over reading
+// from and writing to conn; callers must not use it directly afterwards.
+func NewMux(conn *Conn) *Mux {
+	m := &Mux{
+		conn:       conn,
+		writeToken: make(chan struct{}, 1),
+		streams:    make(map[uint32]*Stream),
+		nextID:     1,
+		accept:     make(chan *Stream, acceptBacklog),
+		refuse:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if conn.IsServer() {
+		m.nextID = 2
+	}
+	go m.readLoop()
+	go m.refuseLoop()
+	return m
+}
+
+// OpenStream opens a new stream to the peer.
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := newStream(m, id)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(frameOpen, id, nil); err != nil {
+		m.removeStream(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.closeErr()
+	}
+}
+
+// Close closes the Mux, every stream on it, and the underlying connection.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+	return m.conn.Close()
+}
+
+// fail shuts the Mux down with err, waking every blocked stream.
+func (m *Mux) fail(err error) {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		m.mu.Unlock()
+		close(m.done)
+	})
+}
+
+func (m *Mux) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// localParity returns the parity, 1 or 0, of the IDs of streams opened by
+// this side.
+func (m *Mux) localParity() uint32 {
+	if m.conn.IsServer() {
+		return 0
+	}
+	return 1
+}
+
+func (m *Mux) removeStream(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// writeFrame sends one frame. The header and payload go out in a single
+// Write so that they are not interleaved with other frames.
+func (m *Mux) writeFrame(typ byte, id uint32, payload []byte) error {
+	return m.writeFrameBefore(nil, typ, id, payload)
+}
+
+// writeFrameBefore is like writeFrame but gives up with
+// os.ErrDeadlineExceeded if expired is closed before the frame's turn on
+// the connection comes.
+func (m *Mux) writeFrameBefore(expired <-chan struct{}, typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(payload)))
+	copy(buf[frameHeaderLen:], payload)
+
+	select {
+	case m.writeToken <- struct{}{}:
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-m.done:
+		return m.closeErr()
+	}
+	defer func() { <-m.writeToken }()
+	if err := m.closeErr(); err != nil {
+		return err
+	}
+	if _, err := m.conn.Write(buf); err != nil {
+		m.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads frames from the connection and dispatches them to streams
+// until the connection fails.
+func (m *Mux) readLoop() {
+	var hdr [frameHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			if err == io.EOF {
+				err = ErrMuxClosed
+			}
+			m.fail(err)
+			return
+		}
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[5:7]))
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.fail(err)
+			return
+		}
+		if err := m.handleFrame(typ, id, payload); err != nil {
+			m.fail(err)
+			m.conn.Close()
+			return
+		}
+	}
+}
+
+func (m *Mux) handleFrame(typ byte, id uint32, payload []byte) error {
+	m.mu.Lock()
+	s := m.streams[id]
+	m.mu.Unlock()
+
+	switch typ {
+	case frameOpen:
+		if s != nil {
+			return errors.New("xtls: mux peer reopened stream in use")
+		}
+		if id%2 == m.localParity() {
+			return errors.New("xtls: mux peer opened a stream with a local ID")
+		}
+		s = newStream(m, id)
+		m.mu.Lock()
+		m.streams[id] = s
+		m.mu.Unlock()
+		select {
+		case m.accept <- s:
+		default:
+			// The backlog is full; refuse the stream instead of blocking
+			// the read loop, and with it every other stream.
+			return m.refuseStream(id)
+		}
+	case frameData:
+		if s == nil {
+			// Data for a stream we have closed; drop it.
+			return nil
+		}
+		return s.receive(payload)
+	case frameClose:
+		if s != nil {
+			s.remoteClose()
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return errors.New("xtls: mux window frame has bad length")
+		}
+		if s != nil {
+			s.addWindow(binary.BigEndian.Uint32(payload))
+		}
+	default:
+		return errors.New("xtls: mux received unknown frame type")
+	}
+	return nil
+}
+
+// refuseStream drops the peer-opened stream id and queues its close frame
+// for refuseLoop.
+func (m *Mux) refuseStream(id uint32) error {
+	m.mu.Lock()
+	delete(m.streams, id)
+	if len(m.refused) == acceptBacklog {
+		m.mu.Unlock()
+		return errors.New("xtls: mux peer opened too many streams")
+	}
+	m.refused = append(m.refused, id)
+	m.mu.Unlock()
+	select {
+	case m.refuse <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// refuseLoop sends the close frames of the streams refused by the read
+// loop, which must not block on writes, until the Mux fails.
+func (m *Mux) refuseLoop() {
+	for {
+		select {
+		case <-m.refuse:
+		case <-m.done:
+			return
+		}
+		m.mu.Lock()
+		ids := m.refused
+		m.refused = nil
+		m.mu.Unlock()
+		for _, id := range ids {
+			if m.writeFrame(frameClose, id, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Stream is one logical connection carried by a Mux. It implements
+// net.Conn.
+type Stream struct {
+	mux *Mux
+	id  uint32
+
+	mu           sync.Mutex
+	buf          []byte        // received data not yet read
+	readable     chan struct{} // closed and replaced when buf or state changes
+	unacked      int           // bytes read but not yet credited to the peer
+	sendWindow   int
+	writable     chan struct{} // closed and replaced when sendWindow grows
+	localClosed  bool
+	remoteClosed bool
+
+	readDeadline  deadline.Deadline
+	writeDeadline deadline.Deadline
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	return &Stream{
+		mux:           m,
+		id:            id,
+		readable:      make(chan struct{}),
+		writable:      make(chan struct{}),
+		sendWindow:    streamWindowSize,
+		readDeadline:  deadline.Make(),
+		writeDeadline: deadline.Make(),
+	}
+}
+
+// ID returns the stream identifier, unique within its Mux.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) receive(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed {
+		return nil
+	}
+	if len(s.buf)+len(p) > streamWindowSize {
+		return errors.New("xtls: mux peer exceeded stream window")
+	}
+	s.buf = append(s.buf, p...)
+	close(s.readable)
+	s.readable = make(chan struct{})
+	return nil
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteClosed = true
+	close(s.readable)
+	s.readable = make(chan struct{})
+	close(s.writable)
+	s.writable = make(chan struct{})
+	if s.localClosed {
+		s.mux.removeStream(s.id)
+	}
+}
+
+func (s *Stream) addWindow(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendWindow += int(n)
+	close(s.writable)
+	s.writable = make(chan struct{})
+}
+
+// Read reads data from the stream. It returns io.EOF once the peer has
+// closed the stream and all its data has been read.
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(s.buf) > 0 {
+			n := copy(b, s.buf)
+			s.buf = s.buf[n:]
+			s.unacked += n
+			var credit int
+			if s.unacked >= streamWindowSize/2 {
+				credit, s.unacked = s.unacked, 0
+			}
+			s.mu.Unlock()
+			if credit > 0 {
+				var inc [4]byte
+				binary.BigEndian.PutUint32(inc[:], uint32(credit))
+				s.mux.writeFrame(frameWindow, s.id, inc[:])
+			}
+			return n, nil
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		readable := s.readable
+		s.mu.Unlock()
+
+		if s.readDeadline.Expired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		select {
+		case <-readable:
+		case <-s.readDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-s.mux.done:
+			return 0, s.mux.closeErr()
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the peer's window for
+// the stream is full.
+func (s *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if s.sendWindow == 0 {
+			writable := s.writable
+			s.mu.Unlock()
+			if s.writeDeadline.Expired() {
+				return written, os.ErrDeadlineExceeded
+			}
+			select {
+			case <-writable:
+			case <-s.writeDeadline.Wait():
+				return written, os.ErrDeadlineExceeded
+			case <-s.mux.done:
+				return written, s.mux.closeErr()
+			}
+			continue
+		}
+		n := len(b)
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		err := os.ErrDeadlineExceeded
+		if !s.writeDeadline.Expired() {
+			err = s.mux.writeFrameBefore(s.writeDeadline.Wait(), frameData, s.id, b[:n])
+		}
+		if err == os.ErrDeadlineExceeded {
+			s.addWindow(uint32(n)) // give back the credit reserved above
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream. Other streams on the Mux are unaffected.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.localClosed = true
+	s.buf = nil
+	close(s.readable)
+	s.readable = make(chan struct{})
+	remoteClosed := s.remoteClosed
+	s.mu.Unlock()
+
+	if remoteClosed {
+		s.mux.removeStream(s.id)
+	}
+	err := s.mux.writeFrame(frameClose, s.id, nil)
+	if err == ErrMuxClosed {
+		return nil
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of this stream only.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	s.writeDeadline.Set(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of this stream only.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of this stream only.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Set(t)
+	return nil
+}
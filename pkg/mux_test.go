@@ -0,0 +1,280 @@
+package xtls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	nxtls "github.com/nXTLS/Go"
+	"github.com/nXTLS/Go/xtlstest"
+)
+
+// testMuxPair returns a client and server Mux over a fresh XTLS connection.
+func testMuxPair(t *testing.T) (client, server *Mux) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client = NewMux(NewConn(c1, &Config{InsecureSkipVerify: true}))
+	server = NewMux(NewServerConn(c2, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}}))
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxConcurrentStreams(t *testing.T) {
+	client, server := testMuxPair(t)
+
+	// Echo every accepted stream.
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	const streams = 8
+	// Larger than the stream window, to exercise flow control.
+	const size = 3 * streamWindowSize
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			want := make([]byte, size)
+			rand.Read(want)
+			go func() {
+				s.Write(want)
+			}()
+			got := make([]byte, size)
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Errorf("stream %d: %v", s.ID(), err)
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("stream %d: echoed data does not match", s.ID())
+			}
+			s.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamDeadlines(t *testing.T) {
+	client, server := testMuxPair(t)
+
+	s1, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer1.ID() != s1.ID() || peer2.ID() != s2.ID() {
+		t.Fatalf("accepted streams %d, %d, want %d, %d", peer1.ID(), peer2.ID(), s1.ID(), s2.ID())
+	}
+
+	s1.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	s2.SetReadDeadline(time.Now().Add(time.Hour))
+
+	buf := make([]byte, 8)
+	if _, err := s1.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("s1 Read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// The expired deadline on s1 must not disturb s2 or the connection.
+	if _, err := peer2.Write([]byte("still ok")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s2.Read(buf)
+	if err != nil || string(buf[:n]) != "still ok" {
+		t.Fatalf("s2 Read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	client, server := testMuxPair(t)
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("ReadAll = %q, %v, want %q", got, err, "bye")
+	}
+	if _, err := s.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v, want %v", err, net.ErrClosed)
+	}
+
+	client.Close()
+	if _, err := server.AcceptStream(); err == nil {
+		t.Error("AcceptStream succeeded after the peer closed the mux")
+	}
+}
+
+func TestMuxWriteDeadlineKeepsWindow(t *testing.T) {
+	client, _ := testMuxPair(t)
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := s.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	s.mu.Lock()
+	window := s.sendWindow
+	s.mu.Unlock()
+	if window != streamWindowSize {
+		t.Errorf("send window after a timed-out Write = %d, want %d", window, streamWindowSize)
+	}
+}
+
+func TestMuxAcceptBacklogFull(t *testing.T) {
+	client, server := testMuxPair(t)
+
+	streams := make([]*Stream, acceptBacklog+1)
+	for i := range streams {
+		s, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = s
+	}
+	// The open beyond the backlog is refused, not queued behind it.
+	if _, err := streams[acceptBacklog].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read on a refused stream = %v, want io.EOF", err)
+	}
+
+	// The read loop is still running for the accepted streams.
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(streams[0], buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("Read = %q, %v, want %q", buf, err, "ok")
+	}
+}
+
+// stallingConn is a net.Conn whose writes block, as when the peer stops
+// reading, once stall is closed, until release is closed.
+type stallingConn struct {
+	net.Conn
+	stall, release chan struct{}
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.stall:
+		<-c.release
+		return 0, net.ErrClosed
+	default:
+		return c.Conn.Write(b)
+	}
+}
+
+func TestMuxRefusalDoesNotBlockReads(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	client := NewConn(c1, &Config{InsecureSkipVerify: true})
+	defer client.Close()
+	raw := &stallingConn{Conn: c2, stall: make(chan struct{}), release: make(chan struct{})}
+	server := NewServerConn(raw, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if clientErr, serverErr := xtlstest.Handshake(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: %v, %v", clientErr, serverErr)
+	}
+	close(raw.stall)
+	m := NewMux(server)
+	defer func() {
+		close(raw.release)
+		m.Close()
+	}()
+
+	// Opens beyond the backlog, even with the stream accepted below taken
+	// off it, whose refusals cannot be sent, then data for the first
+	// stream.
+	var frames []byte
+	for i := 0; i < acceptBacklog+2; i++ {
+		frames = append(frames, frameOpen, 0, 0, 0, byte(2*i+1), 0, 0)
+	}
+	frames = append(frames, frameData, 0, 0, 0, 1, 0, 2, 'o', 'k')
+	if _, err := client.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("Read = %q, %v, want %q", buf, err, "ok")
+	}
+
+	// A Stream Write waiting for its turn behind the stalled refusal gives
+	// up at its deadline.
+	for len(m.writeToken) == 0 {
+		runtime.Gosched()
+	}
+	s.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestMuxRejectsLocalStreamID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(NewConn(c1, &Config{InsecureSkipVerify: true}))
+	defer client.Close()
+	server := NewServerConn(c2, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	defer server.Close()
+
+	// An open frame for ID 1, which only the client may use.
+	go func() {
+		server.Write([]byte{frameOpen, 0, 0, 0, 1, 0, 0})
+		io.Copy(io.Discard, server) // lets the failing client send close_notify
+	}()
+	if s, err := client.AcceptStream(); err == nil {
+		t.Fatalf("AcceptStream accepted stream %d with the client's own parity", s.ID())
+	}
+}
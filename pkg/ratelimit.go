@@ -0,0 +1,107 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Token bucket used to cap the accept rate of a Listener.
+
+package xtls
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter is a token bucket refilled at rate tokens per second up to
+// burst tokens. The zero value imposes no limit.
+type acceptLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second; zero means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+	done   chan struct{} // closed by close; made on first use
+}
+
+// set changes the rate and burst, keeping the tokens already saved up to
+// the new burst. A rate of zero or less removes the limit.
+func (l *acceptLimiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate <= 0 {
+		l.rate = 0
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if l.rate == 0 {
+		l.tokens = float64(burst)
+		l.last = time.Now()
+	} else {
+		l.advanceLocked(time.Now())
+	}
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+func (l *acceptLimiter) advanceLocked(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// using it. The bucket may go into debt, so concurrent callers queue up
+// behind each other instead of all waking at the same time.
+func (l *acceptLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.advanceLocked(time.Now())
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait takes a token like reserve and sleeps until it may be used. It
+// returns early once close is called.
+func (l *acceptLimiter) wait() {
+	d := l.reserve()
+	if d <= 0 {
+		return
+	}
+	l.mu.Lock()
+	done := l.doneLocked()
+	l.mu.Unlock()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-done:
+	}
+}
+
+// close wakes up callers of wait, now and in the future.
+func (l *acceptLimiter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	done := l.doneLocked()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+}
+
+func (l *acceptLimiter) doneLocked() chan struct{} {
+	if l.done == nil {
+		l.done = make(chan struct{})
+	}
+	return l.done
+}
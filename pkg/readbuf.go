@@ -0,0 +1,78 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Read-ahead buffering for connections with many small reads.
+
+package xtls
+
+import (
+	"fmt"
+)
+
+// SetReadBufferSize makes Read fetch up to n bytes from the underlying
+// connection at a time and serve smaller reads from what it has read
+// ahead, which saves a socket read per call for line-oriented protocols,
+// notably in Direct mode where every read goes to the socket. Reads of n
+// bytes or more bypass the buffer. Zero, the default, turns buffering off;
+// data already read ahead is still returned first.
+//
+// The read deadline applies when the buffer has to be refilled; data
+// already buffered is returned even after the deadline has passed, as
+// crypto/tls does with a decrypted record. A timeout that interrupts a
+// refill is returned once and does not discard buffered data.
+func (c *Conn) SetReadBufferSize(n int) error {
+	if n < 0 {
+		return fmt.Errorf("xtls: negative read buffer size %d", n)
+	}
+	c.readMu.Lock()
+	c.readSize = n
+	c.readMu.Unlock()
+	return nil
+}
+
+// Peek returns the next n bytes without consuming them, reading from the
+// underlying connection until that many are buffered. n may not exceed the
+// size set by SetReadBufferSize. If fewer than n bytes can be read, Peek
+// returns those with the error that stopped it, such as a read deadline.
+// The slice is only valid until the next Read or Peek.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flowError(); err != nil {
+		return nil, err
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if n < 0 || n > c.readSize && n > len(c.readBuf)-c.readPos {
+		return nil, fmt.Errorf("xtls: cannot peek %d bytes with a read buffer of %d", n, c.readSize)
+	}
+	for len(c.readBuf)-c.readPos < n && c.readErr == nil {
+		c.fill()
+	}
+	buffered := c.readBuf[c.readPos:]
+	if len(buffered) < n {
+		err := c.readErr
+		c.readErr = nil
+		return buffered, c.contextErr(err)
+	}
+	return buffered[:n], nil
+}
+
+// fill reads once from the underlying connection into the read buffer,
+// after the unread data, and records any error in readErr. The caller
+// holds connMu and readMu.
+func (c *Conn) fill() {
+	unread := c.readBuf[c.readPos:]
+	buf := c.readBuf[:cap(c.readBuf)]
+	if len(buf) != c.readSize {
+		buf = make([]byte, c.readSize)
+	}
+	k := copy(buf, unread)
+	n, err := c.Conn.Read(buf[k:])
+	c.countIn(n)
+	c.tapData(DirectionRead, buf[k:k+n])
+	c.readBuf = buf[:k+n]
+	c.readPos = 0
+	c.readErr = err
+}
@@ -0,0 +1,155 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Registry of live connections with a JSON diagnostics handler.
+
+package xtls
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// ConnFullState is a snapshot of a connection for diagnostics, as returned
+// by Conn.FullState and served by ConnRegistry.
+type ConnFullState struct {
+	LocalAddr          string `json:"local_addr"`
+	RemoteAddr         string `json:"remote_addr"`
+	Tag                string `json:"tag,omitempty"`
+	Flow               string `json:"flow"`
+	State              string `json:"state"` // as reported to SetConnState: new, active or closed
+	HandshakeComplete  bool   `json:"handshake_complete"`
+	Version            uint16 `json:"version,omitempty"`
+	CipherSuite        string `json:"cipher_suite,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+	BytesIn            uint64 `json:"bytes_in"`  // application bytes returned by Read
+	BytesOut           uint64 `json:"bytes_out"` // application bytes accepted by Write
+	AlertsStripped     uint64 `json:"alerts_stripped"`
+	Fallback           string `json:"fallback,omitempty"` // the Origin fallback reason and detail, if any
+}
+
+// FullState returns a snapshot of the connection's addresses, flow,
+// negotiated parameters and counters. It is safe to call from any
+// goroutine while the connection is in use, and does not wait for a
+// handshake in progress: until the handshake completes, the negotiated
+// fields are left empty.
+func (c *Conn) FullState() ConnFullState {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	s := ConnFullState{
+		Tag:            c.Tag(),
+		Flow:           c.GetFlow(),
+		BytesIn:        atomic.LoadUint64(&c.bytesIn),
+		BytesOut:       atomic.LoadUint64(&c.bytesOut),
+		AlertsStripped: c.migratedAlerts + c.Conn.AlertsStripped(),
+	}
+	if addr := c.LocalAddr(); addr != nil {
+		s.LocalAddr = addr.String()
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		s.RemoteAddr = addr.String()
+	}
+	c.stateMu.Lock()
+	s.State = c.state.String()
+	c.stateMu.Unlock()
+	// ConnectionState waits for a handshake in progress, so only ask once
+	// the handshake is known to be done.
+	if c.Conn.HandshakeComplete() {
+		cs := c.Conn.ConnectionState()
+		s.HandshakeComplete = true
+		s.Version = cs.Version
+		s.CipherSuite = nxtls.CipherSuiteName(cs.CipherSuite)
+		s.ServerName = cs.ServerName
+		s.NegotiatedProtocol = cs.NegotiatedProtocol
+	}
+	if reason, detail := c.Conn.FallbackReason(); reason != nxtls.FallbackNone {
+		s.Fallback = reason.String()
+		if detail != "" {
+			s.Fallback += ": " + detail
+		}
+	}
+	return s
+}
+
+// A ConnRegistry tracks live connections for an operator dashboard.
+// Connections join it with Register and leave it when they are closed. As
+// an http.Handler it serves the FullState of every registered connection
+// as a JSON array, in registration order, for mounting at a path such as
+// /debug/xtls. The zero value is an empty registry ready to use, and its
+// methods are safe for concurrent use.
+type ConnRegistry struct {
+	mu    sync.Mutex
+	conns map[*Conn]uint64 // registration sequence numbers
+	seq   uint64
+}
+
+// Register adds c to r until c is closed. A connection is in at most one
+// registry: registering it elsewhere moves it. Registering a closed
+// connection does nothing.
+func (r *ConnRegistry) Register(c *Conn) {
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+	if c.registryClosed || c.registry == r {
+		return
+	}
+	if c.registry != nil {
+		c.registry.remove(c)
+	}
+	c.registry = r
+	r.mu.Lock()
+	if r.conns == nil {
+		r.conns = make(map[*Conn]uint64)
+	}
+	r.seq++
+	r.conns[c] = r.seq
+	r.mu.Unlock()
+}
+
+// Conns returns the registered connections in registration order.
+func (r *ConnRegistry) Conns() []*Conn {
+	r.mu.Lock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return r.conns[conns[i]] < r.conns[conns[j]] })
+	r.mu.Unlock()
+	return conns
+}
+
+// ServeHTTP writes the FullState of every registered connection as JSON.
+func (r *ConnRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conns := r.Conns()
+	states := make([]ConnFullState, len(conns))
+	for i, c := range conns {
+		states[i] = c.FullState()
+	}
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+func (r *ConnRegistry) remove(c *Conn) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// unregister removes c from its ConnRegistry for good, as c is closing.
+func (c *Conn) unregister() {
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+	c.registryClosed = true
+	if c.registry != nil {
+		c.registry.remove(c)
+		c.registry = nil
+	}
+}
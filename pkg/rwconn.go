@@ -0,0 +1,67 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// net.Conn adapter for arbitrary byte-stream carriers.
+
+package xtls
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// WrapReadWriter presents rw as a net.Conn, for running XTLS over carriers
+// that are not network connections, such as a pair of pipes or a message
+// bus stream; the result can be passed to NewConn or NewServerConn. local
+// and remote are reported by LocalAddr and RemoteAddr; nil stands for a
+// placeholder address of network "rw". Deadlines are passed on if rw has
+// the corresponding SetDeadline, SetReadDeadline or SetWriteDeadline
+// method and are otherwise ignored: the calls succeed without effect, so
+// a carrier that cannot honor them offers no timeouts.
+func WrapReadWriter(rw io.ReadWriteCloser, local, remote net.Addr) net.Conn {
+	if local == nil {
+		local = rwAddr{}
+	}
+	if remote == nil {
+		remote = rwAddr{}
+	}
+	return &rwConn{ReadWriteCloser: rw, local: local, remote: remote}
+}
+
+// rwConn is the net.Conn returned by WrapReadWriter.
+type rwConn struct {
+	io.ReadWriteCloser
+	local, remote net.Addr
+}
+
+func (c *rwConn) LocalAddr() net.Addr  { return c.local }
+func (c *rwConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *rwConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rwConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *rwConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// rwAddr is the placeholder address of a WrapReadWriter conn.
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "rw" }
+func (rwAddr) String() string  { return "rw" }
@@ -0,0 +1,51 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// XTLS over SCTP associations, as an alternative to TCP.
+
+package xtls
+
+import "fmt"
+
+// errSCTPUnsupported is returned by DialSCTP and ListenSCTP on platforms
+// without SCTP support.
+var errSCTPUnsupported = fmt.Errorf("%w: SCTP is not supported on this platform", ErrUnsupportedNetwork)
+
+// DialSCTP is like Dial over an SCTP association instead of a TCP
+// connection. network must be "sctp", "sctp4" or "sctp6". Only a single
+// stream is used, so the association behaves like a TCP connection.
+//
+// Every Write is sent as one SCTP message. In Direct mode the trailing
+// alert of a Write is dropped before it is sent, so stripping never
+// splits a message; the peer still sees one message per Write.
+//
+// SCTP is currently only supported on Linux.
+func DialSCTP(network, addr string, config *Config) (*Conn, error) {
+	conn, err := dialSCTP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, config), nil
+}
+
+// ListenSCTP is like ListenXTLS over SCTP; see DialSCTP for networks and
+// limitations.
+func ListenSCTP(network, addr string, config *Config) (*Listener, error) {
+	ln, err := listenSCTP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, config), nil
+}
+
+// sctpTCPNetwork maps an SCTP network name to the TCP one used to resolve
+// its addresses.
+func sctpTCPNetwork(network string) (string, error) {
+	switch network {
+	case "sctp":
+		return "tcp", nil
+	case "sctp4":
+		return "tcp4", nil
+	case "sctp6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnsupportedNetwork, network)
+}
@@ -0,0 +1,87 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// One-to-one style SCTP sockets on Linux.
+
+//go:build linux
+
+package xtls
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// dialSCTP connects a one-to-one style SCTP socket to addr. Such sockets
+// accept the same calls as TCP ones, so the net package can run them.
+func dialSCTP(network, addr string) (net.Conn, error) {
+	fd, sa, err := sctpSocket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", err)}
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// listenSCTP binds a one-to-one style SCTP socket to addr and listens on it.
+func listenSCTP(network, addr string) (net.Listener, error) {
+	fd, sa, err := sctpSocket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", err)}
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("listen", err)}
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sctpSocket resolves addr and opens an SCTP socket of the matching family.
+func sctpSocket(network, addr string) (int, syscall.Sockaddr, error) {
+	tcpNetwork, err := sctpTCPNetwork(network)
+	if err != nil {
+		return -1, nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr(tcpNetwork, addr)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := tcpAddr.IP.To4(); network != "sctp6" && (tcpAddr.IP == nil || ip4 != nil) {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		if tcpAddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(tcpAddr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return -1, nil, &net.OpError{Op: "socket", Net: network, Err: os.NewSyscallError("socket", err)}
+	}
+	return fd, sa, nil
+}
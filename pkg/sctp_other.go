@@ -0,0 +1,22 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// SCTP stubs for platforms other than Linux.
+
+//go:build !linux
+
+package xtls
+
+import "net"
+
+func dialSCTP(network, addr string) (net.Conn, error) {
+	if _, err := sctpTCPNetwork(network); err != nil {
+		return nil, err
+	}
+	return nil, errSCTPUnsupported
+}
+
+func listenSCTP(network, addr string) (net.Listener, error) {
+	if _, err := sctpTCPNetwork(network); err != nil {
+		return nil, err
+	}
+	return nil, errSCTPUnsupported
+}
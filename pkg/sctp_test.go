@@ -0,0 +1,67 @@
+package xtls
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+func TestSCTP(t *testing.T) {
+	ln, err := ListenSCTP("sctp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+	})
+	var opErr *net.OpError
+	if errors.Is(err, errSCTPUnsupported) || errors.As(err, &opErr) && opErr.Op == "socket" {
+		t.Skipf("SCTP is not available: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.AcceptXTLS()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetFlow(RPRXDirect)
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			errc <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		errc <- err
+	}()
+
+	conn, err := DialSCTP("sctp", ln.Addr().String(), &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetFlow(RPRXDirect)
+	// The trailing alert is stripped from the message.
+	if _, err := conn.Write([]byte{'p', 'i', 'n', 'g', 0x15, 0x03, 0x03, 0x00, 0x1a}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v, want %q", buf, err, "ping")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DialSCTP("tcp", ln.Addr().String(), nil); err == nil {
+		t.Error("DialSCTP accepted a TCP network")
+	}
+}
@@ -0,0 +1,83 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Package-wide connection counters for health checks and metrics.
+
+package xtls
+
+import (
+	"sync/atomic"
+
+	nxtls "github.com/nXTLS/Go"
+)
+
+// AggregateStats holds counters summed over the connections created by this
+// package, as returned by Stats.
+type AggregateStats struct {
+	TotalConns     uint64 // connections created
+	ActiveConns    uint64 // connections created but not yet closed
+	BytesIn        uint64 // application bytes returned by Read
+	BytesOut       uint64 // application bytes accepted by Write
+	AlertsStripped uint64 // trailing alerts dropped by Direct mode writes of closed conns
+	Fallbacks      uint64 // closed conns that fell back to the Origin fallback logic
+}
+
+// stats holds the package-wide counters, all accessed atomically. It
+// keeps no reference to any connection: counters kept by the nXTLS
+// connection are folded in when the wrapper is closed.
+var stats struct {
+	total, active     uint64
+	bytesIn, bytesOut uint64
+	alertsStripped    uint64
+	fallbacks         uint64
+}
+
+// track counts c as a new active connection. Every Conn constructor calls
+// it.
+func track(c *Conn) *Conn {
+	atomic.AddUint64(&stats.total, 1)
+	atomic.AddUint64(&stats.active, 1)
+	return c
+}
+
+// untrack counts c as closed and folds in the counters kept by its nXTLS
+// connection. Only the first call for a tracked conn has an effect. The
+// caller holds c.connMu.
+func untrack(c *Conn) {
+	if !atomic.CompareAndSwapUint32(&c.untracked, 0, 1) {
+		return
+	}
+	atomic.AddUint64(&stats.active, ^uint64(0))
+	atomic.AddUint64(&stats.alertsStripped, c.migratedAlerts+c.Conn.AlertsStripped())
+	if reason, _ := c.Conn.FallbackReason(); reason != nxtls.FallbackNone {
+		atomic.AddUint64(&stats.fallbacks, 1)
+	}
+}
+
+// countIn and countOut add n application bytes read or written by c to its
+// counters and to the package-wide ones.
+func (c *Conn) countIn(n int) {
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	atomic.AddUint64(&stats.bytesIn, uint64(n))
+}
+
+func (c *Conn) countOut(n int) {
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	atomic.AddUint64(&stats.bytesOut, uint64(n))
+}
+
+// Stats returns counters summed over every Conn created by this package
+// since the process started, for feeding a health check or metrics
+// endpoint. A Conn counts as active until its Close method is called, so
+// connections that are dropped without being closed stay active, though
+// nothing keeps them from being garbage collected. Bytes are counted as
+// they pass; stripped alerts and fallbacks are added when a Conn is
+// closed.
+func Stats() AggregateStats {
+	return AggregateStats{
+		TotalConns:     atomic.LoadUint64(&stats.total),
+		ActiveConns:    atomic.LoadUint64(&stats.active),
+		BytesIn:        atomic.LoadUint64(&stats.bytesIn),
+		BytesOut:       atomic.LoadUint64(&stats.bytesOut),
+		AlertsStripped: atomic.LoadUint64(&stats.alertsStripped),
+		Fallbacks:      atomic.LoadUint64(&stats.fallbacks),
+	}
+}
@@ -0,0 +1,12 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// String to []byte conversion for Go releases before 1.20.
+
+//go:build !go1.20
+
+package xtls
+
+// stringBytes returns the bytes of s. Before Go 1.20 there is no supported
+// way to alias a string's memory, so it copies.
+func stringBytes(s string) []byte {
+	return []byte(s)
+}
@@ -0,0 +1,13 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Zero-copy string to []byte conversion for Go 1.20 and later.
+
+//go:build go1.20
+
+package xtls
+
+import "unsafe"
+
+// stringBytes returns a read-only []byte view of s that shares its memory.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
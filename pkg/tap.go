@@ -0,0 +1,66 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Plaintext capture for debugging the protocol carried over a connection.
+
+package xtls
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// tapHeaderLen is the length of the frame header written by a plaintext
+// tap: one direction byte followed by a 4-byte big-endian payload length.
+const tapHeaderLen = 5
+
+// plaintextTap writes the frames of SetPlaintextTap.
+type plaintextTap struct {
+	mu  sync.Mutex
+	w   io.Writer
+	hdr [tapHeaderLen]byte
+}
+
+// SetPlaintextTap copies all application data read from or written to the
+// connection to w, before encryption and after decryption, so the inner
+// protocol can be inspected. Each Read or Write that moves data becomes
+// one frame on w: a direction byte, DirectionRead or DirectionWrite, then
+// the payload length as a 4-byte big-endian integer, then the payload.
+// Reads are captured as they come off the connection, so data fetched by
+// Peek or a read buffer is tapped before the caller consumes it. Frames are
+// written in the order the calls complete; errors from w are ignored, so a
+// failing tap never breaks the connection. A nil w turns the tap off.
+//
+// The tap defeats the confidentiality TLS provides: anything that can read
+// w sees the traffic, including passwords and session cookies. Use it only
+// while debugging, never write it to a shared location, and do not leave
+// it enabled in production.
+func (c *Conn) SetPlaintextTap(w io.Writer) {
+	c.tapMu.Lock()
+	defer c.tapMu.Unlock()
+	if w == nil {
+		c.tap = nil
+		return
+	}
+	c.tap = &plaintextTap{w: w}
+}
+
+// tapData writes b to the plaintext tap, if any, as a frame for dir.
+func (c *Conn) tapData(dir Direction, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.tapMu.Lock()
+	t := c.tap
+	c.tapMu.Unlock()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hdr[0] = byte(dir)
+	binary.BigEndian.PutUint32(t.hdr[1:], uint32(len(b)))
+	if _, err := t.w.Write(t.hdr[:]); err != nil {
+		return
+	}
+	t.w.Write(b)
+}
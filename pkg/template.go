@@ -0,0 +1,57 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Connection templates for factories producing many similar connections.
+
+package xtls
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// A ConnTemplate holds the settings shared by the connections a factory
+// produces over different sockets, so that they are applied by New before
+// the connection is handed out, instead of by setter calls that may race
+// with its first use. A ConnTemplate must not be modified while New is
+// running; it may be used by several goroutines at once otherwise.
+type ConnTemplate struct {
+	// Config is the client configuration of every connection.
+	Config *Config
+
+	// Flow is the initial flow, as passed to SetFlow. Empty means
+	// RPRXOrigin.
+	Flow string
+
+	// FlowByALPN, if non-nil, is passed to SetFlowByALPN.
+	FlowByALPN map[string]string
+
+	// StrictFlow is passed to SetStrictFlow.
+	StrictFlow bool
+
+	// Debug enables XTLS debug output, as EnableXTLSDebug does.
+	Debug bool
+
+	// ProgressDeadline, if non-zero, is passed to SetProgressDeadline.
+	ProgressDeadline time.Duration
+
+	// ConnState, if non-nil, is passed to SetConnState.
+	ConnState func(net.Conn, http.ConnState)
+}
+
+// New returns a client connection over conn with the settings of t.
+func (t *ConnTemplate) New(conn net.Conn) *Conn {
+	c := NewConn(conn, t.Config)
+	c.SetStrictFlow(t.StrictFlow)
+	if t.Flow != "" {
+		c.SetFlow(t.Flow)
+	}
+	if t.FlowByALPN != nil {
+		c.SetFlowByALPN(t.FlowByALPN)
+	}
+	c.EnableXTLSDebug(t.Debug)
+	c.SetProgressDeadline(t.ProgressDeadline)
+	if t.ConnState != nil {
+		c.SetConnState(t.ConnState)
+	}
+	return c
+}
@@ -0,0 +1,143 @@
+// MIT License: nXTLS compatibility glue for XTLS API consumers.
+// Session ticket key management for listeners.
+
+package xtls
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+// SetSessionTicketKeys sets the keys that encrypt and decrypt the session
+// tickets of connections accepted by the listener; see
+// Config.SetSessionTicketKeys. The first key encrypts new tickets and all
+// of them decrypt tickets presented for resumption, so keeping recent keys
+// after the first lets earlier tickets still resume. Configs returned by
+// GetConfigForClient are not affected. It panics if keys is empty or the
+// listener has no Config.
+func (l *Listener) SetSessionTicketKeys(keys [][32]byte) {
+	l.config.SetSessionTicketKeys(keys)
+}
+
+// RotateSessionTicketKeys installs a fresh random session ticket key now
+// and every interval afterwards, limiting how long a stolen key can
+// decrypt recorded traffic. The keep keys before the newest remain valid
+// for decryption, so tickets issued up to keep intervals ago still resume;
+// older tickets fall back to a full handshake. Keys come from the Config's
+// Rand, or crypto/rand.
+//
+// Rotation runs until stop is called or the listener is closed; calling
+// RotateSessionTicketKeys again replaces it. Like SetSessionTicketKeys, it
+// does not affect Configs returned by GetConfigForClient.
+func (l *Listener) RotateSessionTicketKeys(interval time.Duration, keep int) (stop func(), err error) {
+	if l.config == nil {
+		return nil, errors.New("xtls: RotateSessionTicketKeys needs a listener Config")
+	}
+	if interval <= 0 || keep < 0 {
+		return nil, errors.New("xtls: RotateSessionTicketKeys needs a positive interval and keep of zero or more")
+	}
+	r := &ticketKeyRotation{listener: l, keep: keep, done: make(chan struct{})}
+	key, err := r.newKey()
+	if err != nil {
+		return nil, err
+	}
+	l.ticketMu.Lock()
+	if prev := l.ticketRotation; prev != nil {
+		prev.stopLocked()
+	}
+	l.ticketRotation = r
+	r.installLocked(key)
+	l.ticketMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				// A failing random source leaves the current keys in place
+				// until the next tick.
+				r.rotate()
+			}
+		}
+	}()
+	return r.stop, nil
+}
+
+// stopTicketRotation ends rotation started by RotateSessionTicketKeys.
+func (l *Listener) stopTicketRotation() {
+	l.ticketMu.Lock()
+	defer l.ticketMu.Unlock()
+	if r := l.ticketRotation; r != nil {
+		r.stopLocked()
+	}
+}
+
+// ticketKeyRotation holds the keys installed by RotateSessionTicketKeys,
+// newest first. Its fields are guarded by the listener's ticketMu.
+type ticketKeyRotation struct {
+	listener *Listener
+	keep     int
+	keys     [][32]byte
+	done     chan struct{} // closed once the rotation is stopped
+}
+
+// rotate installs a new key, keeping the keep newest previous ones, unless
+// the rotation has been stopped or replaced meanwhile.
+func (r *ticketKeyRotation) rotate() error {
+	key, err := r.newKey()
+	if err != nil {
+		return err
+	}
+	r.listener.ticketMu.Lock()
+	defer r.listener.ticketMu.Unlock()
+	r.installLocked(key)
+	return nil
+}
+
+// newKey returns a random key from the Config's Rand, or crypto/rand.
+func (r *ticketKeyRotation) newKey() (key [32]byte, err error) {
+	rnd := r.listener.config.Rand
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	_, err = io.ReadFull(rnd, key[:])
+	return key, err
+}
+
+// installLocked makes key the newest key if r is still the listener's
+// rotation. The caller holds ticketMu.
+func (r *ticketKeyRotation) installLocked(key [32]byte) {
+	if r.listener.ticketRotation != r {
+		return
+	}
+	keys := append([][32]byte{key}, r.keys...)
+	if len(keys) > r.keep+1 {
+		keys = keys[:r.keep+1]
+	}
+	r.keys = keys
+	r.listener.SetSessionTicketKeys(keys)
+}
+
+// stop ends the rotation; further calls do nothing.
+func (r *ticketKeyRotation) stop() {
+	r.listener.ticketMu.Lock()
+	defer r.listener.ticketMu.Unlock()
+	r.stopLocked()
+}
+
+// stopLocked is stop with ticketMu held.
+func (r *ticketKeyRotation) stopLocked() {
+	if r.listener.ticketRotation == r {
+		r.listener.ticketRotation = nil
+	}
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
@@ -4,11 +4,18 @@
 package xtls
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	nxtls "github.com/nXTLS/Go"
@@ -31,16 +38,144 @@ const (
 // Config is a type alias for nXTLS Config, for compatibility.
 type Config = nxtls.Config
 
+// Direction is a type alias for nXTLS Direction, used by SetRecordTracer.
+type Direction = nxtls.Direction
+
+// Record directions reported to a record tracer.
+const (
+	DirectionRead  = nxtls.DirectionRead
+	DirectionWrite = nxtls.DirectionWrite
+)
+
+// Handshake stages reported to a SetHandshakeProgress callback.
+const (
+	HandshakeStageClientHelloSent     = nxtls.HandshakeStageClientHelloSent
+	HandshakeStageClientHelloReceived = nxtls.HandshakeStageClientHelloReceived
+	HandshakeStageServerHelloReceived = nxtls.HandshakeStageServerHelloReceived
+	HandshakeStageCertificateReceived = nxtls.HandshakeStageCertificateReceived
+	HandshakeStageFinished            = nxtls.HandshakeStageFinished
+)
+
 // Conn wraps nXTLS.Conn to present an XTLS-like API and flow logic.
 type Conn struct {
+	// Counters reported by Stats, accessed atomically. They come first
+	// for 64-bit alignment.
+	bytesIn, bytesOut uint64
+	progressIdle      int64  // a time.Duration set by SetProgressDeadline
+	untracked         uint32 // set once Close has counted the conn as closed
+	slotFreed         uint32 // set once Close has freed the Listener slot
+
 	*nxtls.Conn
-	flow      string
-	handshook bool
+
+	// connMu is held shared by every method that uses Conn, and
+	// exclusively by Migrate to replace it. Migrate only ever TryLocks it,
+	// so a method holding it shared may call another that takes it again.
+	// migratedAlerts counts the alerts stripped by replaced conns.
+	connMu         sync.RWMutex
+	migratedAlerts uint64
+
+	flowMu     sync.Mutex
+	flow       string
+	flowByALPN map[string]string // set by SetFlowByALPN
+	strictFlow bool              // set by SetStrictFlow
+	flowErr    error             // unknown flow passed to SetFlow under SetStrictFlow
+
+	config *Config // the config passed to NewConn or NewServerConn, for Migrate and Rebind
+
+	// handshakeMu guards the per-transport state below, so that a conn
+	// installed by Migrate gets the bookkeeping of its own handshake.
+	handshakeMu   sync.Mutex
+	handshookConn *nxtls.Conn // the conn whose completed handshake has been accounted for
+	flowConn      *nxtls.Conn // the conn whose flow SetFlowByALPN or an explicit switch has set
+
+	acceptedAt    time.Time    // when a Listener wrapped the conn
+	acceptLatency *histogram   // the Listener's histogram, fed once the handshake completes
+	slot          *connLimiter // the Listener whose SetMaxConns slot the conn holds, if any
+
+	stateMu   sync.Mutex
+	state     http.ConnState                 // the state last reported to connState
+	connState func(net.Conn, http.ConnState) // set by SetConnState
+
+	readMu   sync.Mutex
+	readSize int    // set by SetReadBufferSize; zero means Read is not buffered
+	readBuf  []byte // plaintext read ahead, unread from readPos on
+	readPos  int
+	readErr  error // error of the read that last filled readBuf, kept until it drains
+
+	maxRecordSize int // if non-zero, Write splits buffers into chunks of at most this size
+	recordJitter  int // chunks are up to this many bytes smaller than maxRecordSize
+
+	tapMu sync.Mutex
+	tap   *plaintextTap // set by SetPlaintextTap
+
+	coalesceMu     sync.Mutex
+	coalesceDelay  time.Duration // set by SetWriteCoalescing; zero means writes are not coalesced
+	coalesceMax    int
+	coalesceBuf    []byte         // plaintext held for the next coalesced write
+	coalesceTimer  *time.Timer    // sends coalesceBuf once coalesceDelay has passed
+	coalesceTimers sync.WaitGroup // armed timers that have not been stopped or finished
+	coalesceErr    error          // error of a timer flush, for the next call
+
+	ctxMu   sync.Mutex
+	ctx     context.Context // set by WithContext; nil means context.Background
+	ctxStop chan struct{}   // closed to stop watching ctx
+	ctxDone chan struct{}   // closed once the goroutine watching ctx has exited
+
+	registryMu     sync.Mutex
+	registry       *ConnRegistry // set by ConnRegistry.Register
+	registryClosed bool          // set on Close, after which Register is a no-op
 }
 
 // SetFlow sets the flow control mode (origin/direct) for this connection.
+// Unrecognized flows fall back to Origin, unless SetStrictFlow is in
+// effect: then the flow is left unchanged and Read, Peek and Write fail
+// with the error SetFlowStrict would have returned, until a later SetFlow
+// succeeds.
 func (c *Conn) SetFlow(flow string) {
+	c.flowMu.Lock()
+	strict := c.strictFlow
+	c.flowMu.Unlock()
+	if !strict {
+		c.setFlow(flow)
+		return
+	}
+	if err := c.SetFlowStrict(flow); err != nil {
+		c.flowMu.Lock()
+		c.flowErr = err
+		c.flowMu.Unlock()
+	}
+}
+
+// SetStrictFlow makes the connection fail closed on an unrecognized flow,
+// such as a typo in a configuration file, instead of falling back to
+// Origin; see SetFlow.
+func (c *Conn) SetStrictFlow(strict bool) {
+	c.flowMu.Lock()
+	c.strictFlow = strict
+	c.flowMu.Unlock()
+}
+
+// SetFlowStrict is like SetFlow but returns an error matching
+// ErrUnknownFlow for an unrecognized flow, leaving the flow unchanged,
+// whatever SetStrictFlow says.
+func (c *Conn) SetFlowStrict(flow string) error {
+	switch strings.ToLower(flow) {
+	case RPRXDirect, RPRXOrigin:
+	default:
+		return fmt.Errorf("%w %q, want %s or %s", ErrUnknownFlow, flow, RPRXOrigin, RPRXDirect)
+	}
+	c.setFlow(flow)
+	return nil
+}
+
+func (c *Conn) setFlow(flow string) {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	c.flushCoalesced()
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
 	c.flow = flow
+	c.flowErr = nil
 	switch strings.ToLower(flow) {
 	case RPRXDirect:
 		c.Conn.SetXTLSMode(nxtls.XTLSModeDirect)
@@ -51,90 +186,535 @@ func (c *Conn) SetFlow(flow string) {
 	}
 }
 
+// setFlowName records flow as the current flow after the nXTLS connection
+// switched mode by itself, as Upgrade does.
+func (c *Conn) setFlowName(flow string) {
+	c.flowMu.Lock()
+	c.flow = flow
+	c.flowMu.Unlock()
+}
+
+// Upgrade switches the connection from Origin to Direct flow after an
+// application-level exchange; see nxtls.Conn.Upgrade. It may only be called
+// once and returns ErrAlreadyUpgraded afterwards.
+func (c *Conn) Upgrade() error {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flushCoalesced(); err != nil {
+		return err
+	}
+	if err := c.Conn.Upgrade(); err != nil {
+		return err
+	}
+	c.handshakeMu.Lock()
+	c.flowConn = c.Conn // an explicit switch overrides SetFlowByALPN
+	c.handshakeMu.Unlock()
+	c.setFlowName(RPRXDirect)
+	return nil
+}
+
+// SpliceFrom is like Upgrade but first sends prebuffered to the peer as raw
+// bytes, ahead of anything written afterwards; see nxtls.Conn.SpliceFrom.
+func (c *Conn) SpliceFrom(prebuffered []byte) error {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flushCoalesced(); err != nil {
+		return err
+	}
+	if err := c.Conn.SpliceFrom(prebuffered); err != nil {
+		return err
+	}
+	c.handshakeMu.Lock()
+	c.flowConn = c.Conn // an explicit switch overrides SetFlowByALPN
+	c.handshakeMu.Unlock()
+	c.setFlowName(RPRXDirect)
+	return nil
+}
+
 // GetFlow returns the current flow control mode as a string.
 func (c *Conn) GetFlow() string {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
 	return c.flow
 }
 
+// flowError returns the error Read, Peek and Write fail with after an
+// unknown flow under SetStrictFlow.
+func (c *Conn) flowError() error {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+	return c.flowErr
+}
+
+// SetFlowByALPN makes the connection switch, once the handshake
+// completes, to the flow that flows maps the negotiated ALPN protocol to,
+// such as RPRXDirect for bulk protocols and RPRXOrigin for control
+// protocols. Unmapped protocols keep the flow already set. It must be
+// called before the handshake; flows is copied.
+func (c *Conn) SetFlowByALPN(flows map[string]string) {
+	m := make(map[string]string, len(flows))
+	for proto, flow := range flows {
+		m[proto] = flow
+	}
+	c.flowMu.Lock()
+	c.flowByALPN = m
+	c.flowMu.Unlock()
+}
+
 // Handshake performs the TLS handshake if it has not yet been performed.
+// Once the handshake has completed it returns immediately, so it is safe
+// to call from concurrent Read and Write calls.
 func (c *Conn) Handshake() error {
-	if c.handshook {
-		return nil
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.Conn.HandshakeContext(c.Context()); err != nil {
+		if errors.Is(err, ErrHandshakeTimeout) {
+			return err
+		}
+		return c.contextErr(err)
 	}
-	err := c.Conn.Handshake()
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshookConn != c.Conn {
+		c.handshookConn = c.Conn
+		handshakeDurations.observe(c.Conn.HandshakeDuration())
+		if c.acceptLatency != nil {
+			c.acceptLatency.observe(time.Since(c.acceptedAt))
+		}
+		c.setState(http.StateActive)
+	}
+	if c.flowConn != c.Conn {
+		c.flowConn = c.Conn
+		c.applyFlowByALPN()
+	}
+	return nil
+}
+
+// applyFlowByALPN switches to the flow that SetFlowByALPN maps the
+// negotiated protocol to, if any. The caller holds connMu.
+func (c *Conn) applyFlowByALPN() {
+	c.flowMu.Lock()
+	flows := c.flowByALPN
+	c.flowMu.Unlock()
+	if len(flows) == 0 {
+		return
+	}
+	if flow, ok := flows[c.Conn.ConnectionState().NegotiatedProtocol]; ok {
+		c.SetFlow(flow)
+	}
+}
+
+// WithContext attaches ctx to the connection, for carrying request-scoped
+// values such as trace IDs, and ties the connection's lifetime to it: once
+// ctx is done, the underlying connection is closed without a close_notify,
+// and pending and later Read, Write and Handshake calls fail with ctx.Err().
+// A later call replaces ctx and stops watching the previous one.
+func (c *Conn) WithContext(ctx context.Context) {
+	if ctx == nil {
+		panic("xtls: nil context")
+	}
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	if c.ctxStop != nil {
+		close(c.ctxStop)
+		c.ctxStop = nil
+	}
+	c.ctx = ctx
+	if ctx.Done() == nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.ctxStop, c.ctxDone = stop, done
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.connMu.RLock()
+			c.Conn.NetConn().Close()
+			c.connMu.RUnlock()
+		case <-stop:
+		}
+	}()
+}
+
+// Context returns the context attached by WithContext, or
+// context.Background if there is none.
+func (c *Conn) Context() context.Context {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// contextErr returns the error of the attached context in place of err once
+// the context is done, since the failure was caused by its cancellation.
+func (c *Conn) contextErr(err error) error {
 	if err == nil {
-		c.handshook = true
+		return nil
+	}
+	if ctxErr := c.Context().Err(); ctxErr != nil {
+		return ctxErr
 	}
 	return err
 }
 
 // Read reads data from the connection, performing handshake if necessary.
+// With a read buffer set by SetReadBufferSize, small reads are served from
+// data read ahead.
 func (c *Conn) Read(b []byte) (int, error) {
-	if !c.handshook {
-		if err := c.Handshake(); err != nil {
-			return 0, err
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flowError(); err != nil {
+		return 0, err
+	}
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readPos == len(c.readBuf) {
+		if err := c.readErr; err != nil {
+			c.readErr = nil
+			return 0, c.contextErr(err)
+		}
+		if len(b) == 0 || len(b) >= c.readSize {
+			// Nothing to gain from buffering; read straight into b.
+			n, err := c.Conn.Read(b)
+			c.countIn(n)
+			c.tapData(DirectionRead, b[:n])
+			return n, c.contextErr(err)
+		}
+		c.fill()
+		if c.readPos == len(c.readBuf) {
+			err := c.readErr
+			c.readErr = nil
+			return 0, c.contextErr(err)
 		}
 	}
-	return c.Conn.Read(b)
+	n := copy(b, c.readBuf[c.readPos:])
+	c.readPos += n
+	return n, nil
 }
 
 // Write writes data to the connection, performing handshake if necessary.
 func (c *Conn) Write(b []byte) (int, error) {
-	if !c.handshook {
-		if err := c.Handshake(); err != nil {
-			return 0, err
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if err := c.flowError(); err != nil {
+		return 0, err
+	}
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	n, ok, err := c.coalesceWrite(b)
+	if !ok {
+		n, err = c.write(b)
+	}
+	c.countOut(n)
+	c.tapData(DirectionWrite, b[:n])
+	return n, c.contextErr(err)
+}
+
+func (c *Conn) write(b []byte) (int, error) {
+	limit := c.maxRecordSize
+	idle := time.Duration(atomic.LoadInt64(&c.progressIdle))
+	if limit == 0 && idle > 0 {
+		limit = maxRecordSize
+	}
+	if limit == 0 || len(b) == 0 || len(b) <= limit && idle == 0 {
+		return c.Conn.Write(b)
+	}
+	var n int
+	for len(b) > 0 {
+		size := limit
+		if c.recordJitter > 0 {
+			size -= mathrand.Intn(c.recordJitter + 1)
+		}
+		chunk := b
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if idle > 0 {
+			if err := c.Conn.SetWriteDeadline(time.Now().Add(idle)); err != nil {
+				return n, err
+			}
 		}
+		m, err := c.Conn.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
 	}
-	return c.Conn.Write(b)
+	return n, nil
 }
 
-// Close closes the connection.
+// Bounds accepted by SetMaxRecordSize.
+const (
+	minRecordSize = 512
+	maxRecordSize = 16384
+)
+
+// SetMaxRecordSize makes Write split buffers larger than n bytes into
+// n-byte chunks, each handed to the underlying connection separately. In
+// Origin mode every chunk becomes at least one TLS record; in Direct mode
+// every chunk is a separate write to the socket. Smaller records shape
+// traffic and change its fingerprint at some cost in throughput. n must be
+// within [512, 16384]; zero restores the default of no chunking.
+func (c *Conn) SetMaxRecordSize(n int) error {
+	if n != 0 && (n < minRecordSize || n > maxRecordSize) {
+		return fmt.Errorf("xtls: max record size %d out of range [%d, %d]", n, minRecordSize, maxRecordSize)
+	}
+	c.maxRecordSize = n
+	if c.recordJitter >= n {
+		c.recordJitter = 0
+	}
+	return nil
+}
+
+// SetRecordSizeJitter makes each chunk cut by Write a random size between
+// n-jitter and n bytes, where n is the SetMaxRecordSize limit, so that
+// record sizes on the wire vary instead of forming a regular pattern.
+// jitter must be below n; zero disables it. Lowering n below the jitter
+// later disables the jitter as well.
+func (c *Conn) SetRecordSizeJitter(jitter int) error {
+	if jitter < 0 || (jitter > 0 && jitter >= c.maxRecordSize) {
+		return fmt.Errorf("xtls: record size jitter %d out of range [0, %d)", jitter, c.maxRecordSize)
+	}
+	c.recordJitter = jitter
+	return nil
+}
+
+// SetProgressDeadline makes Write fail only once idle passes without
+// progress, rather than at a fixed time: Write sends its buffer in chunks
+// of at most 16384 bytes, or the SetMaxRecordSize limit, and moves the
+// write deadline to idle from now before each one. A slow but steady
+// upload thus never times out, while a stalled one fails with a timeout
+// error after idle. It takes over the write deadline, replacing any set by
+// SetWriteDeadline or SetDeadline, and leaves the last one in place when
+// Write returns. Zero turns it off. It may be called concurrently with
+// Write, which uses the value current when it starts.
+func (c *Conn) SetProgressDeadline(idle time.Duration) {
+	atomic.StoreInt64(&c.progressIdle, int64(idle))
+}
+
+// WriteString writes s to the connection without copying it into a new
+// []byte when built with Go 1.20 or later. The bytes go through the same
+// path as Write, so direct-mode alert stripping still sees the string
+// contents. The underlying conn must not retain or modify the slice it is
+// handed, which holds for net.Conn.
+func (c *Conn) WriteString(s string) (int, error) {
+	if len(s) == 0 {
+		return c.Write(nil)
+	}
+	return c.Write(stringBytes(s))
+}
+
+// Close closes the connection, after sending any bytes held by write
+// coalescing.
 func (c *Conn) Close() error {
-	return c.Conn.Close()
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.close(c.flushCoalesced(), c.Conn.Close)
+}
+
+// closeNotifyTimeout is the CloseGracefully bound used for a timeout of
+// zero or less, as in nxtls.Conn.CloseGracefully.
+const closeNotifyTimeout = 5 * time.Second
+
+// CloseGracefully flushes bytes held by SetWriteCoalescing, then closes the
+// connection like nxtls.Conn.CloseGracefully: a genuine close_notify is sent
+// even in Direct mode before the socket is closed. Everything must be
+// written within timeout; zero or less means five seconds.
+func (c *Conn) CloseGracefully(timeout time.Duration) error {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if timeout <= 0 {
+		timeout = closeNotifyTimeout
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	return c.close(c.flushCoalesced(), func() error {
+		return c.Conn.CloseGracefully(timeout)
+	})
+}
+
+func (c *Conn) close(flushErr error, closeConn func() error) error {
+	c.ctxMu.Lock()
+	if c.ctxStop != nil {
+		close(c.ctxStop)
+		c.ctxStop = nil
+	}
+	watcher := c.ctxDone
+	c.ctxMu.Unlock()
+	// Wait for the goroutines that may still touch c, so that Rebind can
+	// reset it once Close returns.
+	if watcher != nil {
+		<-watcher
+	}
+	c.coalesceTimers.Wait()
+	untrack(c)
+	c.releaseSlot()
+	c.unregister()
+	c.setState(http.StateClosed)
+	if err := closeConn(); err != nil {
+		return err
+	}
+	return flushErr
 }
 
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
-	return c.Conn.LocalAddr()
+	return c.current().LocalAddr()
 }
 
 // RemoteAddr returns the remote network address.
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.Conn.RemoteAddr()
+	return c.current().RemoteAddr()
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.Conn.SetDeadline(t)
+	return c.current().SetDeadline(t)
 }
 
 // SetReadDeadline sets the read deadline on the connection.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.Conn.SetReadDeadline(t)
+	return c.current().SetReadDeadline(t)
 }
 
 // SetWriteDeadline sets the write deadline on the connection.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.Conn.SetWriteDeadline(t)
+	return c.current().SetWriteDeadline(t)
+}
+
+// Errors of the nXTLS package, for matching with errors.Is without
+// importing it.
+var (
+	ErrHandshakeTimeout          = nxtls.ErrHandshakeTimeout
+	ErrNotHandshaken             = nxtls.ErrNotHandshaken
+	ErrKeyingMaterialUnavailable = nxtls.ErrKeyingMaterialUnavailable
+	ErrAlreadyUpgraded           = nxtls.ErrAlreadyUpgraded
+	ErrSecretExportDisabled      = nxtls.ErrSecretExportDisabled
+)
+
+// ErrUnsupportedNetwork matches, with errors.Is, the errors of operations
+// that the network of the connection does not support, such as socket
+// options that need TCP, and of SCTP on platforms without it.
+var ErrUnsupportedNetwork = errors.New("xtls: unsupported network")
+
+// ErrUnknownFlow matches, with errors.Is, the errors of SetFlowStrict, and
+// of Read, Peek and Write after SetFlow under SetStrictFlow, for flows
+// other than RPRXOrigin and RPRXDirect.
+var ErrUnknownFlow = errors.New("xtls: unknown flow")
+
+// errNotTCP is returned by socket options that need a TCP connection.
+var errNotTCP = fmt.Errorf("%w: underlying connection is not a TCP connection", ErrUnsupportedNetwork)
+
+// errNoFileDescriptor is returned by SyscallConn for transports that are
+// not backed by a file descriptor.
+var errNoFileDescriptor = fmt.Errorf("%w: underlying connection has no file descriptor", ErrUnsupportedNetwork)
+
+// SetLinger sets the SO_LINGER behavior of the underlying TCP connection;
+// see net.TCPConn.SetLinger. SetLinger(0) makes Close discard unsent data
+// and reset the connection instead of sending a FIN. It returns an error if
+// the underlying connection is not TCP.
+func (c *Conn) SetLinger(sec int) error {
+	tc, ok := c.current().NetConn().(interface{ SetLinger(int) error })
+	if !ok {
+		return errNotTCP
+	}
+	return tc.SetLinger(sec)
+}
+
+// SetSocketReadBuffer sets the size of the kernel receive buffer of the
+// underlying TCP connection; see net.TCPConn.SetReadBuffer. Larger buffers
+// help on links with a high bandwidth-delay product. It returns an error
+// if the underlying connection is not TCP.
+func (c *Conn) SetSocketReadBuffer(bytes int) error {
+	tc, ok := c.current().NetConn().(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return errNotTCP
+	}
+	return tc.SetReadBuffer(bytes)
+}
+
+// SetSocketWriteBuffer sets the size of the kernel send buffer of the
+// underlying TCP connection; see net.TCPConn.SetWriteBuffer. It returns an
+// error if the underlying connection is not TCP.
+func (c *Conn) SetSocketWriteBuffer(bytes int) error {
+	tc, ok := c.current().NetConn().(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return errNotTCP
+	}
+	return tc.SetWriteBuffer(bytes)
+}
+
+// SyscallConn returns a raw network connection of the underlying transport,
+// such as a TCP or Unix socket; see net.TCPConn.SyscallConn. Its Control
+// method reaches the file descriptor, for registering it with an event loop
+// or passing it to another process, without unsafe tricks. Reading from or
+// writing to the descriptor directly corrupts the TLS session unless the
+// connection is in Direct mode. It returns an error if the transport is not
+// backed by a file descriptor, as with net.Pipe.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.current().NetConn().(syscall.Conn)
+	if !ok {
+		return nil, errNoFileDescriptor
+	}
+	return sc.SyscallConn()
 }
 
 // Underlying returns the inner nXTLS.Conn for advanced use.
 func (c *Conn) Underlying() *nxtls.Conn {
+	return c.current()
+}
+
+// current returns the nXTLS connection, for methods that use it without
+// holding connMu, since Migrate may replace it.
+func (c *Conn) current() *nxtls.Conn {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
 	return c.Conn
 }
 
 // NewConn creates an XTLS-compatible connection from a net.Conn and config.
 func NewConn(conn net.Conn, config *Config) *Conn {
 	nconn := nxtls.Client(conn, config)
-	return &Conn{
-		Conn: nconn,
-		flow: RPRXOrigin,
+	return track(&Conn{
+		Conn:   nconn,
+		config: config,
+		flow:   RPRXOrigin,
+	})
+}
+
+// NewConnHandshook is like NewConn but completes the handshake before
+// returning, so that the connection can be handed to goroutines that Read
+// and Write concurrently without either of them running it. If the
+// handshake fails, the connection, and with it conn, is closed and the
+// error returned.
+func NewConnHandshook(conn net.Conn, config *Config) (*Conn, error) {
+	c := NewConn(conn, config)
+	if err := c.Handshake(); err != nil {
+		c.Close()
+		return nil, err
 	}
+	return c, nil
 }
 
+// dialContext opens the transport connections of Dial and
+// HTTPDialTLSContext.
+var dialContext = (&net.Dialer{}).DialContext
+
 // Dial creates a client XTLS-compatible connection to the specified address.
+// IPv6 literals may carry a zone, as in "[fe80::1%eth0]:443"; it is passed
+// to the dialer unchanged. Malformed IP literals are rejected up front.
 func Dial(network, addr string, config *Config) (*Conn, error) {
-	conn, err := net.Dial(network, addr)
+	if err := checkDialAddr(network, addr); err != nil {
+		return nil, err
+	}
+	conn, err := dialContext(context.Background(), network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +723,9 @@ func Dial(network, addr string, config *Config) (*Conn, error) {
 
 // DialTimeout is like Dial, but uses a timeout for the connection phase.
 func DialTimeout(network, addr string, timeout time.Duration, config *Config) (*Conn, error) {
+	if err := checkDialAddr(network, addr); err != nil {
+		return nil, err
+	}
 	conn, err := net.DialTimeout(network, addr, timeout)
 	if err != nil {
 		return nil, err
@@ -150,39 +733,543 @@ func DialTimeout(network, addr string, timeout time.Duration, config *Config) (*
 	return NewConn(conn, config), nil
 }
 
+// checkDialAddr reports a malformed IP literal in the host of addr, which
+// net.Dial would otherwise hand to the resolver and fail with an opaque
+// lookup error. Hosts with a colon or a zone must be IPv6 literals, and a
+// zone must be non-empty. Non-IP networks such as "unix" are not checked.
+func checkDialAddr(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	ip, zone, hasZone := strings.Cut(host, "%")
+	if !hasZone && !strings.Contains(host, ":") {
+		return nil // a host name or an IPv4 literal
+	}
+	bad := func(reason string) error {
+		return &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: reason, Addr: addr}}
+	}
+	if net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+		return bad("host is not a valid IPv6 address")
+	}
+	if hasZone && (zone == "" || strings.Contains(zone, "%")) {
+		return bad("malformed IPv6 zone")
+	}
+	if network == "tcp4" || network == "udp4" {
+		return bad("IPv6 address on an IPv4-only network")
+	}
+	return nil
+}
+
+// DialStrategy selects how DialMultipleStrategy tries its addresses.
+type DialStrategy int
+
+const (
+	// DialSequential tries the addresses one at a time, in order.
+	DialSequential DialStrategy = iota
+	// DialParallel tries all addresses at once and keeps the first to
+	// complete a handshake.
+	DialParallel
+)
+
+// MultiDialError is returned by DialMultiple when every address failed.
+type MultiDialError struct {
+	Addrs  []string // the addresses tried
+	Errors []error  // the failure for each address, in the same order
+}
+
+func (e *MultiDialError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "xtls: all %d addresses failed", len(e.Addrs))
+	for i, addr := range e.Addrs {
+		fmt.Fprintf(&b, "; %s: %v", addr, e.Errors[i])
+	}
+	return b.String()
+}
+
+// Is reports whether any of the per-address errors matches target, so that
+// errors.Is looks through a MultiDialError. It stands in for an
+// Unwrap() []error method, which errors.Is only follows from Go 1.20.
+func (e *MultiDialError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first per-address error that matches target, as errors.As
+// does, and sets target to it.
+func (e *MultiDialError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialMultiple connects to the first of addrs that accepts a connection and
+// completes an XTLS handshake, trying them in order, for failover between
+// upstream endpoints. If all fail, the error is a *MultiDialError.
+func DialMultiple(network string, addrs []string, config *Config) (*Conn, error) {
+	return DialMultipleStrategy(network, addrs, config, DialSequential)
+}
+
+// DialMultipleStrategy is like DialMultiple with a choice of strategy.
+func DialMultipleStrategy(network string, addrs []string, config *Config, strategy DialStrategy) (*Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("xtls: DialMultiple called with no addresses")
+	}
+	errs := make([]error, len(addrs))
+	if strategy == DialParallel {
+		type result struct {
+			i    int
+			conn *Conn
+			err  error
+		}
+		results := make(chan result, len(addrs))
+		for i, addr := range addrs {
+			go func(i int, addr string) {
+				conn, err := dialAndHandshake(network, addr, config)
+				results <- result{i, conn, err}
+			}(i, addr)
+		}
+		for pending := len(addrs); pending > 0; pending-- {
+			r := <-results
+			if r.err == nil {
+				// Close the connections of any later winners.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending - 1)
+				return r.conn, nil
+			}
+			errs[r.i] = r.err
+		}
+	} else {
+		for i, addr := range addrs {
+			conn, err := dialAndHandshake(network, addr, config)
+			if err == nil {
+				return conn, nil
+			}
+			errs[i] = err
+		}
+	}
+	return nil, &MultiDialError{Addrs: addrs, Errors: errs}
+}
+
+func dialAndHandshake(network, addr string, config *Config) (*Conn, error) {
+	conn, err := Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialVersionFallback is like Dial followed by Handshake, but if a TLS 1.3
+// handshake is cut off by the network, as by a middlebox that resets
+// connections it does not understand, it redials once with MaxVersion
+// lowered to TLS 1.2, the way browsers used to fall back. Handshakes that
+// fail with a TLS alert from the peer are not retried. The version finally
+// negotiated is reported by ConnectionState().Version.
+//
+// Falling back lets an active attacker force the older version, so use
+// this only where reachability matters more than that risk.
+func DialVersionFallback(network, addr string, config *Config) (*Conn, error) {
+	conn, err := dialAndHandshake(network, addr, config)
+	if err == nil || !isHandshakeReset(err) ||
+		(config != nil && config.MaxVersion != 0 && config.MaxVersion < nxtls.VersionTLS13) {
+		return conn, err
+	}
+	fallback := nxtls.CloneConfig(config)
+	fallback.MaxVersion = nxtls.VersionTLS12
+	return dialAndHandshake(network, addr, fallback)
+}
+
+// isHandshakeReset reports whether a handshake error means the transport
+// was closed or reset under it, rather than the peer sending an alert.
+func isHandshakeReset(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// NewServerConn creates a server-side XTLS-compatible connection from a
+// net.Conn and config.
+func NewServerConn(conn net.Conn, config *Config) *Conn {
+	nconn := nxtls.Server(conn, config)
+	return track(&Conn{
+		Conn:   nconn,
+		config: config,
+		flow:   RPRXOrigin,
+	})
+}
+
+// Rebind reuses the closed connection c for conn, as connection pools in
+// high-churn proxies do to save allocating a new wrapper. c is reset to
+// the state NewConn or NewServerConn gives a new connection, with the same
+// role and Config as before: settings such as SetFlow, SetFlowByALPN,
+// SetStrictFlow, SetReadBufferSize, SetConnState, WithContext and
+// SetPlaintextTap are dropped and the counters start from zero, while the
+// read buffer memory is kept for reuse. The nXTLS connection beneath is
+// new. Rebind returns an error, leaving c untouched, if c has not been
+// closed. Close waits for the goroutines that watch the context and flush
+// coalesced writes, so none of them runs during the reset; c must not be
+// in use by any other goroutine.
+func (c *Conn) Rebind(conn net.Conn) error {
+	c.stateMu.Lock()
+	closed := c.state == http.StateClosed
+	c.stateMu.Unlock()
+	if !closed {
+		return errors.New("xtls: Rebind of a connection that is not closed")
+	}
+	nconn := nxtls.Server(conn, c.config)
+	if c.Conn.IsClient() {
+		nconn = nxtls.Client(conn, c.config)
+	}
+	*c = Conn{
+		Conn:    nconn,
+		config:  c.config,
+		flow:    RPRXOrigin,
+		readBuf: c.readBuf[:0],
+	}
+	track(c)
+	return nil
+}
+
+// connectionAttemptDelay is how long DialHappyEyeballs waits for an attempt
+// before starting the next one. See RFC 8305, Section 5.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// lookupIPAddr resolves host names for DialHappyEyeballs.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// DialHappyEyeballs is like Dial, but resolves both the A and AAAA records
+// of addr's host and races connections to them as described in RFC 8305.
+// IPv6 addresses are tried first, interleaved with IPv4 ones, and a new
+// attempt starts every 250ms or as soon as the previous one fails. The first
+// connection to succeed is wrapped in XTLS; the others are canceled.
+func DialHappyEyeballs(network, addr string, config *Config) (*Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := sortHappyEyeballs(network, ips, port)
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	conn, err := raceDial(network, addrs)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, config), nil
+}
+
+// sortHappyEyeballs returns the dial addresses for ips usable on network,
+// alternating address families and starting with IPv6.
+func sortHappyEyeballs(network string, ips []net.IPAddr, port string) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		hostport := net.JoinHostPort(ip.String(), port)
+		if ip.IP.To4() != nil {
+			if network != "tcp6" {
+				v4 = append(v4, hostport)
+			}
+		} else if network != "tcp4" {
+			v6 = append(v6, hostport)
+		}
+	}
+	addrs := make([]string, 0, len(v4)+len(v6))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			addrs, v6 = append(addrs, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			addrs, v4 = append(addrs, v4[0]), v4[1:]
+		}
+	}
+	return addrs
+}
+
+// raceDial starts staggered connection attempts to addrs and returns the
+// first that succeeds, canceling and closing the rest. If every attempt
+// fails, the first error is returned.
+func raceDial(network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var dialer net.Dialer
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var firstErr error
+	next, pending := 0, 0
+	for next < len(addrs) || pending > 0 {
+		var start <-chan time.Time
+		if next < len(addrs) {
+			start = timer.C
+		}
+		select {
+		case <-start:
+			go func(addr string) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				results <- result{conn, err}
+			}(addrs[next])
+			next++
+			pending++
+			timer.Reset(connectionAttemptDelay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close any loser that connected before noticing the cancel.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// A failed attempt lets the next one start right away.
+			if next < len(addrs) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
 // Listen returns a listener that accepts XTLS-compatible connections.
+// The returned net.Listener is a *Listener.
 func Listen(network, addr string, config *Config) (net.Listener, error) {
+	return ListenXTLS(network, addr, config)
+}
+
+// ListenXTLS is like Listen but returns the *Listener itself, whose
+// AcceptXTLS method yields *Conn without type assertions.
+func ListenXTLS(network, addr string, config *Config) (*Listener, error) {
 	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return &listener{Listener: ln, config: config}, nil
+	return NewListener(ln, config), nil
+}
+
+// NewListener wraps inner so that accepted connections are returned as
+// server-side *xtls.Conn.
+func NewListener(inner net.Listener, config *Config) *Listener {
+	return &Listener{Listener: inner, config: config}
 }
 
-// listener implements net.Listener to wrap accepted connections as *xtls.Conn.
-type listener struct {
+// Listener implements net.Listener to wrap accepted connections as *xtls.Conn.
+type Listener struct {
 	net.Listener
 	config *Config
+
+	// GetConfigForClient, if not nil, selects the Config for a connection
+	// from the SNI in its ClientHello. The choice is made during the
+	// handshake, once the ClientHello has been read. A nil result falls
+	// back to the listener's Config.
+	GetConfigForClient func(sni string) *Config
+
+	dispatchOnce sync.Once
+	dispatch     *Config // hooks GetConfigForClient in; see serverConfig
+
+	limiter acceptLimiter
+	conns   connLimiter
+	latency histogram // time from WrapConn to a completed handshake
+
+	ticketMu       sync.Mutex
+	ticketRotation *ticketKeyRotation // the running RotateSessionTicketKeys rotation
+}
+
+// SetMaxConns caps the number of live connections accepted by the
+// listener at n. Once n connections are open, Accept and AcceptRaw block,
+// or fail with ErrTooManyConns under SetFailWhenFull, until one of them is
+// closed. It may be called at any time; n of zero or less removes the cap.
+// The slot of a connection is freed by the Close of its *Conn; a
+// connection from AcceptRaw that is not passed to WrapConn must be passed
+// to Reject instead.
+func (l *Listener) SetMaxConns(n int) {
+	l.conns.setMax(n)
 }
 
-// Accept returns an XTLS-compatible connection.
-func (l *listener) Accept() (net.Conn, error) {
-	raw, err := l.Listener.Accept()
+// SetFailWhenFull makes Accept and AcceptRaw return ErrTooManyConns
+// instead of blocking when the SetMaxConns limit is reached. It may be
+// called at any time.
+func (l *Listener) SetFailWhenFull(fail bool) {
+	l.conns.setFail(fail)
+}
+
+// Reject closes a connection returned by AcceptRaw that the caller does not
+// pass to WrapConn, freeing its SetMaxConns slot.
+func (l *Listener) Reject(raw net.Conn) error {
+	if l.conns.claim(raw) {
+		l.conns.release()
+	}
+	return raw.Close()
+}
+
+// Close closes the listener, wakes any Accept waiting for a free slot and
+// stops RotateSessionTicketKeys.
+func (l *Listener) Close() error {
+	l.stopTicketRotation()
+	l.conns.close()
+	l.limiter.close()
+	return l.Listener.Close()
+}
+
+// SetAcceptRate caps the listener at perSecond accepted connections per
+// second on average, with bursts of up to burst connections, to blunt
+// connection floods such as active probing. When the limit is reached,
+// Accept and AcceptRaw wait before taking the next connection from the
+// kernel backlog, until Close ends the wait. It may be called at any time
+// to change the limit; a perSecond of zero or less removes it.
+func (l *Listener) SetAcceptRate(perSecond float64, burst int) {
+	l.limiter.set(perSecond, burst)
+}
+
+// Accept returns an XTLS-compatible connection. The net.Conn is a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptXTLS()
 	if err != nil {
 		return nil, err
 	}
-	return NewConn(raw, l.config), nil
+	return c, nil
+}
+
+// AcceptXTLS is like Accept but returns the *Conn, so flow and mode methods
+// are available without a type assertion.
+func (l *Listener) AcceptXTLS() (*Conn, error) {
+	raw, err := l.AcceptRaw()
+	if err != nil {
+		return nil, err
+	}
+	return l.WrapConn(raw), nil
+}
+
+// AcceptRaw waits for the next connection and returns it without XTLS, so
+// the caller can vet it, for example by RemoteAddr, before paying for a
+// handshake. Use WrapConn to continue with XTLS, or Reject to turn the
+// connection away.
+func (l *Listener) AcceptRaw() (net.Conn, error) {
+	tracked, err := l.conns.acquire()
+	if err != nil {
+		return nil, err
+	}
+	// After Close, wait returns at once and Accept reports the closed
+	// listener.
+	l.limiter.wait()
+	c, err := l.Listener.Accept()
+	if !tracked {
+		return c, err
+	}
+	if err != nil {
+		l.conns.track(nil)
+		return nil, err
+	}
+	l.conns.track(c)
+	return c, nil
+}
+
+// WrapConn wraps a connection returned by AcceptRaw as a server-side
+// *xtls.Conn using the listener's configuration.
+func (l *Listener) WrapConn(raw net.Conn) *Conn {
+	c := NewServerConn(raw, l.serverConfig())
+	c.acceptedAt = time.Now()
+	c.acceptLatency = &l.latency
+	if l.conns.claim(raw) {
+		c.slot = &l.conns
+	}
+	return c
+}
+
+// Histogram returns the distribution of the time connections accepted by
+// the listener took from being accepted to completing their handshake,
+// which shows whether a server is bound by handshakes. The clock starts
+// when Accept, AcceptXTLS or WrapConn wraps the connection, so time spent
+// vetting a connection from AcceptRaw is not included. Connections whose
+// handshake fails are not counted.
+func (l *Listener) Histogram() Histogram {
+	return l.latency.snapshot()
+}
+
+// serverConfig returns the Config to hand to a newly accepted connection,
+// hooking GetConfigForClient into the handshake when it is set. The hook
+// lives in a copy of the listener's Config made once, and hands the
+// handshake over to the listener's own Config when no other one is chosen,
+// so that connections share its session ticket keys and see
+// SetSessionTicketKeys and RotateSessionTicketKeys.
+func (l *Listener) serverConfig() *Config {
+	if l.GetConfigForClient == nil {
+		return l.config
+	}
+	l.dispatchOnce.Do(func() {
+		config := l.config.Clone()
+		if config == nil {
+			config = &Config{}
+		}
+		fallback := config.GetConfigForClient
+		config.GetConfigForClient = func(hello *nxtls.ClientHelloInfo) (*Config, error) {
+			if getConfig := l.GetConfigForClient; getConfig != nil {
+				if c := getConfig(hello.ServerName); c != nil {
+					return c, nil
+				}
+			}
+			if fallback != nil {
+				if c, err := fallback(hello); c != nil || err != nil {
+					return c, err
+				}
+			}
+			return l.config, nil
+		}
+		l.dispatch = config
+	})
+	return l.dispatch
 }
 
 // EnableDebug enables debug on the underlying nXTLS.Conn.
 func (c *Conn) EnableDebug(enable bool) {
-	c.Conn.EnableXTLSDebug(enable)
+	c.current().EnableXTLSDebug(enable)
 }
 
 // ConnectionState returns the TLS connection state as crypto/tls.ConnectionState.
 // It maps fields from nXTLS.ConnectionState to crypto/tls.ConnectionState.
 func (c *Conn) ConnectionState() tls.ConnectionState {
-	nc := c.Conn.ConnectionState()
+	nc := c.current().ConnectionState()
 	return toStdConnectionState(nc)
 }
 
@@ -204,27 +1291,76 @@ func toStdConnectionState(nc nxtls.ConnectionState) tls.ConnectionState {
 	}
 }
 
+// RequireALPN completes the handshake and checks that the negotiated ALPN
+// protocol is one of allowed, to enforce a protocol policy such as "h2 or
+// http/1.1 only". Include "" in allowed to accept connections where no
+// protocol was negotiated. If the check fails, the connection is closed
+// and an error is returned.
+func (c *Conn) RequireALPN(allowed ...string) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	proto := c.current().ConnectionState().NegotiatedProtocol
+	for _, p := range allowed {
+		if p == proto {
+			return nil
+		}
+	}
+	c.Close()
+	return fmt.Errorf("xtls: negotiated ALPN protocol %q not in %q", proto, allowed)
+}
+
+// NegotiatedGroup returns the key exchange group selected during the
+// handshake, such as nxtls.X25519, or 0 if there was none or the handshake
+// has not completed.
+func (c *Conn) NegotiatedGroup() nxtls.CurveID {
+	return c.current().ConnectionState().CurveID
+}
+
+// PeerCommonName returns the identity in the peer's verified leaf
+// certificate, for routing by client identity on mTLS servers using
+// ClientAuth set to RequireAndVerifyClientCert or VerifyClientCertIfGiven:
+// the subject common name, or if that is empty the first DNS, email or
+// URI subject alternative name. It returns "" before the handshake has
+// completed, and when the peer sent no certificate or its certificate was
+// not verified, as with RequestClientCert or InsecureSkipVerify.
+func (c *Conn) PeerCommonName() string {
+	state := c.current().ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	leaf := state.PeerCertificates[0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	}
+	return ""
+}
+
 // OCSPResponse returns the stapled OCSP response from the TLS server, if any.
 func (c *Conn) OCSPResponse() []byte {
-	return c.Conn.OCSPResponse()
+	return c.current().OCSPResponse()
 }
 
 // VerifyHostname checks that the peer certificate chain is valid for connecting to the host.
 func (c *Conn) VerifyHostname(host string) error {
-	return c.Conn.VerifyHostname(host)
+	return c.current().VerifyHostname(host)
 }
 
-// ExportKeyingMaterial delegates to nXTLS.ConnectionState if supported.
+// ExportKeyingMaterial returns length bytes of keying material exported as
+// defined in RFC 5705, completing the handshake first if needed.
 func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
-	state := c.Conn.ConnectionState()
-	// Check for method existence, otherwise return error.
-	type ekmIface interface {
-		ExportKeyingMaterial(string, []byte, int) ([]byte, error)
-	}
-	if ekm, ok := interface{}(&state).(ekmIface); ok {
-		return ekm.ExportKeyingMaterial(label, context, length)
+	if err := c.Handshake(); err != nil {
+		return nil, err
 	}
-	return nil, errors.New("xtls: ExportKeyingMaterial not supported in this build")
+	state := c.current().ConnectionState()
+	return state.ExportKeyingMaterial(label, context, length)
 }
 
 // Copy copies between two XTLS conns or any io.Reader/io.Writer, using io.Copy.
@@ -0,0 +1,2477 @@
+package xtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nxtls "github.com/nXTLS/Go"
+	"github.com/nXTLS/Go/xtlstest"
+)
+
+// testCertificate returns a self-signed ECDSA certificate valid for names.
+func testCertificate(t testing.TB, names ...string) nxtls.Certificate {
+	t.Helper()
+	der, key, err := xtlstest.Certificate(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nxtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testPair returns a handshaken client wrapper and server connection over
+// net.Pipe.
+func testPair(t *testing.T) (*Conn, *nxtls.Conn) {
+	t.Helper()
+	return testPairConfig(t, &Config{InsecureSkipVerify: true},
+		&Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+}
+
+// testPairConfig is like testPair with the given client and server configs.
+func testPairConfig(t *testing.T, clientConfig, serverConfig *Config) (*Conn, *nxtls.Conn) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	server := nxtls.Server(c1, serverConfig)
+	client := NewConn(c2, clientConfig)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	if clientErr, serverErr := xtlstest.Handshake(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	return client, server
+}
+
+func TestWriteString(t *testing.T) {
+	client, server := testPair(t)
+
+	go client.WriteString("hello")
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestWriteStringDirectStripsAlert(t *testing.T) {
+	// Alerts are only stripped on TLS 1.2 unless forced.
+	client, server := testPairConfig(t, &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS12},
+		&Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	client.SetFlow(RPRXDirect)
+	server.SetXTLSMode(nxtls.XTLSModeDirect)
+
+	errc := make(chan error, 1)
+	go func() {
+		n, err := client.WriteString("data\x15\x03\x03\x00\x1a")
+		if err == nil && n != 9 {
+			t.Errorf("WriteString returned %d, want 9", n)
+		}
+		errc <- err
+	}()
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "data" {
+		t.Errorf("got %q, want %q", got, "data")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerGetConfigForClient(t *testing.T) {
+	certA := testCertificate(t, "a.test")
+	certB := testCertificate(t, "b.test")
+	configs := map[string]*Config{
+		"a.test": {Certificates: []nxtls.Certificate{certA}},
+		"b.test": {Certificates: []nxtls.Certificate{certB}},
+	}
+
+	ln, err := Listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*Listener).GetConfigForClient = func(sni string) *Config {
+		return configs[sni]
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.(*Conn).Handshake()
+			}()
+		}
+	}()
+
+	for name, cert := range map[string]nxtls.Certificate{"a.test": certA, "b.test": certB} {
+		client, err := Dial("tcp", ln.Addr().String(), &Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		peer := client.ConnectionState().PeerCertificates
+		if len(peer) == 0 || !bytes.Equal(peer[0].Raw, cert.Certificate[0]) {
+			t.Errorf("%s: server presented the wrong certificate", name)
+		}
+		client.Close()
+	}
+}
+
+func TestListenerGetConfigForClientResumes(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	xln := ln.(*Listener)
+	xln.GetConfigForClient = func(sni string) *Config { return nil }
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.(*Conn).Handshake()
+			}()
+		}
+	}()
+
+	// Connections that fall back to the listener's Config share its
+	// automatic ticket keys, so a ticket from the first resumes the second.
+	clientConfig := &Config{
+		ServerName:         "example.test",
+		InsecureSkipVerify: true,
+		MaxVersion:         nxtls.VersionTLS12,
+		ClientSessionCache: nxtls.NewLRUClientSessionCache(1),
+	}
+	for i, want := range []bool{false, true} {
+		client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("handshake %d: %v", i, err)
+		}
+		if got := client.ConnectionState().DidResume; got != want {
+			t.Errorf("handshake %d: DidResume = %t, want %t", i, got, want)
+		}
+		client.Close()
+	}
+}
+
+func TestRecordTracer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	client := NewConn(c2, &Config{InsecureSkipVerify: true})
+
+	type event struct {
+		dir    Direction
+		typ    uint8
+		length int
+	}
+	var events []event
+	client.SetRecordTracer(func(dir Direction, contentType uint8, length int) {
+		events = append(events, event{dir, contentType, length})
+	})
+
+	go func() {
+		buf := make([]byte, 16)
+		n, err := server.Read(buf)
+		if err == nil {
+			server.Write(buf[:n])
+		}
+	}()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if _, err := client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var sawHandshake, sawWrite, sawRead bool
+	for _, e := range events {
+		if e.length <= 0 {
+			t.Errorf("record %+v has no length", e)
+		}
+		switch {
+		case e.typ == 22:
+			sawHandshake = true
+		case e.typ == 23 && e.dir == DirectionWrite:
+			sawWrite = true
+		case e.typ == 23 && e.dir == DirectionRead:
+			sawRead = true
+		}
+	}
+	if !sawHandshake || !sawWrite || !sawRead {
+		t.Errorf("missing records: handshake=%v write=%v read=%v in %+v", sawHandshake, sawWrite, sawRead, events)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	defer func(orig func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = orig }(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host != "dual.test" {
+			t.Errorf("resolved %q, want dual.test", host)
+		}
+		// 192.0.2.1 is reserved for documentation and never answers.
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	conn, err := DialHappyEyeballs("tcp", net.JoinHostPort("dual.test", port), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, ln.Addr())
+	}
+}
+
+func TestSortHappyEyeballs(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+	want := []string{"[2001:db8::1]:443", "192.0.2.1:443", "192.0.2.2:443"}
+	if got := sortHappyEyeballs("tcp", ips, "443"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tcp: got %v, want %v", got, want)
+	}
+	want = []string{"192.0.2.1:443", "192.0.2.2:443"}
+	if got := sortHappyEyeballs("tcp4", ips, "443"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tcp4: got %v, want %v", got, want)
+	}
+}
+
+func TestListenerAcceptRaw(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	xln := ln.(*Listener)
+
+	errc := make(chan error, 1)
+	go func() {
+		raw, err := xln.AcceptRaw()
+		if err != nil {
+			errc <- err
+			return
+		}
+		if _, ok := raw.(*Conn); ok {
+			raw.Close()
+			errc <- errors.New("AcceptRaw returned a wrapped conn")
+			return
+		}
+		host, _, _ := net.SplitHostPort(raw.RemoteAddr().String())
+		if !net.ParseIP(host).IsLoopback() {
+			raw.Close()
+			errc <- fmt.Errorf("unexpected peer %s", raw.RemoteAddr())
+			return
+		}
+		conn := xln.WrapConn(raw)
+		defer conn.Close()
+		errc <- conn.Handshake()
+	}()
+
+	client, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiatedGroup(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	for _, tt := range []struct {
+		name    string
+		version uint16
+		curves  []nxtls.CurveID
+		want    nxtls.CurveID
+	}{
+		{"TLS13-default", VersionTLS13, nil, nxtls.X25519},
+		{"TLS13-P256", VersionTLS13, []nxtls.CurveID{nxtls.CurveP256}, nxtls.CurveP256},
+		{"TLS12-P384", VersionTLS12, []nxtls.CurveID{nxtls.CurveP384}, nxtls.CurveP384},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := testPairConfig(t,
+				&Config{InsecureSkipVerify: true, MaxVersion: tt.version, CurvePreferences: tt.curves},
+				&Config{Certificates: []nxtls.Certificate{cert}})
+			if got := client.NegotiatedGroup(); got != tt.want {
+				t.Errorf("client NegotiatedGroup() = %v, want %v", got, tt.want)
+			}
+			if got := server.ConnectionState().CurveID; got != tt.want {
+				t.Errorf("server CurveID = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	c1, _ := net.Pipe()
+	defer c1.Close()
+	if got := NewConn(c1, &Config{}).NegotiatedGroup(); got != 0 {
+		t.Errorf("NegotiatedGroup() before handshake = %v, want 0", got)
+	}
+}
+
+func TestSetLinger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+
+	conn, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetLinger(0); err != nil {
+		t.Errorf("SetLinger(0) on TCP: %v", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := NewConn(c1, &Config{}).SetLinger(0); err != errNotTCP {
+		t.Errorf("SetLinger(0) on a pipe = %v, want %v", err, errNotTCP)
+	}
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.SetMaxConns(1) // accepted conns stay TCP conns under a cap
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := ln.AcceptXTLS()
+		accepted <- c
+	}()
+
+	conn, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+	for _, c := range []*Conn{conn, server} {
+		if err := c.SetSocketReadBuffer(1 << 20); err != nil {
+			t.Errorf("SetSocketReadBuffer on TCP: %v", err)
+		}
+		if err := c.SetSocketWriteBuffer(1 << 20); err != nil {
+			t.Errorf("SetSocketWriteBuffer on TCP: %v", err)
+		}
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	pipe := NewConn(c1, &Config{})
+	if err := pipe.SetSocketReadBuffer(1 << 20); err != errNotTCP {
+		t.Errorf("SetSocketReadBuffer on a pipe = %v, want %v", err, errNotTCP)
+	}
+	if err := pipe.SetSocketWriteBuffer(1 << 20); err != errNotTCP {
+		t.Errorf("SetSocketWriteBuffer on a pipe = %v, want %v", err, errNotTCP)
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.SetMaxConns(1) // accepted conns stay TCP conns under a cap
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := ln.AcceptXTLS()
+		accepted <- c
+	}()
+
+	conn, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+	for _, c := range []*Conn{conn, server} {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			t.Fatalf("SyscallConn on TCP: %v", err)
+		}
+		var fd uintptr
+		if err := raw.Control(func(s uintptr) { fd = s }); err != nil {
+			t.Fatal(err)
+		}
+		if fd == 0 {
+			t.Error("Control did not see the socket")
+		}
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := NewConn(c1, &Config{}).SyscallConn(); err != errNoFileDescriptor {
+		t.Errorf("SyscallConn on a pipe = %v, want %v", err, errNoFileDescriptor)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	client, server := testPair(t)
+	buf := make([]byte, 64)
+
+	// A few records in Origin mode.
+	for _, msg := range []string{"auth", "ok"} {
+		go client.Write([]byte(msg))
+		n, err := server.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("origin Read = %q, %v, want %q", buf[:n], err, msg)
+		}
+	}
+
+	if err := client.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Upgrade(); err != nxtls.ErrAlreadyUpgraded {
+		t.Errorf("second Upgrade = %v, want %v", err, nxtls.ErrAlreadyUpgraded)
+	}
+	if client.GetFlow() != RPRXDirect {
+		t.Errorf("flow after Upgrade = %q, want %q", client.GetFlow(), RPRXDirect)
+	}
+
+	// The bytes now reach the wire without TLS framing.
+	go client.Write([]byte("bulk"))
+	n, err := io.ReadFull(server.NetConn(), buf[:4])
+	if err != nil || string(buf[:n]) != "bulk" {
+		t.Fatalf("raw Read = %q, %v, want %q", buf[:n], err, "bulk")
+	}
+
+	if err := server.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	go server.Write([]byte("back"))
+	n, err = client.Read(buf)
+	if err != nil || string(buf[:n]) != "back" {
+		t.Fatalf("direct Read = %q, %v, want %q", buf[:n], err, "back")
+	}
+}
+
+func TestSetMaxRecordSize(t *testing.T) {
+	client, server := testPair(t)
+	for _, n := range []int{-1, 511, 16385} {
+		if err := client.SetMaxRecordSize(n); err == nil {
+			t.Errorf("SetMaxRecordSize(%d) succeeded", n)
+		}
+	}
+	if err := client.SetMaxRecordSize(4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// In Direct mode each chunk is a separate write on the carrier, and
+	// net.Pipe never merges writes into a single read.
+	go server.Upgrade()
+	if err := client.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 10000)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Write(data)
+		errc <- err
+	}()
+	buf := make([]byte, len(data))
+	for _, want := range []int{4096, 4096, 1808} {
+		n, err := server.NetConn().Read(buf)
+		if err != nil || n != want {
+			t.Fatalf("chunk = %d bytes, %v, want %d", n, err, want)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpliceFrom(t *testing.T) {
+	client, server := testPair(t)
+	buf := make([]byte, 64)
+
+	go client.Write([]byte("tls"))
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "tls" {
+		t.Fatalf("origin Read = %q, %v, want %q", buf[:n], err, "tls")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if err := client.SpliceFrom([]byte("prebuffered,")); err != nil {
+			errc <- err
+			return
+		}
+		_, err := client.Write([]byte("spliced"))
+		errc <- err
+	}()
+	want := "prebuffered,spliced"
+	n, err = io.ReadFull(server.NetConn(), buf[:len(want)])
+	if err != nil || string(buf[:n]) != want {
+		t.Fatalf("raw Read = %q, %v, want %q", buf[:n], err, want)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SpliceFrom(nil); err != nxtls.ErrAlreadyUpgraded {
+		t.Errorf("second SpliceFrom = %v, want %v", err, nxtls.ErrAlreadyUpgraded)
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	client, _ := testPair(t)
+	if client.Context() != context.Background() {
+		t.Errorf("Context() without WithContext = %v, want context.Background()", client.Context())
+	}
+
+	type traceKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace-1"))
+	client.WithContext(ctx)
+	if got := client.Context().Value(traceKey{}); got != "trace-1" {
+		t.Errorf("Context().Value = %v, want %q", got, "trace-1")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Read after cancel = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read did not unblock when the context was canceled")
+	}
+	if _, err := client.Write([]byte("x")); err != context.Canceled {
+		t.Errorf("Write after cancel = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestListenerSetAcceptRate(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	xln := ln.(*Listener)
+	xln.SetAcceptRate(20, 2)
+
+	const conns = 6
+	for i := 0; i < conns; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	// Two accepts come from the burst and the other four at 20 per second.
+	start := time.Now()
+	for i := 0; i < conns; i++ {
+		c, err := xln.AcceptRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("accepted %d connections in %v, want at least 200ms", conns, elapsed)
+	}
+
+	// Lifting the limit takes effect immediately.
+	xln.SetAcceptRate(0, 0)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start = time.Now()
+	if c, err := xln.AcceptRaw(); err != nil {
+		t.Fatal(err)
+	} else {
+		c.Close()
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("unlimited accept took %v", elapsed)
+	}
+}
+
+func TestListenerCloseWakesRateLimitedAccept(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xln := ln.(*Listener)
+	// The burst is spent by the first accept; the next token is an hour
+	// away.
+	xln.SetAcceptRate(1.0/3600, 1)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c, err := xln.AcceptRaw(); err != nil {
+		t.Fatal(err)
+	} else {
+		c.Close()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := xln.AcceptRaw()
+		errc <- err
+	}()
+	ln.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("AcceptRaw after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake an AcceptRaw waiting on the accept rate")
+	}
+}
+
+func TestRecordSizeJitter(t *testing.T) {
+	client, server := testPair(t)
+	if err := client.SetRecordSizeJitter(100); err == nil {
+		t.Error("SetRecordSizeJitter succeeded without a max record size")
+	}
+	if err := client.SetMaxRecordSize(1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRecordSizeJitter(1024); err == nil {
+		t.Error("SetRecordSizeJitter accepted a jitter as large as the max record size")
+	}
+	if err := client.SetRecordSizeJitter(512); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make(map[int]bool)
+	client.SetRecordTracer(func(dir Direction, contentType uint8, length int) {
+		if dir == DirectionWrite && contentType == 23 {
+			sizes[length] = true
+		}
+	})
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Write(data)
+		errc <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("payload was not reassembled intact")
+	}
+
+	// Each record carries at most 1024 bytes of plaintext plus the AEAD
+	// overhead, and the sizes vary.
+	for size := range sizes {
+		if size > 1024+64 {
+			t.Errorf("record of %d bytes exceeds the max record size", size)
+		}
+	}
+	if len(sizes) < 2 {
+		t.Errorf("record sizes %v do not vary", sizes)
+	}
+}
+
+func TestListenerAcceptXTLS(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var _ net.Listener = ln
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.AcceptXTLS()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetFlow(RPRXDirect)
+		if conn.GetFlow() != RPRXDirect {
+			errc <- fmt.Errorf("flow = %q, want %q", conn.GetFlow(), RPRXDirect)
+			return
+		}
+		errc <- conn.Handshake()
+	}()
+
+	client, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	ln.Close()
+	if c, err := ln.Accept(); err == nil || c != nil {
+		t.Errorf("Accept on a closed listener = %v, %v, want a nil conn and an error", c, err)
+	}
+}
+
+func TestDialMultiple(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.AcceptXTLS()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Handshake()
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	config := &Config{InsecureSkipVerify: true}
+	for _, strategy := range []DialStrategy{DialSequential, DialParallel} {
+		conn, err := DialMultipleStrategy("tcp", []string{deadAddr, ln.Addr().String()}, config, strategy)
+		if err != nil {
+			t.Fatalf("strategy %d: %v", strategy, err)
+		}
+		if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+			t.Errorf("strategy %d: connected to %s, want %s", strategy, got, ln.Addr())
+		}
+		conn.Close()
+	}
+
+	_, err = DialMultiple("tcp", []string{deadAddr, deadAddr}, config)
+	var multiErr *MultiDialError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 2 || multiErr.Errors[0] == nil || multiErr.Errors[1] == nil {
+		t.Errorf("DialMultiple to dead addresses = %v, want a MultiDialError with two errors", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Errorf("errors.As(%v, *net.OpError) did not find the dial error", err)
+	}
+	if !errors.Is(err, multiErr.Errors[1]) {
+		t.Error("errors.Is does not match a per-address error")
+	}
+}
+
+func TestConnRole(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := ln.AcceptXTLS()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	defer server.Close()
+
+	if !dialed.IsClient() || dialed.IsServer() {
+		t.Errorf("dialed conn: IsClient = %v, IsServer = %v", dialed.IsClient(), dialed.IsServer())
+	}
+	if server.IsClient() || !server.IsServer() {
+		t.Errorf("accepted conn: IsClient = %v, IsServer = %v", server.IsClient(), server.IsServer())
+	}
+}
+
+func TestRequireALPN(t *testing.T) {
+	serverConfig := &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		NextProtos:   []string{"h2", "spdy/3"},
+	}
+
+	client, _ := testPairConfig(t, &Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}, serverConfig)
+	if err := client.RequireALPN("h2", "http/1.1"); err != nil {
+		t.Errorf("RequireALPN with h2 negotiated: %v", err)
+	}
+
+	client, server := testPairConfig(t, &Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3"}}, serverConfig)
+	eof := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		eof <- err
+	}()
+	if err := client.RequireALPN("h2", "http/1.1"); err == nil {
+		t.Error("RequireALPN accepted spdy/3")
+	}
+	if err := <-eof; err != io.EOF {
+		t.Errorf("peer Read = %v, want io.EOF after the rejection", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("Write succeeded on a rejected connection")
+	}
+}
+
+func TestListenerSetMaxConns(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.SetMaxConns(1)
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first, err := ln.AcceptXTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.AcceptRaw()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("Accept did not wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close() // the *Conn frees its slot
+	var second net.Conn
+	select {
+	case second = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("closing a connection did not free its slot")
+	}
+
+	ln.SetFailWhenFull(true)
+	if _, err := ln.AcceptRaw(); err != ErrTooManyConns {
+		t.Errorf("AcceptRaw when full = %v, want %v", err, ErrTooManyConns)
+	}
+	if _, ok := second.(*net.TCPConn); !ok {
+		t.Errorf("AcceptRaw under a cap returned a %T, want *net.TCPConn", second)
+	}
+	ln.Reject(second) // so does Reject for a raw conn
+	third, err := ln.AcceptRaw()
+	if err != nil {
+		t.Fatalf("AcceptRaw after a slot freed up: %v", err)
+	}
+	ln.Reject(third)
+}
+
+func TestDialVersionFallback(t *testing.T) {
+	var attempts int32
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		// Play a middlebox that resets any connection offering TLS 1.3.
+		GetConfigForClient: func(chi *nxtls.ClientHelloInfo) (*Config, error) {
+			atomic.AddInt32(&attempts, 1)
+			for _, v := range chi.SupportedVersions {
+				if v == nxtls.VersionTLS13 {
+					chi.Conn.(*net.TCPConn).SetLinger(0)
+					chi.Conn.Close()
+					return nil, errors.New("reset")
+				}
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the server side, so that its Close is not counted by the
+	// Stats of a later test.
+	var served sync.WaitGroup
+	defer served.Wait()
+	defer ln.Close()
+	served.Add(1)
+	go func() {
+		defer served.Done()
+		for {
+			conn, err := ln.AcceptXTLS()
+			if err != nil {
+				return
+			}
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				conn.Handshake()
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	conn, err := DialVersionFallback("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := conn.ConnectionState().Version; v != nxtls.VersionTLS12 {
+		t.Errorf("negotiated version %x, want TLS 1.2", v)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("%d handshake attempts, want 2", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	before := Stats()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := NewServerConn(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	client := NewConn(c2, &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS12}) // so the alert below is stripped
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, err := client.Write([]byte("hello"))
+		errc <- err
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	client.SetFlow(RPRXDirect)
+	server.SetFlow(RPRXDirect)
+	go func() {
+		_, err := client.Write([]byte{'x', 0x15, 0x03, 0x03, 0x00, 0x1a})
+		errc <- err
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	s := Stats()
+	if d := s.TotalConns - before.TotalConns; d != 2 {
+		t.Errorf("TotalConns grew by %d, want 2", d)
+	}
+	if d := s.ActiveConns - before.ActiveConns; d != 2 {
+		t.Errorf("ActiveConns grew by %d, want 2", d)
+	}
+	if d := s.BytesOut - before.BytesOut; d != 11 {
+		t.Errorf("BytesOut grew by %d, want 11", d)
+	}
+	if d := s.BytesIn - before.BytesIn; d != 6 {
+		t.Errorf("BytesIn grew by %d, want 6", d)
+	}
+
+	// Close the pipe first so that close_notify does not block.
+	c1.Close()
+	c2.Close()
+	client.Close()
+	server.Close()
+	client.Close()
+	after := Stats()
+	if after.ActiveConns != before.ActiveConns {
+		t.Errorf("ActiveConns = %d after Close, want %d", after.ActiveConns, before.ActiveConns)
+	}
+	if after.BytesOut != s.BytesOut || after.BytesIn != s.BytesIn {
+		t.Errorf("byte counts changed on Close: %+v, want %+v", after, s)
+	}
+	if d := after.AlertsStripped - before.AlertsStripped; d != 1 {
+		t.Errorf("AlertsStripped grew by %d, want 1", d)
+	}
+
+	// A conn that fell back to the Origin fallback logic counts once closed.
+	before = Stats()
+	fallback, peer := testPair(t)
+	fallback.SetOriginSignature([]byte("other"))
+	go peer.Write([]byte("hello"))
+	if _, err := io.ReadFull(fallback, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, peer)
+	fallback.Close()
+	if d := Stats().Fallbacks - before.Fallbacks; d != 1 {
+		t.Errorf("Fallbacks grew by %d, want 1", d)
+	}
+}
+
+func TestFlowByALPN(t *testing.T) {
+	flows := map[string]string{"h2": RPRXDirect, "bulk": RPRXDirect, "control": RPRXOrigin}
+	serverConfig := &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		NextProtos:   []string{"h2", "bulk", "control", "other"},
+	}
+	for _, tt := range []struct {
+		proto, flow string
+	}{
+		{"h2", RPRXDirect},
+		{"bulk", RPRXDirect},
+		{"control", RPRXOrigin},
+		{"other", RPRXOrigin},
+	} {
+		c1, c2 := net.Pipe()
+		server := NewServerConn(c1, serverConfig)
+		server.SetFlowByALPN(flows)
+		client := NewConn(c2, &Config{InsecureSkipVerify: true, NextProtos: []string{tt.proto}})
+		client.SetFlowByALPN(flows)
+		errc := make(chan error, 1)
+		go func() { errc <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if got := client.GetFlow(); got != tt.flow {
+			t.Errorf("%s: client flow = %q, want %q", tt.proto, got, tt.flow)
+		}
+		if got := server.GetFlow(); got != tt.flow {
+			t.Errorf("%s: server flow = %q, want %q", tt.proto, got, tt.flow)
+		}
+
+		go client.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%s: server read %q, %v", tt.proto, buf, err)
+		}
+		c1.Close()
+		c2.Close()
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestFlowByALPNConcurrentHandshake(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	server := NewServerConn(c1, &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		NextProtos:   []string{"bulk"},
+	})
+	client := NewConn(c2, &Config{InsecureSkipVerify: true, NextProtos: []string{"bulk"}})
+	client.SetFlowByALPN(map[string]string{"bulk": RPRXDirect})
+	defer client.Close()
+	defer server.Close()
+	go server.Handshake()
+
+	// The handshake runs from whichever of Read and Write gets there
+	// first, while GetFlow polls the flow it switches.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for client.GetFlow() != RPRXDirect {
+			runtime.Gosched()
+		}
+	}()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if mode := client.Conn.GetXTLSMode(); mode != nxtls.XTLSModeDirect {
+		t.Errorf("mode = %v, want Direct", mode)
+	}
+	c1.Close()
+	c2.Close()
+	<-readErr
+}
+
+func TestWriteMetrics(t *testing.T) {
+	client, _ := testPair(t)
+	client.NetConn().Close() // so that close_notify does not block
+	client.Close()
+
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			types[f[2]] = f[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed line %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+
+	s := Stats()
+	if got := values["xtls_connections_total"]; got != float64(s.TotalConns) || got < 1 {
+		t.Errorf("xtls_connections_total = %v, want %d", got, s.TotalConns)
+	}
+	if types["xtls_connections_active"] != "gauge" || types["xtls_alerts_stripped_total"] != "counter" {
+		t.Errorf("wrong metric types: %v", types)
+	}
+	if _, ok := values["xtls_alerts_stripped_total"]; !ok {
+		t.Error("xtls_alerts_stripped_total missing")
+	}
+
+	const h = "xtls_handshake_duration_seconds"
+	if types[h] != "histogram" {
+		t.Errorf("%s has type %q, want histogram", h, types[h])
+	}
+	count := values[h+"_count"]
+	if count < 1 || values[h+`_bucket{le="+Inf"}`] != count {
+		t.Errorf("%s_count = %v, +Inf bucket = %v", h, count, values[h+`_bucket{le="+Inf"}`])
+	}
+	prev := 0.0
+	for _, le := range handshakeBuckets {
+		v, ok := values[fmt.Sprintf("%s_bucket{le=%q}", h, strconv.FormatFloat(le, 'g', -1, 64))]
+		if !ok || v < prev || v > count {
+			t.Errorf("bucket le=%v = %v, previous %v, count %v", le, v, prev, count)
+		}
+		prev = v
+	}
+	if values[h+"_sum"] <= 0 {
+		t.Errorf("%s_sum = %v, want > 0", h, values[h+"_sum"])
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	client, server := testPair(t)
+	if err := client.SetReadBufferSize(64); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetReadBufferSize(-1); err == nil {
+		t.Error("SetReadBufferSize accepted a negative size")
+	}
+
+	const msg = "first line\nsecond line\n"
+	go server.Write([]byte(msg))
+
+	peeked, err := client.Peek(5)
+	if err != nil || string(peeked) != "first" {
+		t.Fatalf("Peek(5) = %q, %v, want %q", peeked, err, "first")
+	}
+	if _, err := client.Peek(65); err == nil {
+		t.Error("Peek beyond the buffer size succeeded")
+	}
+
+	// Once the data is buffered, an expired deadline does not hide it.
+	if err := client.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	buf := make([]byte, 4)
+	for len(got) < len(msg) {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Read after %q: %v", got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != msg {
+		t.Errorf("read %q, want %q", got, msg)
+	}
+	var netErr net.Error
+	if _, err := client.Read(buf); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Read with an empty buffer past the deadline = %v, want a timeout", err)
+	}
+
+	// The connection keeps working once the deadline is cleared.
+	client.SetReadDeadline(time.Time{})
+	go server.Write([]byte("more"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "more" {
+		t.Errorf("Read after clearing the deadline = %q, %v", buf, err)
+	}
+	if in := atomic.LoadUint64(&client.bytesIn); in != uint64(len(msg)+4) {
+		t.Errorf("bytes in = %d, want %d", in, len(msg)+4)
+	}
+}
+
+// countingConn counts the reads that reach the transport.
+type countingConn struct {
+	net.Conn
+	reads int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+// BenchmarkSmallReads reads a Direct-mode stream 16 bytes at a time and
+// reports the transport reads per 16-byte Read, with and without a read
+// buffer.
+func BenchmarkSmallReads(b *testing.B) {
+	for _, size := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			transport := &countingConn{Conn: c2}
+			server := nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(b, "example.test")}})
+			client := NewConn(transport, &Config{InsecureSkipVerify: true})
+			errc := make(chan error, 1)
+			go func() { errc <- server.Handshake() }()
+			if err := client.Handshake(); err != nil {
+				b.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				b.Fatal(err)
+			}
+			client.SetFlow(RPRXDirect)
+			server.SetXTLSMode(nxtls.XTLSModeDirect)
+			client.SetReadBufferSize(size)
+
+			go func() {
+				chunk := make([]byte, 16*1024)
+				for left := 16 * b.N; left > 0; left -= len(chunk) {
+					if left < len(chunk) {
+						chunk = chunk[:left]
+					}
+					if _, err := server.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, 16)
+			start := atomic.LoadInt64(&transport.reads)
+			b.SetBytes(16)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.ReadFull(client, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&transport.reads)-start)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := NewConn(c2, &Config{InsecureSkipVerify: true})
+	if got := conn.NetConn(); got != c2 {
+		t.Errorf("NetConn() = %v, want the transport %v", got, c2)
+	}
+}
+
+func TestErrorSentinels(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := NewConn(c1, &Config{InsecureSkipVerify: true})
+	if err := conn.SetLinger(0); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Errorf("SetLinger on a pipe = %v, want ErrUnsupportedNetwork", err)
+	}
+	if _, err := sctpTCPNetwork("tcp"); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Errorf("sctpTCPNetwork(tcp) = %v, want ErrUnsupportedNetwork", err)
+	}
+
+	// The peer never answers, so the handshake runs into the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	conn.WithContext(ctx)
+	if err := conn.Handshake(); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("Handshake past the context deadline = %v, want ErrHandshakeTimeout", err)
+	}
+}
+
+// gatedConn hands every write deadline set on it to the test, and holds
+// the caller until the test has taken it, so a test can step a writer
+// through its chunks.
+type gatedConn struct {
+	net.Conn
+	deadlines chan time.Time
+}
+
+func (c *gatedConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines <- t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestSetProgressDeadline(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	const chunks = 10
+	data := make([]byte, chunks*16384)
+
+	// Each chunk moves the write deadline to idle past the time it is
+	// sent, so a Write that keeps making progress outlasts idle.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	transport := &gatedConn{Conn: c2, deadlines: make(chan time.Time)}
+	client := NewConn(transport, &Config{InsecureSkipVerify: true})
+	go server.Handshake()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, server)
+
+	client.SetProgressDeadline(idle)
+	errc := make(chan error, 1)
+	go func() {
+		n, err := client.Write(data)
+		if err == nil && n != len(data) {
+			err = fmt.Errorf("wrote %d bytes", n)
+		}
+		errc <- err
+	}()
+	// The writer computes each deadline after the previous SetWriteDeadline
+	// was let through, so it is at least idle past the moment the test
+	// started letting it through.
+	var released time.Time
+	for i := 0; i < chunks; i++ {
+		before := time.Now()
+		d := <-transport.deadlines
+		if d.Before(released.Add(idle)) {
+			t.Errorf("chunk %d: write deadline %v, want at least idle after the previous chunk was let through", i, d)
+		}
+		released = before
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("steady Write: %v", err)
+	}
+
+	// A reader that stops makes Write fail once idle passes.
+	client, stalled := testPair(t)
+	client.SetProgressDeadline(idle)
+	go func() {
+		buf := make([]byte, 16384)
+		io.ReadFull(stalled, buf)
+	}()
+	n, err := client.Write(data)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("stalled Write = %d, %v, want a timeout", n, err)
+	}
+	if n < 16384 || n >= len(data) {
+		t.Errorf("stalled Write sent %d bytes, want the first chunk but not all", n)
+	}
+}
+
+func TestPlaintextTap(t *testing.T) {
+	client, server := testPair(t)
+	var tap bytes.Buffer
+	client.SetPlaintextTap(&tap)
+
+	// send writes data to w and waits until it has come out of r and the
+	// Write has returned, so its frame is on the tap.
+	send := func(w io.Writer, r io.Reader, data string) {
+		t.Helper()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte(data))
+			errc <- err
+		}()
+		if _, err := io.ReadFull(r, make([]byte, len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(client, server, "hello")
+	send(server, client, "world!")
+	client.SetPlaintextTap(nil)
+	send(client, server, "untapped")
+
+	type frame struct {
+		dir  Direction
+		data string
+	}
+	var got []frame
+	for b := tap.Bytes(); len(b) > 0; {
+		if len(b) < 5 {
+			t.Fatalf("truncated frame header %x", b)
+		}
+		n := int(b[1])<<24 | int(b[2])<<16 | int(b[3])<<8 | int(b[4])
+		if len(b) < 5+n {
+			t.Fatalf("frame of %d bytes has only %d", n, len(b)-5)
+		}
+		got = append(got, frame{Direction(b[0]), string(b[5 : 5+n])})
+		b = b[5+n:]
+	}
+	want := []frame{{DirectionWrite, "hello"}, {DirectionRead, "world!"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tapped frames = %+v, want %+v", got, want)
+	}
+}
+
+func TestDialIPv6Zone(t *testing.T) {
+	defer func(orig func(context.Context, string, string) (net.Conn, error)) { dialContext = orig }(dialContext)
+	var dialed []string
+	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+
+	for _, addr := range []string{"[fe80::1%eth0]:443", "[fe80::1%25]:443", "[::1]:443", "example.test:443", "192.0.2.1:443"} {
+		dialed = nil
+		conn, err := Dial("tcp", addr, &Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Dial(%q): %v", addr, err)
+			continue
+		}
+		conn.Close()
+		if len(dialed) != 1 || dialed[0] != addr {
+			t.Errorf("Dial(%q) dialed %q", addr, dialed)
+		}
+	}
+
+	for _, tt := range []struct{ network, addr string }{
+		{"tcp", "[fe80::1%]:443"},
+		{"tcp", "[fe80::zz%eth0]:443"},
+		{"tcp", "[fe80::1%eth0%1]:443"},
+		{"tcp", "[1.2.3.4%eth0]:443"},
+		{"tcp4", "[fe80::1%eth0]:443"},
+		{"tcp", "fe80::1:443"},
+	} {
+		dialed = nil
+		_, err := Dial(tt.network, tt.addr, nil)
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) {
+			t.Errorf("Dial(%q, %q) = %v, want an address error", tt.network, tt.addr, err)
+		}
+		if dialed != nil {
+			t.Errorf("Dial(%q, %q) dialed %q", tt.network, tt.addr, dialed)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	serverConfig := &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}}
+	clientConfig := &Config{
+		ServerName:         "example.test",
+		InsecureSkipVerify: true,
+		ClientSessionCache: nxtls.NewLRUClientSessionCache(1),
+	}
+	client, server := testPairConfig(t, clientConfig, serverConfig)
+
+	// echo answers one message on server, which lets the client pick up
+	// the TLS 1.3 session ticket sent after the handshake.
+	echo := func(server io.ReadWriter, msg string) {
+		t.Helper()
+		go func() {
+			buf := make([]byte, len(msg))
+			io.ReadFull(server, buf)
+			server.Write(buf)
+		}()
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo = %q, %v, want %q", buf, err, msg)
+		}
+	}
+	echo(server, "before")
+	oldInner := client.NetConn()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	newServer := nxtls.Server(c1, serverConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- newServer.Handshake() }()
+	if err := client.Migrate(c2); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	if !client.ConnectionState().DidResume || !newServer.ConnectionState().DidResume {
+		t.Error("migration handshake did not resume the session")
+	}
+	if client.NetConn() != c2 {
+		t.Error("NetConn is not the new transport after Migrate")
+	}
+	if _, err := oldInner.Write([]byte("x")); err == nil {
+		t.Error("old transport still open after Migrate")
+	}
+	echo(newServer, "after")
+
+	// A Read in progress keeps the transport in place.
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		readDone <- err
+	}()
+	for client.connMu.TryLock() {
+		client.connMu.Unlock()
+		runtime.Gosched()
+	}
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	go nxtls.Server(c3, serverConfig).Handshake()
+	if err := client.Migrate(c4); err != ErrConnBusy {
+		t.Errorf("Migrate during a Read = %v, want ErrConnBusy", err)
+	}
+	if client.NetConn() != c2 {
+		t.Error("a failed Migrate replaced the transport")
+	}
+	newServer.Write([]byte("x"))
+	if err := <-readDone; err != nil {
+		t.Errorf("Read after a failed Migrate: %v", err)
+	}
+
+	// Without a cached session the server does a full handshake.
+	client, _ = testPairConfig(t, &Config{InsecureSkipVerify: true, ClientSessionCache: nxtls.NewLRUClientSessionCache(1)}, serverConfig)
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	go nxtls.Server(c1, serverConfig).Handshake()
+	if err := client.Migrate(c2); err != ErrNotResumed {
+		t.Errorf("Migrate without a ticket = %v, want ErrNotResumed", err)
+	}
+
+	// A connection without a session cache cannot migrate at all.
+	client, _ = testPair(t)
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	if err := client.Migrate(c2); err == nil {
+		t.Error("Migrate without a ClientSessionCache succeeded")
+	}
+}
+
+func TestMigrateConcurrent(t *testing.T) {
+	serverConfig := &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}}
+	clientConfig := &Config{
+		ServerName:         "example.test",
+		InsecureSkipVerify: true,
+		ClientSessionCache: nxtls.NewLRUClientSessionCache(1),
+	}
+	client, server := testPairConfig(t, clientConfig, serverConfig)
+	go io.Copy(server, server)
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Methods running alongside Migrate either make it fail with
+	// ErrConnBusy or wait for it; the race detector checks that none of
+	// them sees the transport while it is replaced.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, f := range []func() error{
+		func() error { _, err := client.Peek(0); return err },
+		client.Handshake,
+		func() error {
+			client.ConnectionState()
+			client.LocalAddr()
+			return client.SetDeadline(time.Time{})
+		},
+	} {
+		wg.Add(1)
+		go func(f func() error) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := f(); err != nil {
+					t.Error(err)
+					return
+				}
+				runtime.Gosched()
+			}
+		}(f)
+	}
+	migrated := false
+	for i := 0; i < 100 && !migrated; i++ {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go nxtls.Server(c1, serverConfig).Handshake()
+		switch err := client.Migrate(c2); err {
+		case nil:
+			migrated = true
+		case ErrConnBusy:
+		default:
+			t.Errorf("Migrate: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if !migrated {
+		t.Error("Migrate never found the connection idle")
+	}
+}
+
+func TestListenerHistogram(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const conns = 4
+	errc := make(chan error, conns)
+	go func() {
+		for i := 0; i < conns; i++ {
+			c, err := ln.AcceptXTLS()
+			if err != nil {
+				errc <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				errc <- c.Handshake()
+			}()
+		}
+	}()
+	for i := 0; i < conns; i++ {
+		c, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	for i := 0; i < conns; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := ln.Histogram()
+	if h.Count != conns {
+		t.Errorf("Histogram().Count = %d, want %d", h.Count, conns)
+	}
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	if total != conns || len(h.Counts) != len(h.Bounds)+1 {
+		t.Errorf("Histogram() buckets %v over bounds %v, want %d observations", h.Counts, h.Bounds, conns)
+	}
+	if h.Sum <= 0 {
+		t.Errorf("Histogram().Sum = %v, want a positive total", h.Sum)
+	}
+}
+
+func TestPeerCommonName(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client-42"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := nxtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+		ClientAuth:   nxtls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		for {
+			c, err := ln.AcceptXTLS()
+			if err != nil {
+				return
+			}
+			err = c.Handshake()
+			results <- result{c.PeerCommonName(), err}
+			c.Close()
+		}
+	}()
+
+	client, err := Dial("tcp", ln.Addr().String(), &Config{
+		InsecureSkipVerify: true,
+		Certificates:       []nxtls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r.err != nil || r.name != "client-42" {
+		t.Errorf("server saw peer %q, %v, want %q", r.name, r.err, "client-42")
+	}
+	if name := client.PeerCommonName(); name != "" {
+		t.Errorf("client with InsecureSkipVerify reports peer %q, want none", name)
+	}
+
+	// Without a client certificate the server refuses the handshake.
+	anon, err := Dial("tcp", ln.Addr().String(), &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	anon.Handshake()
+	anon.Read(make([]byte, 1))
+	if r := <-results; r.err == nil || r.name != "" {
+		t.Errorf("server accepted a client without a certificate as %q", r.name)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	serverConfig := &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}}
+	client, oldServer := testPairConfig(t, &Config{InsecureSkipVerify: true}, serverConfig)
+	if err := client.SetReadBufferSize(4096); err != nil {
+		t.Fatal(err)
+	}
+	// A context watcher and a coalescing timer must be done with c
+	// before Rebind resets it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.WithContext(ctx)
+	if err := client.SetWriteCoalescing(time.Millisecond, 1024); err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(oldServer, make([]byte, 4))
+	if _, err := client.Write([]byte("held")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetFlow(RPRXDirect)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := client.Rebind(c2); err == nil {
+		t.Fatal("Rebind of an open connection succeeded")
+	}
+	oldServer.NetConn().Close()
+	client.Close()
+	active := Stats().ActiveConns
+	if err := client.Rebind(c2); err != nil {
+		t.Fatalf("Rebind after Close: %v", err)
+	}
+	if got := Stats().ActiveConns; got != active+1 {
+		t.Errorf("ActiveConns after Rebind = %d, want %d", got, active+1)
+	}
+	if client.GetFlow() != RPRXOrigin || client.readSize != 0 || client.NetConn() != c2 {
+		t.Errorf("Rebind kept old state: flow %q, read buffer %d", client.GetFlow(), client.readSize)
+	}
+	cancel() // the old context no longer reaches the connection
+
+	server := nxtls.Server(c1, serverConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake after Rebind: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(server, make([]byte, 5))
+	if _, err := client.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&client.bytesOut); n != 5 {
+		t.Errorf("bytes written after Rebind = %d, want 5", n)
+	}
+	c1.Close()
+	client.Close()
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		spec, network, addr, flow, sni string
+		alpn                           []string
+		insecure                       bool
+	}{
+		{"xtls://example.com:443", "tcp", "example.com:443", RPRXOrigin, "example.com", nil, false},
+		{"xtls://example.com:443/?flow=xtls-rprx-direct&sni=front.test&alpn=h2,http/1.1",
+			"tcp", "example.com:443", RPRXDirect, "front.test", []string{"h2", "http/1.1"}, false},
+		{"xtls://192.0.2.1:8443?insecure=true&network=tcp4", "tcp4", "192.0.2.1:8443", RPRXOrigin, "", nil, true},
+		{"xtls://[2001:db8::1]:443?sni=example.com", "tcp", "[2001:db8::1]:443", RPRXOrigin, "example.com", nil, false},
+		{"xtls://[fe80::1%25eth0]:443", "tcp", "[fe80::1%eth0]:443", RPRXOrigin, "", nil, false},
+	} {
+		network, addr, config, flow, err := ParseEndpoint(tt.spec)
+		if err != nil {
+			t.Errorf("ParseEndpoint(%q): %v", tt.spec, err)
+			continue
+		}
+		if network != tt.network || addr != tt.addr || flow != tt.flow {
+			t.Errorf("ParseEndpoint(%q) = %q, %q, flow %q, want %q, %q, flow %q", tt.spec, network, addr, flow, tt.network, tt.addr, tt.flow)
+		}
+		if config.ServerName != tt.sni || !reflect.DeepEqual(config.NextProtos, tt.alpn) || config.InsecureSkipVerify != tt.insecure {
+			t.Errorf("ParseEndpoint(%q) config: sni %q, alpn %q, insecure %v", tt.spec, config.ServerName, config.NextProtos, config.InsecureSkipVerify)
+		}
+	}
+
+	for _, tt := range []struct{ spec, wantErr string }{
+		{"xtls://example.com:443?flow=xtls-rprx-vision", `unknown flow "xtls-rprx-vision"`},
+		{"xtls://example.com:443?flow=direct", `unknown flow "direct"`},
+		{"https://example.com:443", `scheme "https" is not xtls`},
+		{"xtls://example.com", `invalid or missing port ""`},
+		{"xtls://example.com:99999", `invalid or missing port "99999"`},
+		{"xtls://:443", "missing host"},
+		{"xtls://example.com:443/path", "only a host, port and query are allowed"},
+		{"xtls://user@example.com:443", "only a host, port and query are allowed"},
+		{"xtls://example.com:443?sni=a&sni=b", `parameter "sni" given 2 times`},
+		{"xtls://example.com:443?alpn=h2,,http/1.1", "empty protocol"},
+		{"xtls://example.com:443?insecure=maybe", "not a boolean"},
+		{"xtls://example.com:443?network=udp", `unsupported network "udp"`},
+		{"xtls://example.com:443?sin=example.com", `unknown parameter "sin"`},
+		{"xtls://example.com:443?sni=%zz", "invalid URL escape"},
+		{"xtls://[fe80::zz]:443", "invalid host"},
+		{"xtls://[::1]:443?network=tcp4", "IPv4-only network"},
+		{"xtls://exa mple.com:443", "invalid character"},
+	} {
+		_, _, config, _, err := ParseEndpoint(tt.spec)
+		if err == nil || config != nil {
+			t.Errorf("ParseEndpoint(%q) succeeded, want an error containing %q", tt.spec, tt.wantErr)
+		} else if !strings.Contains(err.Error(), tt.wantErr) || !strings.HasPrefix(err.Error(), "xtls: endpoint ") {
+			t.Errorf("ParseEndpoint(%q) = %v, want an error containing %q", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	client, server := testPair(t)
+	var records int32
+	client.SetRecordTracer(func(dir Direction, contentType uint8, length int) {
+		if dir == DirectionWrite && contentType == 23 {
+			atomic.AddInt32(&records, 1)
+		}
+	})
+	if err := client.SetWriteCoalescing(time.Second, maxRecordSize+1); err == nil {
+		t.Error("SetWriteCoalescing accepted a size above 16384")
+	}
+
+	reads := make(chan string, 8)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				close(reads)
+				return
+			}
+			reads <- string(buf[:n])
+		}
+	}()
+	expect := func(what, want string, within time.Duration) {
+		t.Helper()
+		select {
+		case got := <-reads:
+			if got != want {
+				t.Fatalf("%s: read %q, want %q", what, got, want)
+			}
+		case <-time.After(within):
+			t.Fatalf("%s: nothing read after %v", what, within)
+		}
+	}
+	write := func(s string) {
+		t.Helper()
+		if n, err := client.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+
+	// Small writes go out together once the delay passes.
+	if err := client.SetWriteCoalescing(50*time.Millisecond, 16); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	write("a")
+	write("b")
+	write("c")
+	expect("timer", "abc", 5*time.Second)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("held bytes sent after %v, before the delay", d)
+	}
+
+	// Reaching maxBytes sends at once; a write that does not fit sends the
+	// held bytes first.
+	if err := client.SetWriteCoalescing(time.Hour, 16); err != nil {
+		t.Fatal(err)
+	}
+	write("0123456789")
+	write("abcdef")
+	expect("maxBytes", "0123456789abcdef", 5*time.Second)
+	write("held")
+	write("0123456789abcdef0123")
+	expect("overflow", "held", 5*time.Second)
+	expect("large write", "0123456789abcdef0123", 5*time.Second)
+
+	// Flush and Close send what is held.
+	write("flush")
+	select {
+	case got := <-reads:
+		t.Fatalf("read %q before Flush", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect("Flush", "flush", 5*time.Second)
+	// Flush returns after its record is traced, so all five are counted.
+	if n := atomic.LoadInt32(&records); n != 5 {
+		t.Errorf("sent %d records, want 5", n)
+	}
+	write("close")
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect("Close", "close", 5*time.Second)
+}
+
+func TestFlush(t *testing.T) {
+	client, server := testPair(t)
+	if err := client.Flush(); err != nil {
+		t.Fatalf("Flush with nothing held: %v", err)
+	}
+
+	// Bytes held by coalescing and records held by write buffering both go
+	// out, in order.
+	if err := client.SetWriteCoalescing(time.Hour, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetWriteBuffering(true); err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("request"))
+	if n := client.Buffered(); n != 0 {
+		t.Errorf("Buffered() = %d before Flush, want the bytes still coalesced", n)
+	}
+	client.SetWriteCoalescing(0, 0) // sends into the record buffer
+	if client.Buffered() == 0 {
+		t.Fatal("record not held by write buffering")
+	}
+	client.SetWriteCoalescing(time.Hour, 1024)
+	client.Write([]byte(" body"))
+
+	errc := make(chan error, 1)
+	go func() { errc <- client.Flush() }()
+	buf := make([]byte, 32)
+	var got []byte
+	for len(got) < len("request body") {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "request body" {
+		t.Errorf("read %q, want %q", got, "request body")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := client.Buffered(); n != 0 {
+		t.Errorf("Buffered() = %d after Flush, want 0", n)
+	}
+
+	// Write errors surface from Flush.
+	client.Write([]byte("lost"))
+	client.NetConn().Close()
+	if err := client.Flush(); err == nil {
+		t.Error("Flush on a closed transport succeeded")
+	}
+}
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	ln, err := ListenXTLS("tcp", "127.0.0.1:0", &Config{
+		Certificates: []nxtls.Certificate{testCertificate(t, "example.test")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := ln.RotateSessionTicketKeys(0, 1); err == nil {
+		t.Error("RotateSessionTicketKeys accepted a zero interval")
+	}
+	stop, err := ln.RotateSessionTicketKeys(time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	clientConfig := &Config{
+		ServerName:         "example.test",
+		InsecureSkipVerify: true,
+		ClientSessionCache: nxtls.NewLRUClientSessionCache(1),
+	}
+	// connect runs a handshake and an echo, which delivers the TLS 1.3
+	// session ticket, and reports whether the session was resumed.
+	connect := func() bool {
+		t.Helper()
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		server := ln.WrapConn(c1)
+		client := NewConn(c2, clientConfig)
+		go func() {
+			buf := make([]byte, 4)
+			io.ReadFull(server, buf)
+			server.Write(buf)
+		}()
+		buf := make([]byte, 4)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		return client.ConnectionState().DidResume
+	}
+	rotate := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := ln.ticketRotation.rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, step := range []struct {
+		name      string
+		rotations int
+		resumed   bool
+	}{
+		{"first connection", 0, false},
+		{"after one rotation", 1, true},
+		{"after the grace period", 2, false},
+		{"with the same keys", 0, true},
+	} {
+		rotate(step.rotations)
+		if got := connect(); got != step.resumed {
+			t.Errorf("%s: resumed = %t, want %t", step.name, got, step.resumed)
+		}
+	}
+
+	ln.SetSessionTicketKeys([][32]byte{{1}})
+	if connect() {
+		t.Error("resumed after SetSessionTicketKeys replaced the keys")
+	}
+
+	// A tick of a replaced rotation leaves the new rotation's keys alone.
+	old := ln.ticketRotation
+	stop2, err := ln.RotateSessionTicketKeys(time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop2()
+	connect()
+	if err := old.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if !connect() {
+		t.Error("a replaced rotation installed its keys")
+	}
+	stop()
+	stop()
+}
+
+func TestCloseGracefully(t *testing.T) {
+	client, server := testPair(t)
+	if err := client.SetWriteCoalescing(time.Hour, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(server)
+		done <- result{data, err}
+	}()
+	if err := client.CloseGracefully(time.Second); err != nil {
+		t.Fatalf("CloseGracefully: %v", err)
+	}
+	if r := <-done; string(r.data) != "data" || r.err != nil {
+		t.Fatalf("peer read %q, %v, want the coalesced data and a clean EOF", r.data, r.err)
+	}
+	if !server.CleanlyClosed() {
+		t.Error("peer did not see close_notify")
+	}
+
+	// A peer that never reads makes it give up after the timeout.
+	client, _ = testPair(t)
+	start := time.Now()
+	if err := client.CloseGracefully(50 * time.Millisecond); err == nil {
+		t.Error("CloseGracefully succeeded with a peer that does not read")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("CloseGracefully took %v, want about 50ms", d)
+	}
+
+	// Without a timeout, the coalesced bytes are flushed under the default
+	// bound too.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server = nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	transport := &eventConn{Conn: c2}
+	client = NewConn(transport, &Config{InsecureSkipVerify: true})
+	go server.Handshake()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, server)
+	if err := client.SetWriteCoalescing(time.Hour, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	transport.reset()
+	start = time.Now()
+	if err := client.CloseGracefully(0); err != nil {
+		t.Fatalf("CloseGracefully(0): %v", err)
+	}
+	events, deadline := transport.get()
+	if len(events) == 0 || events[0] != "deadline" || deadline.Before(start.Add(closeNotifyTimeout)) {
+		t.Errorf("CloseGracefully(0) did %v, first deadline %v from the call; want a %v deadline before the flush", events, deadline.Sub(start), closeNotifyTimeout)
+	}
+}
+
+// eventConn records the order of writes and write deadlines set on it.
+type eventConn struct {
+	net.Conn
+	mu            sync.Mutex
+	events        []string
+	firstDeadline time.Time
+}
+
+func (c *eventConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.events = append(c.events, "write")
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *eventConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	if c.firstDeadline.IsZero() {
+		c.firstDeadline = t
+	}
+	c.events = append(c.events, "deadline")
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *eventConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events, c.firstDeadline = nil, time.Time{}
+}
+
+func (c *eventConn) get() ([]string, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.events...), c.firstDeadline
+}
+
+func TestConnTemplate(t *testing.T) {
+	var states int32
+	tmpl := &ConnTemplate{
+		Config:           &Config{InsecureSkipVerify: true},
+		Flow:             RPRXDirect,
+		ProgressDeadline: time.Second,
+		ConnState: func(net.Conn, http.ConnState) {
+			atomic.AddInt32(&states, 1)
+		},
+	}
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		c := tmpl.New(c1)
+		if got := c.GetFlow(); got != RPRXDirect {
+			t.Errorf("conn %d: GetFlow() = %q, want %q", i, got, RPRXDirect)
+		}
+		if got := c.GetXTLSMode(); got != nxtls.XTLSModeDirect {
+			t.Errorf("conn %d: GetXTLSMode() = %v, want Direct", i, got)
+		}
+		if idle := time.Duration(atomic.LoadInt64(&c.progressIdle)); idle != time.Second {
+			t.Errorf("conn %d: progress deadline %v, want 1s", i, idle)
+		}
+	}
+	if n := atomic.LoadInt32(&states); n != 2 {
+		t.Errorf("ConnState called %d times, want once per conn", n)
+	}
+}
+
+func TestNewConnHandshook(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	server := nxtls.Server(c1, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	go server.Handshake()
+	client, err := NewConnHandshook(c2, &Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.ConnectionState().HandshakeComplete {
+		t.Error("handshake not complete on return")
+	}
+
+	// A failed handshake fails construction and closes the transport.
+	c3, c4 := xtlstest.Pipe()
+	defer c3.Close()
+	server = nxtls.Server(c3, &Config{Certificates: []nxtls.Certificate{testCertificate(t, "example.test")}})
+	go server.Handshake()
+	if _, err := NewConnHandshook(c4, &Config{ServerName: "other.test"}); err == nil {
+		t.Fatal("NewConnHandshook succeeded with an untrusted certificate")
+	}
+	if _, err := c4.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write to the transport after failure = %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestStrictFlow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	lenient := NewConn(c1, &Config{})
+	lenient.SetFlow(RPRXDirect)
+	lenient.SetFlow("xtls-rprx-drect")
+	if got := lenient.GetXTLSMode(); got != nxtls.XTLSModeOrigin {
+		t.Errorf("lenient: mode after an unknown flow = %v, want Origin", got)
+	}
+	if err := lenient.SetFlowStrict("xtls-rprx-drect"); !errors.Is(err, ErrUnknownFlow) {
+		t.Errorf("SetFlowStrict(unknown) = %v, want ErrUnknownFlow", err)
+	}
+
+	strict, peer := testPair(t)
+	go io.Copy(io.Discard, peer)
+	strict.SetStrictFlow(true)
+	strict.SetFlow(RPRXDirect)
+	strict.SetFlow("xtls-rprx-drect")
+	if got := strict.GetFlow(); got != RPRXDirect {
+		t.Errorf("strict: flow after an unknown flow = %q, want it unchanged", got)
+	}
+	if _, err := strict.Write([]byte("data")); !errors.Is(err, ErrUnknownFlow) {
+		t.Errorf("strict: Write = %v, want ErrUnknownFlow", err)
+	}
+	if _, err := strict.Read(make([]byte, 4)); !errors.Is(err, ErrUnknownFlow) {
+		t.Errorf("strict: Read = %v, want ErrUnknownFlow", err)
+	}
+	if _, err := strict.Peek(0); !errors.Is(err, ErrUnknownFlow) {
+		t.Errorf("strict: Peek = %v, want ErrUnknownFlow", err)
+	}
+	strict.SetFlow(RPRXOrigin)
+	if _, err := strict.Write([]byte("data")); err != nil {
+		t.Errorf("strict: Write after a valid SetFlow = %v", err)
+	}
+}
+
+// bufferRW is a buffer-backed io.ReadWriteCloser: reads return what was
+// written.
+type bufferRW struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferRW) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestWrapReadWriter(t *testing.T) {
+	rw := &bufferRW{}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	conn := WrapReadWriter(rw, nil, remote)
+	if conn.LocalAddr().Network() != "rw" || conn.RemoteAddr() != remote {
+		t.Errorf("addresses = %v, %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if err := conn.SetDeadline(time.Now()); err != nil {
+		t.Errorf("SetDeadline on a carrier without deadlines = %v, want nil", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read = %q, %v, want %q", buf, err, "hello")
+	}
+	if conn.Close(); !rw.closed {
+		t.Error("Close did not close the carrier")
+	}
+
+	// Deadlines reach a carrier that supports them.
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn = WrapReadWriter(p1, nil, nil)
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after the deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"errors"
 	"fmt"
 	"hash"
 )
@@ -247,7 +246,13 @@ func (h *finishedHash) discardHandshakeBuffer() {
 // ConnectionState.ekm when renegotiation is enabled and thus
 // we wish to fail all key-material export requests.
 func noExportedKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
-	return nil, errors.New("crypto/tls: ExportKeyingMaterial is unavailable when renegotiation is enabled")
+	return nil, fmt.Errorf("%w when renegotiation is enabled", ErrKeyingMaterialUnavailable)
+}
+
+// noExportedKeyingMaterialBeforeHandshake is used as a value of
+// ConnectionState.ekm until the handshake has completed.
+func noExportedKeyingMaterialBeforeHandshake(label string, context []byte, length int) ([]byte, error) {
+	return nil, ErrNotHandshaken
 }
 
 // ekmFromMasterSecret generates exported keying material as defined in RFC 5705.
@@ -0,0 +1,77 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+// Export of connection secrets for analysis tooling.
+
+package tls
+
+import "errors"
+
+// ErrSecretExportDisabled is returned by ExportSecrets when the Config of
+// the connection does not set AllowSecretExport.
+var ErrSecretExportDisabled = errors.New("tls: secret export is not allowed by Config.AllowSecretExport")
+
+// ConnSecrets holds the secrets of a connection, as returned by
+// ExportSecrets. They are the values a KeyLogWriter receives, keyed by the
+// ClientHello random, in the NSS key log format.
+type ConnSecrets struct {
+	Version      uint16 // the negotiated TLS version
+	ClientRandom []byte
+
+	// TLS 1.3 handshake and first application traffic secrets.
+	ClientHandshakeTrafficSecret []byte
+	ServerHandshakeTrafficSecret []byte
+	ClientTrafficSecret          []byte
+	ServerTrafficSecret          []byte
+
+	// MasterSecret is the master secret of TLS 1.2 and earlier.
+	MasterSecret []byte
+}
+
+// ExportSecrets returns the secrets of the connection's handshake, for
+// analysis tooling that decrypts captured traffic programmatically instead
+// of reading a KeyLogWriter file. It fails with ErrSecretExportDisabled
+// unless Config.AllowSecretExport is set, and with ErrNotHandshaken before
+// the handshake completes. The TLS 1.3 traffic secrets are those of the
+// first generation; key updates are not reflected.
+func (c *Conn) ExportSecrets() (*ConnSecrets, error) {
+	if !c.config.AllowSecretExport {
+		return nil, ErrSecretExportDisabled
+	}
+	if !c.handshakeComplete() || c.secrets == nil {
+		return nil, ErrNotHandshaken
+	}
+	s := *c.secrets
+	s.Version = c.vers
+	return &s, nil
+}
+
+// writeKeyLog writes a secret to the KeyLogWriter, if any, and keeps it for
+// ExportSecrets.
+func (c *Conn) writeKeyLog(label string, clientRandom, secret []byte) error {
+	c.saveSecret(label, clientRandom, secret)
+	return c.config.writeKeyLog(label, clientRandom, secret)
+}
+
+// saveSecret keeps a copy of secret for ExportSecrets if the Config allows
+// it.
+func (c *Conn) saveSecret(label string, clientRandom, secret []byte) {
+	if !c.config.AllowSecretExport {
+		return
+	}
+	if c.secrets == nil {
+		c.secrets = &ConnSecrets{}
+	}
+	c.secrets.ClientRandom = append([]byte(nil), clientRandom...)
+	secret = append([]byte(nil), secret...)
+	switch label {
+	case keyLogLabelTLS12:
+		c.secrets.MasterSecret = secret
+	case keyLogLabelClientHandshake:
+		c.secrets.ClientHandshakeTrafficSecret = secret
+	case keyLogLabelServerHandshake:
+		c.secrets.ServerHandshakeTrafficSecret = secret
+	case keyLogLabelClientTraffic:
+		c.secrets.ClientTrafficSecret = secret
+	case keyLogLabelServerTraffic:
+		c.secrets.ServerTrafficSecret = secret
+	}
+}
@@ -95,7 +95,7 @@ func (m *sessionStateTLS13) marshal() []byte {
 	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(m.resumptionSecret)
 	})
-	marshalCertificate(&b, m.certificate)
+	marshalCertificate(&b, m.certificate, nil)
 	return b.BytesOrPanic()
 }
 
@@ -112,7 +112,7 @@ func (m *sessionStateTLS13) unmarshal(data []byte) bool {
 		readUint64(&s, &m.createdAt) &&
 		readUint8LengthPrefixed(&s, &m.resumptionSecret) &&
 		len(m.resumptionSecret) != 0 &&
-		unmarshalCertificate(&s, &m.certificate) &&
+		unmarshalCertificate(&s, &m.certificate, nil) &&
 		s.Empty()
 }
 
@@ -6,8 +6,12 @@
 package tls
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 	"io"
@@ -33,6 +37,50 @@ func (mode XTLSMode) String() string {
 	}
 }
 
+// Direction identifies whether a traced record was read or written.
+type Direction int
+
+const (
+	DirectionRead  Direction = iota // Record received from the peer.
+	DirectionWrite                  // Record sent to the peer.
+)
+
+// String returns a human-readable string for Direction.
+func (dir Direction) String() string {
+	switch dir {
+	case DirectionRead:
+		return "Read"
+	case DirectionWrite:
+		return "Write"
+	default:
+		return "Unknown"
+	}
+}
+
+// FallbackReason says why a connection switched to the Origin fallback
+// logic.
+type FallbackReason int
+
+const (
+	FallbackNone              FallbackReason = iota // No fallback has happened.
+	FallbackUnspecified                             // Fallback was set without a reason, e.g. by UpdateXTLSState.
+	FallbackSignatureMismatch                       // The peer's first data did not match the expected signature.
+)
+
+// String returns a human-readable string for FallbackReason.
+func (r FallbackReason) String() string {
+	switch r {
+	case FallbackNone:
+		return "None"
+	case FallbackUnspecified:
+		return "Unspecified"
+	case FallbackSignatureMismatch:
+		return "SignatureMismatch"
+	default:
+		return "Unknown"
+	}
+}
+
 // KnownAlertHeaders represents classic TLS alert record headers for detection.
 var KnownAlertHeaders = [][]byte{
 	{0x15, 0x03, 0x03}, // TLS1.2 alert
@@ -60,15 +108,16 @@ func IsAlertRecordHeader(buf []byte, pos int) bool {
 
 // FindAllTrailingAlerts scans from the end and returns a slice excluding all trailing alert records.
 func FindAllTrailingAlerts(buf []byte) (head []byte, alertCount int) {
+	return findTrailingAlerts(buf, func([]byte) bool { return true })
+}
+
+// findTrailingAlerts is like FindAllTrailingAlerts but stops at the first
+// trailing alert record, counting from the end, for which strip is false.
+func findTrailingAlerts(buf []byte, strip func(record []byte) bool) (head []byte, alertCount int) {
 	pos := len(buf)
-	for pos >= 5 {
-		// look for possible alert record at pos-5
-		start := pos - 5
-		if !IsAlertRecordHeader(buf, start) {
-			break
-		}
-		length := int(buf[start+3])<<8 | int(buf[start+4])
-		if start+5+length != pos || length <= 0 || length > 256 {
+	for {
+		start := trailingAlertStart(buf[:pos])
+		if start < 0 || !strip(buf[start:pos]) {
 			break
 		}
 		pos = start
@@ -77,15 +126,119 @@ func FindAllTrailingAlerts(buf []byte) (head []byte, alertCount int) {
 	return buf[:pos], alertCount
 }
 
+// IsBenignAlert reports whether record, a complete alert record, is a
+// plaintext warning-level close_notify, the only alert whose loss cannot
+// hide an error from the application. Encrypted alerts, whose level and
+// description cannot be read, are not benign.
+func IsBenignAlert(record []byte) bool {
+	return len(record) == 7 && record[0] == byte(recordTypeAlert) &&
+		record[3] == 0 && record[4] == 2 &&
+		record[5] == alertLevelWarning && alert(record[6]) == alertCloseNotify
+}
+
+// RemoveBenignTrailingAlerts is like RemoveAllTrailingAlerts but only
+// strips trailing alerts for which IsBenignAlert holds, so fatal and
+// encrypted alerts reach the peer and it sees the real error. Stripping
+// stops at the last alert that is not benign; benign ones before it stay.
+func RemoveBenignTrailingAlerts(data []byte) ([]byte, int) {
+	return findTrailingAlerts(data, IsBenignAlert)
+}
+
+// trailingAlertStart returns the offset of the alert record, of at most 256
+// bytes of payload, that ends buf, or -1 if there is none.
+func trailingAlertStart(buf []byte) int {
+	for length := 1; length <= 256 && 5+length <= len(buf); length++ {
+		start := len(buf) - 5 - length
+		if IsAlertRecordHeader(buf, start) && int(buf[start+3])<<8|int(buf[start+4]) == length {
+			return start
+		}
+	}
+	return -1
+}
+
+// StripTrailingAlertsForVersion is like RemoveAllTrailingAlerts for data
+// sent over a connection that negotiated version. Under TLS 1.3 it strips
+// nothing unless force is set, since alerts are then encrypted inside
+// application data records and trailing bytes that look like an alert
+// record are data that must not be lost.
+func StripTrailingAlertsForVersion(data []byte, version uint16, force bool) ([]byte, int) {
+	if !alertStrippingApplies(version, force) {
+		return data, 0
+	}
+	return RemoveAllTrailingAlerts(data)
+}
+
+// alertStrippingApplies reports whether trailing alerts should be stripped
+// from data of a connection that negotiated version, zero if unknown.
+func alertStrippingApplies(version uint16, force bool) bool {
+	return force || version != VersionTLS13
+}
+
+// partialAlertStart returns the offset of the earliest suffix of buf that
+// holds a complete alert record header, with a payload length of 1 to 256
+// bytes, whose payload is cut off by the end of buf, or -1 if there is none.
+// A suffix shorter than a header never counts, so a trailing 0x15 or
+// 0x15 0x03 is not taken for the start of an alert.
+func partialAlertStart(buf []byte) int {
+	start := len(buf) - 5 - 256
+	if start < 0 {
+		start = 0
+	}
+	for pos := start; pos+5 <= len(buf); pos++ {
+		if isPartialAlert(buf[pos:]) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// isPartialAlert reports whether rec starts with a known alert header and a
+// plausible length, and ends before the payload that length announces.
+func isPartialAlert(rec []byte) bool {
+	if len(rec) < 5 {
+		return false
+	}
+	for _, header := range KnownAlertHeaders {
+		if len(header) > len(rec) || string(rec[:len(header)]) != string(header) {
+			continue
+		}
+		length := int(rec[3])<<8 | int(rec[4])
+		return length >= 1 && length <= 256 && len(rec) < 5+length
+	}
+	return false
+}
+
+// alertScanWindow is how many bytes at the end of a buffer
+// RemoveAllTrailingAlerts searches for alert records, well above the 261
+// bytes of the largest one.
+const alertScanWindow = 4096
+
 // RemoveAllTrailingAlerts strips all TLS alert records at the end and returns the main data and strip count.
+// Only the last 4096 bytes are searched, so large writes cost no more to
+// check than small ones; alerts further back, which only a run of many
+// back-to-back alerts could reach, are kept. FindAllTrailingAlerts
+// searches the whole buffer.
 func RemoveAllTrailingAlerts(data []byte) ([]byte, int) {
-	return FindAllTrailingAlerts(data)
+	if len(data) <= alertScanWindow {
+		return FindAllTrailingAlerts(data)
+	}
+	skip := len(data) - alertScanWindow
+	tail, count := FindAllTrailingAlerts(data[skip:])
+	return data[:skip+len(tail)], count
 }
 
+// debugOutput is where XTLSDebug writes; tests replace it.
+var debugOutput io.Writer = os.Stdout
+
+// nowFunc is the clock behind XTLSConnState.LastTransition,
+// Conn.HandshakeDuration and SetKeyUpdateInterval; tests replace it.
+// Deadlines use the real clock.
+var nowFunc = time.Now
+
 // XTLSDebug emits formatted debug output if enabled.
 func XTLSDebug(enabled bool, format string, v ...interface{}) {
 	if enabled {
-		fmt.Printf("[XTLS] "+format+"\n", v...)
+		fmt.Fprintf(debugOutput, "[XTLS] "+format+"\n", v...)
 	}
 }
 
@@ -105,6 +258,8 @@ type XTLSConnState struct {
 	ExpectLen      int  // Expected length for direct transition
 	MatchCount     int  // Protocol signature confirmation
 	FallbackCount  int  // Fallback trigger counter
+	FallbackReason FallbackReason // Why OriginFallback was last set
+	FallbackDetail string         // Optional detail for FallbackReason, such as the offending byte
 	Debug          bool // Enable or disable debug output
 	LastTransition time.Time // Timestamp of last state change
 }
@@ -141,12 +296,16 @@ func ParseXTLSMode(s string) XTLSMode {
 func UpdateXTLSState(state *XTLSConnState, field string, value bool) {
 	state.Lock()
 	defer state.Unlock()
-	state.LastTransition = time.Now()
+	state.LastTransition = nowFunc()
 	switch field {
 	case "DirectReady":
 		state.DirectReady = value
 	case "OriginFallback":
 		state.OriginFallback = value
+		state.FallbackReason, state.FallbackDetail = FallbackNone, ""
+		if value {
+			state.FallbackReason = FallbackUnspecified
+		}
 	case "ReadBypass":
 		state.ReadBypass = value
 	case "WriteBypass":
@@ -157,15 +316,128 @@ func UpdateXTLSState(state *XTLSConnState, field string, value bool) {
 	}
 }
 
+// SetXTLSFallback turns on OriginFallback and records why, logging the
+// reason if debug is enabled. detail may be empty.
+func SetXTLSFallback(state *XTLSConnState, reason FallbackReason, detail string) {
+	state.Lock()
+	defer state.Unlock()
+	state.LastTransition = nowFunc()
+	state.OriginFallback = true
+	state.FallbackCount++
+	state.FallbackReason, state.FallbackDetail = reason, detail
+	if state.Debug {
+		fmt.Printf("[XTLS] State update: OriginFallback = true (%v: %s) at %s\n", reason, detail, state.LastTransition.Format(time.RFC3339))
+	}
+}
+
 // DumpXTLSState prints the current state (for diagnostics).
 func DumpXTLSState(state *XTLSConnState) {
 	state.Lock()
 	defer state.Unlock()
-	fmt.Printf("[XTLS] Conn State: %+v\n", *state)
+	fmt.Printf("[XTLS] Conn State: %+v\n", state)
+}
+
+// DumpConfig returns a human-readable summary of the settings config will
+// use in a handshake, for diagnosing a misbehaving handshake before it runs.
+// Defaults are resolved to their effective values. Certificates are shown by
+// subject and names only; private keys, session ticket keys and other
+// secrets are never printed.
+func DumpConfig(config *Config) string {
+	if config == nil {
+		config = &Config{}
+	}
+	var b strings.Builder
+	line := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "%-22s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+	}
+
+	line("ServerName", "%q", config.ServerName)
+	line("Versions (client)", "%s", versionList(config.supportedVersions(true)))
+	line("Versions (server)", "%s", versionList(config.supportedVersions(false)))
+	suites := make([]string, 0, len(config.cipherSuites()))
+	for _, id := range config.cipherSuites() {
+		suites = append(suites, CipherSuiteName(id))
+	}
+	line("CipherSuites", "%s", strings.Join(suites, ", "))
+	line("ExactCipherOrder", "%t", config.exactCipherOrder)
+	line("CurvePreferences", "%v", config.curvePreferences())
+	line("NextProtos", "%q", config.NextProtos)
+	line("InsecureSkipVerify", "%t", config.InsecureSkipVerify)
+	line("RootCAs", "%s", poolString(config.RootCAs, "system"))
+	line("ClientAuth", "%v", config.ClientAuth)
+	line("ClientCAs", "%s", poolString(config.ClientCAs, "none"))
+	line("VerifyPeerCertificate", "%t", config.VerifyPeerCertificate != nil)
+	line("VerifyConnection", "%t", config.VerifyConnection != nil)
+	line("RequireStrongCiphers", "%t", config.requireStrongCiphers)
+	line("RequireStrongCurves", "%t", config.requireStrongCurves)
+	line("GREASE", "%t", config.grease)
+	line("Renegotiation", "%s", renegotiationString(config.Renegotiation))
+	line("SessionTickets", "%t", !config.SessionTicketsDisabled)
+	line("KeyLogWriter", "%t", config.KeyLogWriter != nil)
+	line("AllowSecretExport", "%t", config.AllowSecretExport)
+	line("Certificates", "%d", len(config.Certificates))
+	for i, cert := range config.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf == nil {
+			line(fmt.Sprintf("  [%d]", i), "(unparsable)")
+			continue
+		}
+		line(fmt.Sprintf("  [%d]", i), "subject=%q dns=%q expires=%s",
+			leaf.Subject.String(), leaf.DNSNames, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+func versionList(versions []uint16) string {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		switch v {
+		case VersionTLS13:
+			names = append(names, "TLS 1.3")
+		case VersionTLS12:
+			names = append(names, "TLS 1.2")
+		case VersionTLS11:
+			names = append(names, "TLS 1.1")
+		case VersionTLS10:
+			names = append(names, "TLS 1.0")
+		default:
+			names = append(names, fmt.Sprintf("0x%04x", v))
+		}
+	}
+	if len(names) == 0 {
+		return "(none)"
+	}
+	return strings.Join(names, ", ")
+}
+
+func poolString(pool *x509.CertPool, ifNil string) string {
+	if pool == nil {
+		return ifNil
+	}
+	return "custom"
+}
+
+func renegotiationString(r RenegotiationSupport) string {
+	switch r {
+	case RenegotiateNever:
+		return "never"
+	case RenegotiateOnceAsClient:
+		return "once as client"
+	case RenegotiateFreelyAsClient:
+		return "freely as client"
+	}
+	return fmt.Sprintf("%d", int(r))
 }
 
 // XTLSWriteDirect strips all trailing alert records and writes safe data to conn.
 // Returns total bytes (including stripped alerts) for API consistency.
+//
+// Deprecated: The count mixes bytes written with bytes dropped, and a
+// short write by conn is returned as is. Use WriteDirectV2, which reports
+// the two separately and completes short writes.
 func XTLSWriteDirect(conn net.Conn, buf []byte, debug bool) (int, error) {
 	main, count := RemoveAllTrailingAlerts(buf)
 	if count > 0 && debug {
@@ -178,30 +450,355 @@ func XTLSWriteDirect(conn net.Conn, buf []byte, debug bool) (int, error) {
 	return n + len(buf) - len(main), nil
 }
 
-// XTLSReadDirect is a passthrough read (Direct mode).
+// WriteDirectV2 strips all trailing alert records from data and writes the
+// rest to conn, for relaying in Direct mode. written is the number
+// of bytes conn accepted and stripped the number of alert bytes dropped,
+// so written+stripped == len(data) on success. Short writes without an
+// error are retried until the data is out; a write that makes no progress
+// fails with io.ErrShortWrite.
+func WriteDirectV2(conn net.Conn, data []byte, debug bool) (written int, stripped int, err error) {
+	main, count := RemoveAllTrailingAlerts(data)
+	stripped = len(data) - len(main)
+	if count > 0 && debug {
+		XTLSDebug(debug, "Removed %d trailing alert record(s)", count)
+	}
+	for written < len(main) {
+		n, err := conn.Write(main[written:])
+		written += n
+		if err != nil {
+			return written, stripped, err
+		}
+		if n == 0 {
+			return written, stripped, io.ErrShortWrite
+		}
+	}
+	return written, stripped, nil
+}
+
+// XTLSReadDirect is a passthrough read (Direct mode). Unlike
+// WriteDirectV2 it does not strip trailing alerts: in a relay the alerts
+// are dropped on the way out, by WriteDirectV2 or XTLSCopyConn, and a
+// reader that terminates the stream itself may want to see them. Use
+// XTLSReadDirectStrip to drop them on the read side instead.
 func XTLSReadDirect(conn net.Conn, b []byte) (int, error) {
 	return conn.Read(b)
 }
 
+// XTLSReadDirectStrip reads from conn like XTLSReadDirect but drops the
+// alert records trailing the data of each read, mirroring WriteDirectV2.
+// A read that returns only alerts is retried, so it does not report 0 bytes
+// with a nil error. Stripping works per read: an alert split across two
+// reads is passed through. StripAlertConnReads keeps state across reads
+// and also catches split alerts.
+func XTLSReadDirectStrip(conn net.Conn, b []byte, debug bool) (int, error) {
+	for {
+		n, err := conn.Read(b)
+		if n == 0 {
+			return n, err
+		}
+		head, count := RemoveAllTrailingAlerts(b[:n])
+		if count > 0 && debug {
+			XTLSDebug(debug, "Removed %d trailing alert record(s) from a read", count)
+		}
+		if len(head) > 0 || err != nil {
+			return len(head), err
+		}
+	}
+}
+
+// StripAlertConn wraps inner so that each Write drops the alert records
+// trailing its buffer, as WriteDirectV2 does, giving any stream the
+// write side of Direct mode without a TLS Conn. Reads pass through; use
+// StripAlertConnReads to strip them too.
+func StripAlertConn(inner net.Conn) net.Conn {
+	return &stripAlertConn{Conn: inner}
+}
+
+// StripAlertConnReads is like StripAlertConn but also drops the alert
+// records trailing the data of each read from inner. An alert split across
+// two reads is stripped as well once its whole 5-byte header has arrived:
+// a read ending in an alert header with a plausible length but only part
+// of the payload is held back from the header on and judged together with
+// the next read. Shorter fragments, such as a lone trailing 0x15, are
+// returned at once and never held.
+func StripAlertConnReads(inner net.Conn) net.Conn {
+	return &stripAlertConn{Conn: inner, reads: true}
+}
+
+type stripAlertConn struct {
+	net.Conn
+	reads bool
+
+	// For reads, held is the end of the last read that may begin an alert
+	// record, ready is stripped data not yet returned and readErr the
+	// error to return once ready drains. buf backs them.
+	held    []byte
+	ready   []byte
+	readErr error
+	buf     []byte
+}
+
+func (c *stripAlertConn) Write(b []byte) (int, error) {
+	n, stripped, err := WriteDirectV2(c.Conn, b, false)
+	if err != nil {
+		return n, err
+	}
+	return n + stripped, nil
+}
+
+func (c *stripAlertConn) Read(b []byte) (int, error) {
+	if !c.reads {
+		return c.Conn.Read(b)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(c.ready) == 0 {
+		if err := c.readErr; err != nil {
+			c.readErr = nil
+			return 0, err
+		}
+		if size := len(c.held) + len(b); cap(c.buf) < size {
+			buf := make([]byte, size)
+			copy(buf, c.held)
+			c.held, c.buf = buf[:len(c.held)], buf
+		} else {
+			c.held = c.buf[:copy(c.buf, c.held)]
+		}
+		n, err := c.Conn.Read(c.buf[len(c.held):cap(c.buf)])
+		data := c.buf[:len(c.held)+n]
+		c.held = nil
+		if err == nil || os.IsTimeout(err) {
+			if pos := partialAlertStart(data); pos >= 0 {
+				data, c.held = data[:pos], data[pos:]
+			}
+		}
+		c.ready, _ = RemoveAllTrailingAlerts(data)
+		c.readErr = err
+	}
+	n := copy(b, c.ready)
+	c.ready = c.ready[n:]
+	if len(c.ready) == 0 && c.readErr != nil {
+		err := c.readErr
+		c.readErr = nil
+		return n, err
+	}
+	return n, nil
+}
+
 // XTLSCopyConn copies data from src to dst with XTLS direct mode alert stripping.
 func XTLSCopyConn(dst, src net.Conn, debug bool) (written int64, err error) {
+	r := XTLSCopyConnResult(dst, src, debug)
+	if r.writeFailed {
+		return r.Written, r.Err
+	}
+	return r.Written, nil
+}
+
+// CopyEnd classifies how a copy between two connections ended.
+type CopyEnd int
+
+const (
+	CopyEndEOF         CopyEnd = iota // The source reached a clean EOF.
+	CopyEndIdleTimeout                // A read or write deadline expired, e.g. an idle timeout.
+	CopyEndError                      // Reading or writing failed.
+	CopyEndSlowConsumer               // A write exceeded CopyOptions.WriteTimeout.
+)
+
+func (e CopyEnd) String() string {
+	switch e {
+	case CopyEndEOF:
+		return "eof"
+	case CopyEndIdleTimeout:
+		return "idle timeout"
+	case CopyEndError:
+		return "error"
+	case CopyEndSlowConsumer:
+		return "slow consumer"
+	}
+	return fmt.Sprintf("CopyEnd(%d)", int(e))
+}
+
+// CopyResult describes a finished copy.
+type CopyResult struct {
+	Written int64   // bytes written to the destination
+	End     CopyEnd // why the copy stopped
+	Err     error   // the error that stopped it; nil for CopyEndEOF
+
+	// WriteBlocked is the total time spent in writes to the destination,
+	// which is where a slow destination holds up the source.
+	WriteBlocked time.Duration
+
+	writeFailed bool
+}
+
+// CopyOptions configures XTLSCopyConnOptions.
+type CopyOptions struct {
+	// WriteTimeout, if non-zero, bounds each write to the destination. A
+	// write that takes longer ends the copy with a *SlowConsumerError. The
+	// copy takes over the destination's write deadline and clears it on
+	// return.
+	WriteTimeout time.Duration
+
+	// Debug enables debug output, like the debug argument of XTLSCopyConn.
+	Debug bool
+}
+
+// SlowConsumerError is returned by XTLSCopyConnOptions when the
+// destination accepts data too slowly for CopyOptions.WriteTimeout.
+type SlowConsumerError struct {
+	Limit   time.Duration // the WriteTimeout that was exceeded
+	Written int           // bytes of the timed-out write that were accepted
+	Err     error         // the error of the write
+}
+
+func (e *SlowConsumerError) Error() string {
+	return fmt.Sprintf("xtls: slow consumer: write not done within %v (%d bytes written): %v", e.Limit, e.Written, e.Err)
+}
+
+func (e *SlowConsumerError) Unwrap() error { return e.Err }
+func (e *SlowConsumerError) Timeout() bool { return true }
+
+// classifyCopyError maps the error that ended a copy to a CopyEnd.
+func classifyCopyError(err error) CopyEnd {
+	if err == nil || err == io.EOF {
+		return CopyEndEOF
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return CopyEndIdleTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CopyEndIdleTimeout
+	}
+	return CopyEndError
+}
+
+// XTLSCopyConnResult is like XTLSCopyConn, but reports how the copy ended
+// instead of treating every read error as the end of the stream, so that
+// tunnel managers can tell a clean close from an idle timeout and from a
+// transport failure.
+func XTLSCopyConnResult(dst, src net.Conn, debug bool) CopyResult {
+	return XTLSCopyConnOptions(dst, src, CopyOptions{Debug: debug})
+}
+
+// XTLSCopyConnOptions is like XTLSCopyConnResult with the options in opts.
+// It can bound each write to dst and reports in CopyResult.WriteBlocked how
+// long the copy waited on dst, to diagnose head-of-line blocking in relays.
+func XTLSCopyConnOptions(dst, src net.Conn, opts CopyOptions) CopyResult {
+	var r CopyResult
+	debug := opts.Debug
+	if opts.WriteTimeout > 0 {
+		defer dst.SetWriteDeadline(time.Time{})
+	}
 	buffer := make([]byte, 32*1024)
 	for {
 		nr, er := src.Read(buffer)
 		if nr > 0 {
 			data, _ := RemoveAllTrailingAlerts(buffer[:nr])
+			start := time.Now()
+			if opts.WriteTimeout > 0 {
+				dst.SetWriteDeadline(start.Add(opts.WriteTimeout))
+			}
 			nw, ew := dst.Write(data)
-			written += int64(nw)
+			r.WriteBlocked += time.Since(start)
+			r.Written += int64(nw)
 			if ew != nil {
-				return written, ew
+				r.End, r.Err, r.writeFailed = classifyCopyError(ew), ew, true
+				if opts.WriteTimeout > 0 && r.End == CopyEndIdleTimeout {
+					r.End = CopyEndSlowConsumer
+					r.Err = &SlowConsumerError{Limit: opts.WriteTimeout, Written: nw, Err: ew}
+				}
+				XTLSDebug(debug, "XTLSCopyConn write %s: %v", r.End, ew)
+				return r
 			}
 		}
 		if er != nil {
-			if er != io.EOF {
-				XTLSDebug(debug, "XTLSCopyConn read error: %v", er)
+			r.End = classifyCopyError(er)
+			if r.End != CopyEndEOF {
+				r.Err = er
+				XTLSDebug(debug, "XTLSCopyConn read %s: %v", r.End, er)
 			}
-			break
+			return r
+		}
+	}
+}
+
+// XTLSRelay copies data in both directions between a and b with direct mode
+// alert stripping, returning once both directions have finished. When one
+// direction ends, the read and write deadlines of both conns are set to now
+// so the other direction does not hang on a half-open pair, whether it is
+// blocked reading or writing.
+//
+// A non-zero deadline is an absolute cap on the whole session: it is applied
+// to both conns, and once it elapses XTLSRelay returns the timeout error of
+// the direction it stopped, which matches os.ErrDeadlineExceeded. This is
+// unrelated to any idle timeout. Deadlines are cleared on return. An error
+// from SetDeadline is returned, except on a conn that is already closed.
+func XTLSRelay(a, b net.Conn, deadline time.Time, debug bool) (aToB, bToA int64, err error) {
+	if !deadline.IsZero() {
+		if err := a.SetDeadline(deadline); err != nil {
+			return 0, 0, err
+		}
+		if err := b.SetDeadline(deadline); err != nil {
+			a.SetDeadline(time.Time{})
+			return 0, 0, err
+		}
+	}
+	defer func() {
+		for _, c := range []net.Conn{a, b} {
+			if e := setRelayDeadline(c, time.Time{}); e != nil && err == nil {
+				err = e
+			}
+		}
+	}()
+
+	type result struct {
+		written *int64
+		r       CopyResult
+	}
+	done := make(chan result, 2)
+	go func() {
+		done <- result{&aToB, XTLSCopyConnResult(b, a, debug)}
+	}()
+	go func() {
+		done <- result{&bToA, XTLSCopyConnResult(a, b, debug)}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res := <-done
+		*res.written = res.r.Written
+		// The second direction timing out is the interruption below, not
+		// the session deadline. Read errors other than timeouts end a
+		// direction like EOF does, as in XTLSCopyConn.
+		interrupted := i == 1 && res.r.End == CopyEndIdleTimeout
+		if err == nil && !interrupted && (res.r.End == CopyEndIdleTimeout || res.r.writeFailed) {
+			err = res.r.Err
 		}
+		if i == 0 {
+			// Unblock the other direction. A conn whose deadline cannot be
+			// set is closed instead, as the direction may never return
+			// otherwise.
+			now := time.Now()
+			for _, c := range []net.Conn{a, b} {
+				if e := setRelayDeadline(c, now); e != nil {
+					c.Close()
+					if err == nil {
+						err = e
+					}
+				}
+			}
+		}
+	}
+	return aToB, bToA, err
+}
+
+// setRelayDeadline sets the read and write deadlines of c to t. A conn that
+// is already closed, locally or, for net.Pipe, by its peer, has nothing left
+// to bound, so that error is ignored.
+func setRelayDeadline(c net.Conn, t time.Time) error {
+	err := c.SetDeadline(t)
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return nil
 	}
-	return written, nil
+	return err
 }
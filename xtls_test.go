@@ -0,0 +1,978 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nXTLS/Go/xtlstest"
+)
+
+func TestXTLSRelayDeadline(t *testing.T) {
+	a, peerA := net.Pipe()
+	b, peerB := net.Pipe()
+	defer peerA.Close()
+	defer peerB.Close()
+
+	start := time.Now()
+	_, _, err := XTLSRelay(a, b, time.Now().Add(50*time.Millisecond), false)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("XTLSRelay error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("XTLSRelay took %v to honor its deadline", elapsed)
+	}
+
+	// The deadline must not outlive the relay.
+	go peerA.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := a.Read(buf); err != nil {
+		t.Fatalf("read after relay: %v", err)
+	}
+}
+
+func TestXTLSRelayCompletes(t *testing.T) {
+	a, peerA := net.Pipe()
+	b, peerB := net.Pipe()
+	defer peerB.Close()
+
+	go func() {
+		peerA.Write([]byte("ping"))
+		peerA.Close()
+	}()
+	go io.Copy(io.Discard, peerB)
+
+	aToB, _, err := XTLSRelay(a, b, time.Now().Add(5*time.Second), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aToB != 4 {
+		t.Errorf("relayed %d bytes from a to b, want 4", aToB)
+	}
+}
+
+// eofConn has nothing to read, as if its peer had finished sending.
+type eofConn struct {
+	net.Conn
+}
+
+func (eofConn) Read([]byte) (int, error) { return 0, io.EOF }
+
+// noDeadlineConn refuses deadlines.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+var errNoDeadline = errors.New("deadlines not supported")
+
+func (noDeadlineConn) SetDeadline(time.Time) error { return errNoDeadline }
+
+func TestXTLSRelayUnblocksWrite(t *testing.T) {
+	a, peerA := net.Pipe()
+	b, peerB := net.Pipe()
+	defer peerA.Close()
+	defer peerB.Close()
+
+	// a to b blocks writing to b, whose peer never reads, until b to a
+	// ends and the relay interrupts it.
+	go peerA.Write([]byte("x"))
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := XTLSRelay(a, eofConn{b}, time.Time{}, false)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("XTLSRelay = %v, want nil for an interrupted direction", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("XTLSRelay hung on a direction blocked in Write")
+	}
+}
+
+func TestXTLSRelaySetDeadlineError(t *testing.T) {
+	a, peerA := net.Pipe()
+	b, peerB := net.Pipe()
+	defer peerA.Close()
+	defer peerB.Close()
+
+	if _, _, err := XTLSRelay(a, noDeadlineConn{b}, time.Now().Add(time.Second), false); err != errNoDeadline {
+		t.Errorf("XTLSRelay = %v, want the SetDeadline error", err)
+	}
+}
+
+// oneByteConn delivers at most one byte per Read, like a link that splits
+// every record across many segments.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestOriginReadFragmentedRecords(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := Server(c1, &Config{Certificates: []Certificate{testCertificate(t, "example.test")}})
+	client := Client(oneByteConn{c2}, &Config{InsecureSkipVerify: true})
+	go func() {
+		server.Write([]byte("hello"))
+		server.Close()
+	}()
+
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read %q, want %q", got, "hello")
+	}
+	if !client.CleanlyClosed() {
+		t.Error("close_notify delivered byte by byte was not recognized")
+	}
+}
+
+func TestOriginReadPartialAlertHeader(t *testing.T) {
+	config := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, err, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, config)
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", err, serverErr)
+	}
+	// Data followed by the first bytes of an alert header that has not
+	// fully arrived yet.
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.NetConn().Write([]byte{byte(recordTypeAlert), 0x03}); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v, want %q", buf[:n], err, "hello")
+	}
+}
+
+// findAllTrailingAlertsBefore is FindAllTrailingAlerts as it was before it
+// located records by their declared length: it expected a header in the
+// last five bytes, which only a record without payload can have, and
+// rejected such records, so it never stripped anything.
+func findAllTrailingAlertsBefore(buf []byte) (head []byte, alertCount int) {
+	pos := len(buf)
+	for pos >= 5 {
+		start := pos - 5
+		if !IsAlertRecordHeader(buf, start) {
+			break
+		}
+		length := int(buf[start+3])<<8 | int(buf[start+4])
+		if start+5+length != pos || length <= 0 || length > 256 {
+			break
+		}
+		pos = start
+		alertCount++
+	}
+	return buf[:pos], alertCount
+}
+
+func TestFindAllTrailingAlertsBeforeAfter(t *testing.T) {
+	alert := func(payload int) []byte {
+		rec := []byte{0x15, 0x03, 0x03, byte(payload >> 8), byte(payload)}
+		return append(rec, make([]byte, payload)...)
+	}
+
+	// Without a complete alert record at the end, both versions agree.
+	for _, data := range []string{"", "x", "data", "\x15\x03\x03", "\x15\x03\x03\x00\x00"} {
+		for _, tail := range [][]byte{
+			nil,
+			alert(0),     // no payload
+			alert(2)[:6], // payload cut short
+			alert(257),   // payload too long
+			{0x16, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}, // handshake record
+			append(alert(2), 'x'),                      // data after the alert
+		} {
+			in := append([]byte(data), tail...)
+			head, n := FindAllTrailingAlerts(in)
+			wantHead, wantN := findAllTrailingAlertsBefore(in)
+			if string(head) != string(wantHead) || n != wantN {
+				t.Errorf("FindAllTrailingAlerts(%q) = %q, %d, before %q, %d", in, head, n, wantHead, wantN)
+			}
+		}
+	}
+
+	// Complete alert records at the end, which the old version never
+	// matched, are now stripped.
+	for _, payload := range []int{1, 2, 256} {
+		in := append(append([]byte("data"), alert(payload)...), alert(2)...)
+		if head, n := findAllTrailingAlertsBefore(in); n != 0 || len(head) != len(in) {
+			t.Errorf("before, payload %d: stripped %d alerts", payload, n)
+		}
+		if head, n := FindAllTrailingAlerts(in); string(head) != "data" || n != 2 {
+			t.Errorf("payload %d: FindAllTrailingAlerts = %q, %d, want %q, 2", payload, head, n, "data")
+		}
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	config := &Config{
+		ServerName:   "example.test",
+		MinVersion:   VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []Certificate{cert},
+	}
+	RequireStrongCiphers(config)
+	out := DumpConfig(config)
+	for _, want := range []string{
+		`ServerName:            "example.test"`,
+		"TLS 1.3, TLS 1.2",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		`["h2" "http/1.1"]`,
+		"RequireStrongCiphers:  true",
+		`dns=["example.test"]`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("DumpConfig output lacks %q:\n%s", want, out)
+		}
+	}
+
+	key := cert.PrivateKey.(*ecdsa.PrivateKey)
+	for _, secret := range []string{key.D.String(), fmt.Sprintf("%x", key.D.Bytes())} {
+		if strings.Contains(out, secret) {
+			t.Errorf("DumpConfig output contains the private key:\n%s", out)
+		}
+	}
+}
+
+func TestXTLSCopyConnResult(t *testing.T) {
+	t.Run("EOF", func(t *testing.T) {
+		src, peer := net.Pipe()
+		dst, sink := xtlstest.Pipe()
+		defer dst.Close()
+		defer sink.Close()
+		go func() {
+			peer.Write([]byte("data"))
+			peer.Close()
+		}()
+		r := XTLSCopyConnResult(dst, src, false)
+		if r.End != CopyEndEOF || r.Err != nil || r.Written != 4 {
+			t.Errorf("result = %+v, want a clean EOF after 4 bytes", r)
+		}
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		src, peer := net.Pipe()
+		defer peer.Close()
+		dst, sink := xtlstest.Pipe()
+		defer dst.Close()
+		defer sink.Close()
+		src.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		r := XTLSCopyConnResult(dst, src, false)
+		if r.End != CopyEndIdleTimeout || !errors.Is(r.Err, os.ErrDeadlineExceeded) {
+			t.Errorf("result = %+v, want an idle timeout", r)
+		}
+	})
+
+	t.Run("TransportError", func(t *testing.T) {
+		src, peer := net.Pipe()
+		defer peer.Close()
+		dst, sink := xtlstest.Pipe()
+		dst.Close()
+		sink.Close()
+		go peer.Write([]byte("data"))
+		r := XTLSCopyConnResult(dst, src, false)
+		if r.End != CopyEndError || r.Err == nil {
+			t.Errorf("result = %+v, want a transport error", r)
+		}
+	})
+}
+
+func TestXTLSCopyConnOptions(t *testing.T) {
+	// throttled returns a destination whose reader waits delay before
+	// taking each 4-byte chunk.
+	throttled := func(delay time.Duration) net.Conn {
+		dst, sink := net.Pipe()
+		t.Cleanup(func() { sink.Close() })
+		go func() {
+			buf := make([]byte, 4)
+			for {
+				time.Sleep(delay)
+				if _, err := sink.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		return dst
+	}
+	source := func(data string) net.Conn {
+		src, peer := net.Pipe()
+		go func() {
+			peer.Write([]byte(data))
+			peer.Close()
+		}()
+		return src
+	}
+
+	t.Run("SlowButWithinTimeout", func(t *testing.T) {
+		dst := throttled(10 * time.Millisecond)
+		defer dst.Close()
+		r := XTLSCopyConnOptions(dst, source("datadata"), CopyOptions{WriteTimeout: time.Second})
+		if r.End != CopyEndEOF || r.Err != nil || r.Written != 8 {
+			t.Fatalf("result = %+v, want a clean EOF after 8 bytes", r)
+		}
+		if r.WriteBlocked < 20*time.Millisecond {
+			t.Errorf("WriteBlocked = %v, want at least the 20ms the destination stalled", r.WriteBlocked)
+		}
+	})
+
+	t.Run("SlowConsumer", func(t *testing.T) {
+		dst := throttled(time.Second)
+		defer dst.Close()
+		r := XTLSCopyConnOptions(dst, source("data"), CopyOptions{WriteTimeout: 30 * time.Millisecond})
+		var slow *SlowConsumerError
+		if r.End != CopyEndSlowConsumer || !errors.As(r.Err, &slow) || slow.Limit != 30*time.Millisecond {
+			t.Fatalf("result = %+v, want a slow consumer error", r)
+		}
+		if !errors.Is(r.Err, os.ErrDeadlineExceeded) {
+			t.Errorf("error %v does not wrap the deadline error", r.Err)
+		}
+		if r.WriteBlocked < 30*time.Millisecond {
+			t.Errorf("WriteBlocked = %v, want at least the 30ms timeout", r.WriteBlocked)
+		}
+	})
+}
+
+func TestStripAlertConn(t *testing.T) {
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	withAlerts := append(append([]byte("data"), alert...), alert...)
+
+	inner, peer := xtlstest.Pipe()
+	defer peer.Close()
+	conn := StripAlertConn(inner)
+	defer conn.Close()
+	if n, err := conn.Write(withAlerts); err != nil || n != len(withAlerts) {
+		t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(withAlerts))
+	}
+	conn.Write(alert)
+	conn.Write([]byte("!"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "data!" {
+		t.Fatalf("peer read %q, %v, want %q", buf, err, "data!")
+	}
+
+	// Reads pass through unless stripping reads was asked for.
+	peer.Write(withAlerts)
+	buf = make([]byte, len(withAlerts))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(withAlerts) {
+		t.Fatalf("Read = %q, %v, want the alerts passed through", buf, err)
+	}
+
+	inner, peer = xtlstest.Pipe()
+	defer peer.Close()
+	conn = StripAlertConnReads(inner)
+	defer conn.Close()
+	peer.Write(withAlerts)
+	buf = make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("Read = %q, %v, want %q", buf[:n], err, "data")
+	}
+	// A read of nothing but alerts is skipped instead of returning 0, nil.
+	peer.Write(alert)
+	peer.Close()
+	if n, err := conn.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read = %q, %v, want io.EOF", buf[:n], err)
+	}
+}
+
+func TestRecentStrippedAlerts(t *testing.T) {
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := Client(c1, &Config{})
+	conn.SetXTLSMode(XTLSModeDirect)
+
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x1a}
+	if _, err := conn.Write(append([]byte("before"), alert...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RecentStrippedAlerts(); len(got) != 0 {
+		t.Errorf("history without SetStrippedAlertHistory = %x, want none", got)
+	}
+
+	conn.SetStrippedAlertHistory(3)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(append([]byte("data"), alert...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := conn.RecentStrippedAlerts()
+	if len(got) != 3 {
+		t.Fatalf("kept %d alerts, want 3", len(got))
+	}
+	for _, rec := range got {
+		if string(rec) != string(alert) {
+			t.Errorf("stripped alert = %x, want %x", rec, alert)
+		}
+	}
+	got[0][0] = 0
+	if rec := conn.RecentStrippedAlerts()[0]; rec[0] != 0x15 {
+		t.Error("RecentStrippedAlerts returned the history itself instead of a copy")
+	}
+
+	// The ring keeps the newest records, oldest first, as it wraps.
+	conn.SetStrippedAlertHistory(3)
+	for i := byte(1); i <= 5; i++ {
+		conn.recordStrippedAlert([]byte{i})
+	}
+	got = conn.RecentStrippedAlerts()
+	if want := [][]byte{{3}, {4}, {5}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("history after wrapping = %v, want %v", got, want)
+	}
+	if n := conn.AlertsStripped(); n != 6 {
+		t.Errorf("AlertsStripped = %d, want 6", n)
+	}
+}
+
+func TestStripAlertConnReadsSplit(t *testing.T) {
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	inner, peer := net.Pipe() // each Write arrives as a separate read
+	defer peer.Close()
+	conn := StripAlertConnReads(inner)
+	defer conn.Close()
+
+	go func() {
+		for _, chunk := range [][]byte{
+			append([]byte("data"), alert[:5]...), alert[5:], []byte("more"),
+			append([]byte("x"), alert[:6]...), alert[6:],
+			[]byte("y\x15"), []byte("z"),
+			[]byte("w\x15\x03\x03"), []byte("v"),
+		} {
+			peer.Write(chunk)
+		}
+		peer.Close()
+	}()
+	buf := make([]byte, 64)
+	for _, want := range []string{"data", "more", "x", "y\x15", "z", "w\x15\x03\x03", "v"} {
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read = %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	if n, err := conn.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read = %q, %v, want io.EOF", buf[:n], err)
+	}
+}
+
+func TestXTLSReadDirectStrip(t *testing.T) {
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	withAlert := append([]byte("data"), alert...)
+
+	conn, peer := xtlstest.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	buf := make([]byte, 64)
+
+	// The plain read helper is a passthrough: alerts reach the reader.
+	peer.Write(withAlert)
+	n, err := XTLSReadDirect(conn, buf)
+	if err != nil || string(buf[:n]) != string(withAlert) {
+		t.Fatalf("XTLSReadDirect = %q, %v, want %q", buf[:n], err, withAlert)
+	}
+
+	// The stripping one drops them, skipping reads of nothing but alerts.
+	peer.Write(withAlert)
+	n, err = XTLSReadDirectStrip(conn, buf, false)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("XTLSReadDirectStrip = %q, %v, want %q", buf[:n], err, "data")
+	}
+	// A buffer the size of the alert makes the first read return only it.
+	peer.Write(append(alert, "more"...))
+	n, err = XTLSReadDirectStrip(conn, buf[:len(alert)], false)
+	if err != nil || string(buf[:n]) != "more" {
+		t.Fatalf("XTLSReadDirectStrip after an alert-only read = %q, %v, want %q", buf[:n], err, "more")
+	}
+}
+
+// shortWriteConn accepts at most max bytes per Write without an error,
+// like a writer that does not complete partial writes itself.
+type shortWriteConn struct {
+	net.Conn
+	max    int
+	writes int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	c.writes++
+	if len(b) > c.max {
+		b = b[:c.max]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWriteDirectV2(t *testing.T) {
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		max      int
+		want     string
+		stripped int
+	}{
+		{"normal", []byte("data"), 1024, "data", 0},
+		{"trailing alerts", append(append([]byte("data"), alert...), alert...), 1024, "data", 2 * len(alert)},
+		{"only alerts", alert, 1024, "", len(alert)},
+		{"short writes", append([]byte("0123456789"), alert...), 3, "0123456789", len(alert)},
+	} {
+		inner, peer := xtlstest.Pipe()
+		conn := &shortWriteConn{Conn: inner, max: tt.max}
+		written, stripped, err := WriteDirectV2(conn, tt.data, false)
+		if err != nil || written != len(tt.want) || stripped != tt.stripped {
+			t.Errorf("%s: WriteDirectV2 = %d, %d, %v, want %d, %d, nil",
+				tt.name, written, stripped, err, len(tt.want), tt.stripped)
+		}
+		if tt.max == 3 && conn.writes != 4 {
+			t.Errorf("%s: %d writes to the conn, want 4", tt.name, conn.writes)
+		}
+		inner.Close()
+		got, _ := io.ReadAll(peer)
+		if string(got) != tt.want {
+			t.Errorf("%s: peer read %q, want %q", tt.name, got, tt.want)
+		}
+		peer.Close()
+	}
+
+	// A conn that stops accepting data without an error is not retried forever.
+	inner, peer := xtlstest.Pipe()
+	defer peer.Close()
+	defer inner.Close()
+	written, _, err := WriteDirectV2(&shortWriteConn{Conn: inner}, []byte("data"), false)
+	if written != 0 || err != io.ErrShortWrite {
+		t.Errorf("WriteDirectV2 to a stalled conn = %d, %v, want 0, io.ErrShortWrite", written, err)
+	}
+}
+
+func TestConnTag(t *testing.T) {
+	defer func(orig io.Writer) { debugOutput = orig }(debugOutput)
+	var out strings.Builder
+	debugOutput = &out
+
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := Client(c1, &Config{})
+	conn.SetXTLSMode(XTLSModeDirect)
+	conn.EnableXTLSDebug(true)
+	if tag := conn.Tag(); tag != "" {
+		t.Errorf("Tag() before SetTag = %q, want none", tag)
+	}
+
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x1a}
+	conn.Write(append([]byte("data"), alert...))
+	conn.SetTag("req-7%d")
+	conn.Write(append([]byte("data"), alert...))
+	if tag := conn.Tag(); tag != "req-7%d" {
+		t.Errorf("Tag() = %q, want %q", tag, "req-7%d")
+	}
+
+	want := "[XTLS] Removed a trailing alert record from a Direct write\n" +
+		"[XTLS] [req-7%d] Removed a trailing alert record from a Direct write\n"
+	if out.String() != want {
+		t.Errorf("debug output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestRemoveBenignTrailingAlerts(t *testing.T) {
+	closeNotify := []byte{0x15, 0x03, 0x03, 0x00, 0x02, alertLevelWarning, byte(alertCloseNotify)}
+	fatal := []byte{0x15, 0x03, 0x03, 0x00, 0x02, alertLevelError, byte(alertBadRecordMAC)}
+	encrypted := append([]byte{0x15, 0x03, 0x03, 0x00, 0x1a}, make([]byte, 0x1a)...)
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	data := []byte("data")
+
+	if !IsBenignAlert(closeNotify) || IsBenignAlert(fatal) || IsBenignAlert(encrypted) {
+		t.Error("IsBenignAlert does not single out the warning close_notify")
+	}
+	for _, tt := range []struct {
+		name      string
+		in        []byte
+		head      []byte
+		count     int
+		allStrips int
+	}{
+		{"close_notify", cat(data, closeNotify), data, 1, 1},
+		{"fatal", cat(data, fatal), cat(data, fatal), 0, 1},
+		{"encrypted", cat(data, encrypted), cat(data, encrypted), 0, 1},
+		{"close_notify after fatal", cat(data, fatal, closeNotify), cat(data, fatal), 1, 2},
+		{"fatal after close_notify", cat(data, closeNotify, fatal), cat(data, closeNotify, fatal), 0, 2},
+	} {
+		head, count := RemoveBenignTrailingAlerts(tt.in)
+		if string(head) != string(tt.head) || count != tt.count {
+			t.Errorf("%s: RemoveBenignTrailingAlerts = %x, %d, want %x, %d", tt.name, head, count, tt.head, tt.count)
+		}
+		if head, count := RemoveAllTrailingAlerts(tt.in); string(head) != "data" || count != tt.allStrips {
+			t.Errorf("%s: RemoveAllTrailingAlerts = %x, %d, want all %d alerts stripped", tt.name, head, count, tt.allStrips)
+		}
+	}
+}
+
+func TestFallbackReason(t *testing.T) {
+	defer func(orig io.Writer) { debugOutput = orig }(debugOutput)
+	var out strings.Builder
+	debugOutput = &out
+
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	clientConfig := &Config{ServerName: "example.test", InsecureSkipVerify: true}
+	client, server, clientErr, serverErr := testHandshake(t, clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	server.SetOriginSignature([]byte{0x17, 0x03, 0x03})
+	server.EnableXTLSDebug(true)
+
+	buf := make([]byte, 16)
+	for _, msg := range []string{"\x17\x03", "\x01data", "more"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := server.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatalf("Read = %q, %v, want %q", buf[:n], err, msg)
+		}
+		if msg == "\x17\x03" {
+			if reason, detail := server.FallbackReason(); reason != FallbackNone {
+				t.Fatalf("FallbackReason after a matching prefix = %v, %q", reason, detail)
+			}
+		}
+	}
+
+	reason, detail := server.FallbackReason()
+	if reason != FallbackSignatureMismatch || !strings.HasPrefix(detail, "byte 2 is 0x01, want 0x03, from ") {
+		t.Errorf("FallbackReason = %v, %q, want a mismatch at byte 2", reason, detail)
+	}
+	if server.xtlsFallbackCount != 1 {
+		t.Errorf("fallback count = %d, want 1", server.xtlsFallbackCount)
+	}
+	if want := "[XTLS] Falling back to Origin logic: SignatureMismatch: " + detail + "\n"; out.String() != want {
+		t.Errorf("debug output = %q, want %q", out.String(), want)
+	}
+	if reason, _ := client.FallbackReason(); reason != FallbackNone {
+		t.Errorf("client FallbackReason = %v, want %v", reason, FallbackNone)
+	}
+
+	var state XTLSConnState
+	SetXTLSFallback(&state, FallbackSignatureMismatch, detail)
+	if !state.OriginFallback || state.FallbackReason != FallbackSignatureMismatch || state.FallbackDetail != detail {
+		t.Errorf("SetXTLSFallback left %+v", &state)
+	}
+	UpdateXTLSState(&state, "OriginFallback", false)
+	if state.FallbackReason != FallbackNone || state.FallbackDetail != "" {
+		t.Errorf("clearing OriginFallback left reason %v, %q", state.FallbackReason, state.FallbackDetail)
+	}
+}
+
+func TestAlertStrippingTLS13(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, clientErr, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	if client.vers != VersionTLS13 {
+		t.Fatalf("negotiated version %x, want TLS 1.3", client.vers)
+	}
+	client.SetXTLSMode(XTLSModeDirect)
+	server.SetXTLSMode(XTLSModeDirect)
+
+	// Application data that happens to end like an alert header is sent
+	// intact under TLS 1.3.
+	data := []byte("data\x15\x03\x03\x00\x1a")
+	if n, err := client.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(server, buf[:len(data)]); err != nil || string(buf[:len(data)]) != string(data) {
+		t.Fatalf("Read = %q, %v, want %q", buf[:len(data)], err, data)
+	}
+	if n := client.AlertsStripped(); n != 0 {
+		t.Errorf("AlertsStripped() = %d under TLS 1.3, want 0", n)
+	}
+
+	client.SetForceAlertStripping(true)
+	client.Write(append(data, "!"...))
+	client.Write(data)
+	if _, err := io.ReadFull(server, buf[:len(data)+1+4]); err != nil || string(buf[:len(data)+5]) != string(data)+"!data" {
+		t.Fatalf("Read = %q, %v, want the forced write stripped", buf[:len(data)+5], err)
+	}
+	if n := client.AlertsStripped(); n != 1 {
+		t.Errorf("AlertsStripped() = %d when forced, want 1", n)
+	}
+
+	alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	withAlert := append([]byte("data"), alert...)
+	for _, tt := range []struct {
+		version uint16
+		force   bool
+		want    string
+	}{
+		{VersionTLS12, false, "data"},
+		{0, false, "data"},
+		{VersionTLS13, false, string(withAlert)},
+		{VersionTLS13, true, "data"},
+	} {
+		if head, _ := StripTrailingAlertsForVersion(withAlert, tt.version, tt.force); string(head) != tt.want {
+			t.Errorf("StripTrailingAlertsForVersion(%x, %t) = %q, want %q", tt.version, tt.force, head, tt.want)
+		}
+	}
+}
+
+func TestBenignAlertStripping(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, clientErr, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS12}, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	client.SetXTLSMode(XTLSModeDirect)
+	server.SetXTLSMode(XTLSModeDirect)
+	client.SetBenignAlertStripping(true)
+
+	closeNotify := "\x15\x03\x03\x00\x02\x01\x00"
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		{"close_notify", "data" + closeNotify + closeNotify, "data"},
+		{"fatal alert", "data\x15\x03\x03\x00\x02\x02\x28", "data\x15\x03\x03\x00\x02\x02\x28"},
+		{"encrypted alert header", "data\x15\x03\x03\x00\x1a", "data\x15\x03\x03\x00\x1a"},
+	} {
+		if n, err := client.Write([]byte(tt.in)); n != len(tt.in) || err != nil {
+			t.Fatalf("%s: Write = %d, %v", tt.name, n, err)
+		}
+		buf := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != tt.want {
+			t.Errorf("%s: Read = %q, %v, want %q", tt.name, buf, err, tt.want)
+		}
+	}
+	if n := client.AlertsStripped(); n != 2 {
+		t.Errorf("AlertsStripped() = %d, want 2", n)
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, clientErr, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+
+	client.SetWriteBuffering(true)
+	if _, err := client.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetXTLSMode(XTLSModeDirect)
+	if err := client.CloseGracefully(time.Second); err != nil {
+		t.Fatalf("CloseGracefully: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("Read = %q, %v, want the buffered data", buf, err)
+	}
+	if n, err := server.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read after close = %d, %v, want io.EOF", n, err)
+	}
+	if !server.CleanlyClosed() {
+		t.Error("peer did not see close_notify")
+	}
+}
+
+func TestRemoveAllTrailingAlertsLargeWrite(t *testing.T) {
+	closeNotify := []byte{0x15, 0x03, 0x03, 0x00, 0x02, alertLevelWarning, byte(alertCloseNotify)}
+	encrypted := append([]byte{0x15, 0x03, 0x03, 0x00, 0x1a}, make([]byte, 0x1a)...)
+	data := bytes.Repeat([]byte("data"), 1<<20)
+	for _, alerts := range [][][]byte{
+		nil,
+		{closeNotify},
+		{encrypted, closeNotify},
+		{encrypted, encrypted, encrypted},
+	} {
+		buf := append([]byte(nil), data...)
+		for _, a := range alerts {
+			buf = append(buf, a...)
+		}
+		head, count := RemoveAllTrailingAlerts(buf)
+		wantHead, wantCount := FindAllTrailingAlerts(buf)
+		if len(head) != len(wantHead) || count != wantCount || count != len(alerts) {
+			t.Errorf("%d alerts: RemoveAllTrailingAlerts = %d bytes, %d, want %d bytes, %d",
+				len(alerts), len(head), count, len(wantHead), wantCount)
+		}
+		if &head[0] != &buf[0] {
+			t.Errorf("%d alerts: head does not alias the input", len(alerts))
+		}
+	}
+
+	// Alerts beyond the scanned tail are left in place.
+	buf := append([]byte("data"), bytes.Repeat(closeNotify, 1000)...)
+	if head, count := RemoveAllTrailingAlerts(buf); count != alertScanWindow/len(closeNotify) ||
+		len(head)+count*len(closeNotify) != len(buf) {
+		t.Errorf("run of 1000 alerts: RemoveAllTrailingAlerts = %d bytes, %d", len(head), count)
+	}
+}
+
+func BenchmarkRemoveAllTrailingAlerts(b *testing.B) {
+	closeNotify := []byte{0x15, 0x03, 0x03, 0x00, 0x02, alertLevelWarning, byte(alertCloseNotify)}
+	for _, bm := range []struct {
+		name string
+		buf  []byte
+	}{
+		{"4MB", append(make([]byte, 4<<20), closeNotify...)},
+		{"4MBOfAlerts", bytes.Repeat(closeNotify, 4<<20/len(closeNotify))},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(bm.buf)))
+			for i := 0; i < b.N; i++ {
+				RemoveAllTrailingAlerts(bm.buf)
+			}
+		})
+	}
+}
+
+// fakeClock is a settable replacement for nowFunc.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)}
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = clock.Now
+
+	state := &XTLSConnState{}
+	UpdateXTLSState(state, "DirectReady", true)
+	if !state.LastTransition.Equal(clock.Now()) {
+		t.Errorf("LastTransition = %v, want %v", state.LastTransition, clock.Now())
+	}
+	clock.Advance(time.Minute)
+	SetXTLSFallback(state, FallbackSignatureMismatch, "")
+	if !state.LastTransition.Equal(clock.Now()) {
+		t.Errorf("LastTransition after fallback = %v, want %v", state.LastTransition, clock.Now())
+	}
+
+	// The handshake takes exactly as long as the clock is advanced during it.
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	c1, c2 := xtlstest.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := Server(c1, serverConfig)
+	client := Client(c2, &Config{InsecureSkipVerify: true})
+	client.SetHandshakeProgress(func(stage string) {
+		if stage == HandshakeStageServerHelloReceived {
+			clock.Advance(150 * time.Millisecond)
+		}
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if d := client.HandshakeDuration(); d != 150*time.Millisecond {
+		t.Errorf("HandshakeDuration() = %v, want 150ms", d)
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)}
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = clock.Now
+
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t, "example.test")}}
+	client, server, clientErr, serverErr := testHandshake(t, &Config{InsecureSkipVerify: true}, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	exchange := func(from, to *Conn, msg string) {
+		t.Helper()
+		if _, err := from.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write(%q): %v", msg, err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(to, buf); err != nil || string(buf) != msg {
+			t.Fatalf("Read = %q, %v, want %q", buf, err, msg)
+		}
+	}
+
+	client.SetKeyUpdateInterval(time.Hour)
+	secret := append([]byte(nil), client.out.trafficSecret...)
+	exchange(client, server, "before")
+	if !bytes.Equal(client.out.trafficSecret, secret) {
+		t.Fatal("keys updated before the interval passed")
+	}
+
+	// Once the interval passes, the next write updates the keys first and
+	// the peer follows.
+	clock.Advance(time.Hour)
+	exchange(client, server, "after")
+	if bytes.Equal(client.out.trafficSecret, secret) {
+		t.Fatal("keys not updated after the interval")
+	}
+	if !bytes.Equal(server.in.trafficSecret, client.out.trafficSecret) {
+		t.Fatal("server did not follow the client's KeyUpdate")
+	}
+	exchange(server, client, "reply")
+
+	// A KeyUpdate requesting one back is answered on the next read.
+	server.out.Lock()
+	err := server.sendKeyUpdateLocked(true)
+	server.out.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(server, client, "requested")
+	exchange(client, server, "answered")
+	if !bytes.Equal(server.in.trafficSecret, client.out.trafficSecret) {
+		t.Fatal("client did not answer the requested KeyUpdate")
+	}
+
+	// Direct mode passes bytes through without touching the keys.
+	secret = append([]byte(nil), client.out.trafficSecret...)
+	clock.Advance(2 * time.Hour)
+	client.SetXTLSMode(XTLSModeDirect)
+	server.SetXTLSMode(XTLSModeDirect)
+	exchange(client, server, "direct")
+	if !bytes.Equal(client.out.trafficSecret, secret) {
+		t.Error("Direct mode write updated the keys")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+
+package xtlstest_test
+
+import (
+	"fmt"
+	"log"
+
+	tls "github.com/nXTLS/Go"
+	"github.com/nXTLS/Go/xtlstest"
+)
+
+// This example drives a connection from Origin mode, where data travels in
+// encrypted TLS records, into Direct mode, where it bypasses the record layer
+// and a trailing alert header is stripped before it reaches the wire.
+func Example_originToDirect() {
+	certPEM, keyPEM, err := xtlstest.KeyPair("example.test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clientRaw, serverRaw := xtlstest.Pipe()
+	client := tls.Client(clientRaw, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	server := tls.Server(serverRaw, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		log.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		log.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	client.Write([]byte("origin"))
+	n, _ := server.Read(buf)
+	fmt.Printf("%v: %q\n", server.GetXTLSMode(), buf[:n])
+
+	client.SetXTLSMode(tls.XTLSModeDirect)
+	server.SetXTLSMode(tls.XTLSModeDirect)
+	// The header of a TLS 1.2 encrypted close_notify is dropped in Direct
+	// mode. Under TLS 1.3 alerts look like application data, so nothing is
+	// stripped unless SetForceAlertStripping asks for it.
+	client.Write([]byte("direct\x15\x03\x03\x00\x1a"))
+	n, _ = server.Read(buf)
+	fmt.Printf("%v: %q\n", server.GetXTLSMode(), buf[:n])
+
+	// Output:
+	// Origin: "origin"
+	// Direct: "direct"
+}
+
+// This example scripts the bytes a server sees to check how it treats a
+// client that does not speak TLS.
+func ExampleFeed() {
+	peer, raw := xtlstest.Pipe()
+	server := tls.Server(raw, &tls.Config{})
+
+	xtlstest.Feed(peer, []byte("GET / HTTP/1.1\r\n"), []byte("Host: example.test\r\n\r\n"))
+	fmt.Println(server.Handshake())
+
+	// Output:
+	// tls: first record does not look like a TLS handshake
+}
+
+func ExampleRecord() {
+	rec := xtlstest.Records(
+		xtlstest.Record(xtlstest.RecordTypeApplicationData, []byte("hi")),
+		xtlstest.Alert(26),
+	)
+	fmt.Printf("% x\n", rec[:7])
+	fmt.Println(len(rec), tls.IsAlertRecordHeader(rec, 7))
+
+	// Output:
+	// 17 03 03 00 02 68 69
+	// 38 true
+}
@@ -0,0 +1,165 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+
+package xtlstest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nXTLS/Go/internal/deadline"
+)
+
+// Pipe creates an in-memory, full duplex network connection, similar to
+// net.Pipe. Unlike net.Pipe, writes are buffered and never wait for the peer
+// to read, which matches how a TCP socket behaves for the small amounts of
+// data used in tests and avoids lock-step deadlocks between handshaking
+// peers. Read and write deadlines are honored and fail with
+// os.ErrDeadlineExceeded.
+func Pipe() (net.Conn, net.Conn) {
+	a, b := newStream(), newStream()
+	c1 := &conn{in: a, out: b, local: pipeAddr("xtlstest-1"), remote: pipeAddr("xtlstest-2")}
+	c2 := &conn{in: b, out: a, local: pipeAddr("xtlstest-2"), remote: pipeAddr("xtlstest-1")}
+	for _, c := range []*conn{c1, c2} {
+		c.done = make(chan struct{})
+		c.readDeadline = deadline.Make()
+		c.writeDeadline = deadline.Make()
+	}
+	return c1, c2
+}
+
+type pipeAddr string
+
+func (pipeAddr) Network() string  { return "xtlstest" }
+func (a pipeAddr) String() string { return string(a) }
+
+// stream is one direction of a pipe: an unbounded queue of bytes.
+type stream struct {
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+	ready  chan struct{} // closed and replaced whenever buf or closed changes
+}
+
+func newStream() *stream {
+	return &stream{ready: make(chan struct{})}
+}
+
+// broadcastLocked wakes every goroutine waiting on s.
+func (s *stream) broadcastLocked() {
+	close(s.ready)
+	s.ready = make(chan struct{})
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.broadcastLocked()
+	}
+}
+
+type conn struct {
+	in, out       *stream
+	local, remote net.Addr
+
+	readDeadline  deadline.Deadline
+	writeDeadline deadline.Deadline
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		if isClosedChan(c.done) {
+			return 0, io.ErrClosedPipe
+		}
+		if c.readDeadline.Expired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+
+		c.in.mu.Lock()
+		if len(c.in.buf) > 0 {
+			n := copy(b, c.in.buf)
+			c.in.buf = c.in.buf[n:]
+			c.in.mu.Unlock()
+			return n, nil
+		}
+		if c.in.closed {
+			c.in.mu.Unlock()
+			return 0, io.EOF
+		}
+		ready := c.in.ready
+		c.in.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-c.readDeadline.Wait():
+		case <-c.done:
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if isClosedChan(c.done) {
+		return 0, io.ErrClosedPipe
+	}
+	if c.writeDeadline.Expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	if c.out.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.out.buf = append(c.out.buf, b...)
+	c.out.broadcastLocked()
+	return len(b), nil
+}
+
+// Close closes the conn. The peer reads any data already written followed
+// by io.EOF, and its further writes fail.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.out.close()
+		c.in.close()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
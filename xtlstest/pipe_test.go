@@ -0,0 +1,53 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+
+package xtlstest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipeDeadlines(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, 8)
+	if _, err := a.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// Clearing the deadline lets the next Read wait for data.
+	a.SetReadDeadline(time.Time{})
+	go b.Write([]byte("ok"))
+	n, err := a.Read(buf)
+	if err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("Read = %q, %v, want %q", buf[:n], err, "ok")
+	}
+
+	b.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := b.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	a, b := Pipe()
+	Feed(a, []byte("bye"))
+	a.Close()
+
+	got, err := io.ReadAll(b)
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("ReadAll = %q, %v, want %q", got, err, "bye")
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write to closed peer = %v, want %v", err, io.ErrClosedPipe)
+	}
+	if _, err := a.Read(got); err != io.ErrClosedPipe {
+		t.Errorf("Read after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2025 nXTLS contributors. MIT License.
+
+// Package xtlstest provides utilities for testing XTLS connections without
+// real sockets: an in-memory transport with working deadlines, builders for
+// raw TLS records, a throwaway certificate generator and a helper that runs
+// both sides of a handshake.
+package xtlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// TLS record content types, for use with Record.
+const (
+	RecordTypeChangeCipherSpec uint8 = 20
+	RecordTypeAlert            uint8 = 21
+	RecordTypeHandshake        uint8 = 22
+	RecordTypeApplicationData  uint8 = 23
+)
+
+// Record returns a TLS record of the given content type carrying payload,
+// with the TLS 1.2 record version used on the wire by TLS 1.2 and 1.3.
+// The payload is not encrypted; use random bytes to stand in for ciphertext.
+func Record(typ uint8, payload []byte) []byte {
+	rec := make([]byte, 5+len(payload))
+	rec[0] = typ
+	rec[1], rec[2] = 0x03, 0x03
+	rec[3], rec[4] = byte(len(payload)>>8), byte(len(payload))
+	copy(rec[5:], payload)
+	return rec
+}
+
+// Alert returns an alert record of length n, as an encrypted alert looks on
+// the wire. The common encrypted close_notify of TLS 1.2 AEAD suites has
+// n = 26.
+func Alert(n int) []byte {
+	return Record(RecordTypeAlert, make([]byte, n))
+}
+
+// Records concatenates records into a single buffer, as they would appear
+// when written in one call.
+func Records(records ...[]byte) []byte {
+	var out []byte
+	for _, r := range records {
+		out = append(out, r...)
+	}
+	return out
+}
+
+// Feed writes each chunk to w with a separate Write call, in order, so that
+// a reader sees the scripted boundaries. It stops at the first error.
+func Feed(w io.Writer, chunks ...[]byte) error {
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyPair returns a PEM-encoded, self-signed ECDSA certificate and private
+// key valid for hosts for one day, suitable for tls.X509KeyPair. Entries of
+// hosts that parse as IP addresses are added as IP SANs.
+func KeyPair(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	der, key, err := Certificate(hosts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// Certificate is like KeyPair but returns the DER-encoded certificate and
+// the key itself, ready to go in the Certificate and PrivateKey fields of a
+// tls.Certificate.
+func Certificate(hosts ...string) (der []byte, key *ecdsa.PrivateKey, err error) {
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"xtlstest"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, key, nil
+}
+
+// A Handshaker is a connection with a TLS handshake, such as a *tls.Conn
+// of this module or of crypto/tls.
+type Handshaker interface {
+	Handshake() error
+	Close() error
+}
+
+// Handshake runs the handshakes of client and server concurrently and
+// returns their errors. A side whose handshake fails is closed, so that
+// the other one does not wait for it forever.
+func Handshake(client, server Handshaker) (clientErr, serverErr error) {
+	errc := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			server.Close()
+		}
+		errc <- err
+	}()
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		client.Close()
+	}
+	return clientErr, <-errc
+}